@@ -0,0 +1,366 @@
+package dashboard
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/goleveldb/leveldb"
+	"math"
+	"os"
+	"sync"
+)
+
+const SCRIPT_INDEX_DIR_DEFAULT = "script-index"
+
+// Workers wait for the script index if it's at most this many blocks behind their block.
+// Further behind, reuse isn't measured for the block, so workers aren't held up by the
+// index being built.
+const SCRIPT_INDEX_MAX_WAIT = 144
+
+// Stored as the second height of a script that has only been seen once.
+const NOT_SEEN = math.MaxUint32
+
+// Keys in the script index. Script entries are keyed by SCRIPT_KEY_PREFIX followed by
+// the sha256 of the script, and hold the first two heights it was paid to.
+var (
+	SCRIPT_KEY_PREFIX  = []byte("s")
+	INDEXED_HEIGHT_KEY = []byte("indexed_height")
+	NETWORK_KEY        = []byte("network")
+)
+
+// ScriptIndex is a persistent on-disk record of the first two heights at which every
+// output script was paid to. Blocks are indexed strictly in height order, so the index
+// always covers every block from the genesis block up to indexedHeight. The index is
+// built in the background, in its own ordered pass up to the highest block any worker
+// needs, so reuse is measured against the whole chain before a block no matter what
+// order blocks are analyzed in.
+type ScriptIndex struct {
+	sync.Mutex
+	db            *leveldb.DB
+	indexedHeight int64
+	target        int64      // height the background pass indexes up to
+	building      bool       // whether the background pass is running
+	indexed       *sync.Cond // broadcast whenever indexedHeight changes
+}
+
+var scriptIndex *ScriptIndex
+var scriptIndexOnce sync.Once
+
+// scriptIndexDir returns the directory of the script index, which can be set with the
+// SCRIPT_INDEX_DIR environment variable.
+func scriptIndexDir() string {
+	if path := os.Getenv("SCRIPT_INDEX_DIR"); path != "" {
+		return path
+	}
+	return SCRIPT_INDEX_DIR_DEFAULT
+}
+
+// openScriptIndex returns the process-wide script index, opening it on first use.
+// An index built from one network is never used for another.
+func openScriptIndex(network string) *ScriptIndex {
+	scriptIndexOnce.Do(func() {
+		db, err := leveldb.OpenFile(scriptIndexDir(), nil)
+		if err != nil {
+			Logger{}.Fatal("Error opening script index", "dir", scriptIndexDir(), "err", err)
+		}
+
+		value, err := db.Get(NETWORK_KEY, nil)
+		if err == leveldb.ErrNotFound {
+			err = db.Put(NETWORK_KEY, []byte(network), nil)
+			if err != nil {
+				Logger{}.Fatal("Error writing script index", "dir", scriptIndexDir(), "err", err)
+			}
+		} else if err != nil {
+			Logger{}.Fatal("Error reading script index", "dir", scriptIndexDir(), "err", err)
+		} else if string(value) != network {
+			Logger{}.Fatal("Script index was built from a different network than bitcoind's", "dir", scriptIndexDir(), "index_network", string(value), "network", network)
+		}
+
+		index := &ScriptIndex{db: db, indexedHeight: -1}
+		index.indexed = sync.NewCond(&index.Mutex)
+		value, err = db.Get(INDEXED_HEIGHT_KEY, nil)
+		if err == nil {
+			index.indexedHeight = int64(binary.BigEndian.Uint64(value))
+		} else if err != leveldb.ErrNotFound {
+			Logger{}.Fatal("Error reading script index", "dir", scriptIndexDir(), "err", err)
+		}
+
+		Logger{}.Info("Opened script index", "dir", scriptIndexDir(), "indexed_height", index.indexedHeight)
+		scriptIndex = index
+	})
+
+	return scriptIndex
+}
+
+// closeScriptIndex closes the script index if it was opened, and stops the background pass.
+func closeScriptIndex() {
+	if scriptIndex != nil {
+		scriptIndex.Lock()
+		defer scriptIndex.Unlock()
+
+		scriptIndex.target = -1
+		scriptIndex.db.Close()
+	}
+}
+
+// scriptKey returns the index key for an output script.
+func scriptKey(pkScript []byte) []byte {
+	hash := sha256.Sum256(pkScript)
+	return append(append([]byte{}, SCRIPT_KEY_PREFIX...), hash[:]...)
+}
+
+// scriptHeights holds the first two heights at which a script was paid to.
+type scriptHeights struct {
+	first  uint32
+	second uint32
+}
+
+// bytes encodes the heights as they're stored in the index.
+func (heights scriptHeights) bytes() []byte {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint32(value, heights.first)
+	binary.BigEndian.PutUint32(value[4:], heights.second)
+	return value
+}
+
+// putIndexedHeight adds the new indexed height to a batch.
+func putIndexedHeight(batch *leveldb.Batch, height int64) {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(height))
+	batch.Put(INDEXED_HEIGHT_KEY, value)
+}
+
+// lookup returns the heights stored for a script, or false if it has never been seen.
+// Must be called with the index locked.
+func (index *ScriptIndex) lookup(key []byte) (scriptHeights, bool) {
+	value, err := index.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return scriptHeights{}, false
+	}
+	if err != nil {
+		Logger{}.Fatal("Error reading script index", "err", err)
+	}
+
+	return scriptHeights{binary.BigEndian.Uint32(value), binary.BigEndian.Uint32(value[4:])}, true
+}
+
+// indexBlock records every output script of the block at the given height, which must be
+// the next height after indexedHeight. Must be called with the index locked.
+func (index *ScriptIndex) indexBlock(height int64, transactions []*wire.MsgTx) {
+	if height != index.indexedHeight+1 {
+		Logger{}.Fatal("Script index can't skip blocks", "indexed_height", index.indexedHeight, "height", height)
+	}
+
+	pending := make(map[string]scriptHeights)
+	for _, tx := range transactions {
+		for _, out := range tx.TxOut {
+			if txscript.IsUnspendable(out.PkScript) {
+				continue
+			}
+
+			key := string(scriptKey(out.PkScript))
+			heights, ok := pending[key]
+			if !ok {
+				heights, ok = index.lookup([]byte(key))
+			}
+
+			if !ok {
+				heights = scriptHeights{uint32(height), NOT_SEEN}
+			} else if heights.second == NOT_SEEN {
+				heights.second = uint32(height)
+			}
+			pending[key] = heights
+		}
+	}
+
+	batch := new(leveldb.Batch)
+	for key, heights := range pending {
+		batch.Put([]byte(key), heights.bytes())
+	}
+	putIndexedHeight(batch, height)
+
+	err := index.db.Write(batch, nil)
+	if err != nil {
+		Logger{}.Fatal("Error writing script index", "height", height, "err", err)
+	}
+
+	index.indexedHeight = height
+	index.indexed.Broadcast()
+}
+
+// rewindBlock takes the block at the given height back out of the index after it was
+// reorganized away, so the block that replaces it can be indexed. Scripts first paid to
+// in the block are removed, and scripts paid to for the second time are marked as only
+// seen once. Only the highest indexed block can be rewound, and blocks that were never
+// indexed are left alone.
+func (index *ScriptIndex) rewindBlock(height int64, transactions []*wire.MsgTx) {
+	index.Lock()
+	defer index.Unlock()
+
+	if height > index.indexedHeight {
+		return
+	}
+	if height != index.indexedHeight {
+		Logger{}.Fatal("Script index can only rewind its highest block", "indexed_height", index.indexedHeight, "height", height)
+	}
+
+	batch := new(leveldb.Batch)
+	for _, tx := range transactions {
+		for _, out := range tx.TxOut {
+			if txscript.IsUnspendable(out.PkScript) {
+				continue
+			}
+
+			key := scriptKey(out.PkScript)
+			heights, ok := index.lookup(key)
+			if !ok {
+				continue
+			}
+
+			if heights.first == uint32(height) {
+				batch.Delete(key)
+			} else if heights.second == uint32(height) {
+				heights.second = NOT_SEEN
+				batch.Put(key, heights.bytes())
+			}
+		}
+	}
+	putIndexedHeight(batch, height-1)
+
+	err := index.db.Write(batch, nil)
+	if err != nil {
+		Logger{}.Fatal("Error writing script index", "height", height, "err", err)
+	}
+
+	index.indexedHeight = height - 1
+	index.indexed.Broadcast()
+}
+
+// indexTo has the background pass index every block up to and including the given
+// height, starting it if it isn't running. Must be called with the index locked.
+func (index *ScriptIndex) indexTo(height int64) {
+	if height > index.target {
+		index.target = height
+	}
+	if !index.building && index.indexedHeight < index.target {
+		index.building = true
+		go index.build()
+	}
+}
+
+// build is the background pass, which indexes blocks in order until it reaches the target.
+// It has its own clients, since it outlives the workers that start it. The index is
+// only locked while each block is written, not while it's fetched, and a worker
+// analyzing the next block may index it in the meantime.
+func (index *ScriptIndex) build() {
+	dash := setupDashboard()
+	defer dash.shutdown()
+	dash.logger = Logger{}.With("worker", "script-index")
+
+	for {
+		index.Lock()
+		next := index.indexedHeight + 1
+		if next > index.target {
+			index.building = false
+			index.Unlock()
+			return
+		}
+		index.Unlock()
+
+		start := throttleRPC()
+		hash, err := dash.client.GetBlockHash(next)
+		internal.observeRPC("getblockhash", start, err)
+		if err != nil {
+			dash.logger.Fatal("Error getting block hash", "height", next, "err", err)
+		}
+
+		start = throttleRPC()
+		block, err := dash.client.GetBlock(hash)
+		internal.observeRPC("getblock", start, err)
+		if err != nil {
+			dash.logger.Fatal("Error getting block", "height", next, "err", err)
+		}
+
+		// The index may have been closed, or the block indexed by a worker, in the meantime.
+		index.Lock()
+		if index.indexedHeight == next-1 && next <= index.target {
+			index.indexBlock(next, block.Transactions)
+		}
+		index.Unlock()
+	}
+}
+
+// AddressReuseStats counts outputs paying to, and inputs spending from, scripts that have been used before.
+type AddressReuseStats struct {
+	OutputsReusingScripts        int64
+	OutputsReusingScriptsInBlock int64
+	InputsSpendingReusedScripts  int64
+}
+
+// computeAddressReuseStats measures script reuse in a block against the script index,
+// and then adds the block to the index if it's next in line. Returns false, without
+// waiting, if the index is more than SCRIPT_INDEX_MAX_WAIT blocks behind the block.
+// An output reuses a script if the script was paid to in an earlier block, or by an
+// earlier output in the same block. An input spends from a reused script if the script
+// was paid to at least twice before this block.
+func (dash *Dashboard) computeAddressReuseStats(data *BlockData) (AddressReuseStats, bool) {
+	index := openScriptIndex(dash.network.Name)
+	index.Lock()
+	defer index.Unlock()
+
+	index.indexTo(data.Height - 1)
+	if data.Height-1-index.indexedHeight > SCRIPT_INDEX_MAX_WAIT {
+		dash.logger.Sampled(data.Height, "Script index is too far behind to measure reuse", "height", data.Height, "indexed_height", index.indexedHeight)
+		return AddressReuseStats{}, false
+	}
+	for index.indexedHeight < data.Height-1 {
+		index.indexed.Wait()
+	}
+
+	stats := AddressReuseStats{}
+	height := uint32(data.Height)
+	seenInBlock := make(map[string]bool)
+
+	for i, tx := range data.Transactions {
+		for _, out := range tx.TxOut {
+			if txscript.IsUnspendable(out.PkScript) {
+				continue
+			}
+
+			key := string(scriptKey(out.PkScript))
+			heights, ok := index.lookup([]byte(key))
+			if ok && heights.first < height {
+				stats.OutputsReusingScripts++
+			} else if seenInBlock[key] {
+				stats.OutputsReusingScripts++
+				stats.OutputsReusingScriptsInBlock++
+			}
+			seenInBlock[key] = true
+		}
+
+		// The coinbase input doesn't spend anything.
+		if i == 0 {
+			continue
+		}
+
+		for _, prevout := range data.Prevouts[i] {
+			heights, ok := index.lookup(scriptKey(prevout.PkScript))
+			if ok && heights.second != NOT_SEEN && heights.second < height {
+				stats.InputsSpendingReusedScripts++
+			}
+		}
+	}
+
+	if index.indexedHeight == data.Height-1 {
+		index.indexBlock(data.Height, data.Transactions)
+	}
+
+	return stats, true
+}
+
+func (metrics AddressReuseStats) setInfluxFields(fields map[string]interface{}) {
+	fields["num_outputs_reusing_scripts"] = metrics.OutputsReusingScripts
+	fields["num_outputs_reusing_scripts_in_block"] = metrics.OutputsReusingScriptsInBlock
+	fields["num_inputs_spending_reused_scripts"] = metrics.InputsSpendingReusedScripts
+}
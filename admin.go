@@ -0,0 +1,285 @@
+package dashboard
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Most workers a job can be resized to.
+const MAX_WORKERS = 64
+
+// controlPlane holds the state that can be changed on the running process through the admin
+// API: whether ingestion is paused, how fast RPC calls can be made, requests to write
+// buffered points right away, and the range job that's running, if any.
+type controlPlane struct {
+	sync.Mutex
+	resumed     *sync.Cond
+	paused      bool
+	rpcInterval time.Duration // minimum time between RPC calls, or 0 for no limit
+	nextRPC     time.Time
+	flushes     int64 // number of flushes requested
+	job         *rangeJob
+}
+
+// Every worker in this process is controlled together.
+var control = newControlPlane()
+
+func newControlPlane() *controlPlane {
+	c := &controlPlane{}
+	c.resumed = sync.NewCond(c)
+	return c
+}
+
+// adminAddr returns the address to serve the admin API on, which can be set with the
+// ADMIN_ADDR environment variable. Addresses starting with unix: are Unix socket paths.
+// The admin API isn't served if it's empty.
+func adminAddr() string {
+	return os.Getenv("ADMIN_ADDR")
+}
+
+func (c *controlPlane) setJob(job *rangeJob) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.job = job
+}
+
+func (c *controlPlane) currentJob() *rangeJob {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.job
+}
+
+func (c *controlPlane) isPaused() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.paused
+}
+
+func (c *controlPlane) setPaused(paused bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.paused = paused
+	c.resumed.Broadcast()
+}
+
+// waitWhilePaused blocks until ingestion is resumed, or stop returns true.
+func (c *controlPlane) waitWhilePaused(stop func() bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	for c.paused && !stop() {
+		c.resumed.Wait()
+	}
+}
+
+// wake wakes up paused workers, so they can notice that their job was cancelled.
+func (c *controlPlane) wake() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.resumed.Broadcast()
+}
+
+// requestFlush asks every worker to write its buffered points before its next block.
+func (c *controlPlane) requestFlush() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.flushes++
+}
+
+// flushCount returns the number of flushes requested. A worker that has seen a lower
+// count should write its buffered points.
+func (c *controlPlane) flushCount() int64 {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.flushes
+}
+
+// setRPCRate limits RPC calls to the given number per second, or removes the limit if it's 0.
+func (c *controlPlane) setRPCRate(perSecond float64) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.rpcInterval = 0
+	if perSecond > 0 {
+		c.rpcInterval = time.Duration(float64(time.Second) / perSecond)
+	}
+}
+
+func (c *controlPlane) rpcRate() float64 {
+	c.Lock()
+	defer c.Unlock()
+
+	// Avoid divide by 0 errors.
+	if c.rpcInterval == 0 {
+		return 0
+	}
+	return float64(time.Second) / float64(c.rpcInterval)
+}
+
+// throttleRPC waits for the next RPC call to be allowed by the rate limit, and returns the
+// time the call starts.
+func throttleRPC() time.Time {
+	control.Lock()
+	now := time.Now()
+	next := control.nextRPC
+	if next.Before(now) {
+		next = now
+	}
+	control.nextRPC = next.Add(control.rpcInterval)
+	control.Unlock()
+
+	time.Sleep(next.Sub(now))
+	return time.Now()
+}
+
+// AdminState is the response of every admin API call.
+type AdminState struct {
+	Paused  bool      `json:"paused"`
+	RPCRate float64   `json:"rpc_rate"` // calls per second, or 0 for no limit
+	Job     *JobState `json:"job,omitempty"`
+}
+
+func (c *controlPlane) state() AdminState {
+	state := AdminState{Paused: c.isPaused(), RPCRate: c.rpcRate()}
+	if job := c.currentJob(); job != nil {
+		jobState := job.state()
+		state.Job = &jobState
+	}
+	return state
+}
+
+// authorized checks the bearer token of a request against ADMIN_TOKEN, in constant time.
+func authorized(r *http.Request, token string) bool {
+	if token == "" {
+		return true
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// onlyPOST wraps a handler that changes state.
+func onlyPOST(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// adminHandler returns the admin API. Every call returns the state after the change.
+func adminHandler(token string) http.Handler {
+	respond := func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, http.StatusOK, control.state())
+	}
+	needJob := func(handler func(job *rangeJob, w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			job := control.currentJob()
+			if job == nil {
+				writeError(w, r, http.StatusConflict, "no range job is running")
+				return
+			}
+			handler(job, w, r)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/admin/state", onlyGET(respond))
+
+	mux.HandleFunc("/v1/admin/pause", onlyPOST(func(w http.ResponseWriter, r *http.Request) {
+		Logger{}.Info("Pausing ingestion")
+		control.setPaused(true)
+		respond(w, r)
+	}))
+
+	mux.HandleFunc("/v1/admin/resume", onlyPOST(func(w http.ResponseWriter, r *http.Request) {
+		Logger{}.Info("Resuming ingestion")
+		control.setPaused(false)
+		respond(w, r)
+	}))
+
+	mux.HandleFunc("/v1/admin/flush", onlyPOST(func(w http.ResponseWriter, r *http.Request) {
+		control.requestFlush()
+		respond(w, r)
+	}))
+
+	mux.HandleFunc("/v1/admin/rpc-rate", onlyPOST(func(w http.ResponseWriter, r *http.Request) {
+		perSecond, err := strconv.ParseFloat(r.URL.Query().Get("per_second"), 64)
+		if err != nil || perSecond < 0 {
+			writeError(w, r, http.StatusBadRequest, "per_second must be a number of calls per second, or 0 for no limit")
+			return
+		}
+		Logger{}.Info("Limiting RPC calls", "per_second", perSecond)
+		control.setRPCRate(perSecond)
+		respond(w, r)
+	}))
+
+	mux.HandleFunc("/v1/admin/workers", onlyPOST(needJob(func(job *rangeJob, w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(r.URL.Query().Get("n"))
+		if err != nil || n < 1 || n > MAX_WORKERS {
+			writeError(w, r, http.StatusBadRequest, "n must be a number of workers from 1 to "+strconv.Itoa(MAX_WORKERS))
+			return
+		}
+		job.resize(n)
+		respond(w, r)
+	})))
+
+	mux.HandleFunc("/v1/admin/cancel", onlyPOST(needJob(func(job *rangeJob, w http.ResponseWriter, r *http.Request) {
+		job.cancel()
+		control.wake()
+		respond(w, r)
+	})))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			writeError(w, r, http.StatusUnauthorized, "missing or wrong admin token")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// serveAdmin serves the admin API on a TCP address or, for addresses starting with unix:,
+// a Unix socket only the current user can connect to. TCP addresses need ADMIN_TOKEN.
+func serveAdmin(addr string) {
+	token := os.Getenv("ADMIN_TOKEN")
+
+	var listener net.Listener
+	var err error
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		os.Remove(path) // left over from a previous run
+
+		// The socket is created with the umask's permissions, so it's restricted while
+		// it's created rather than after it starts accepting connections.
+		umask := syscall.Umask(0177)
+		listener, err = net.Listen("unix", path)
+		syscall.Umask(umask)
+	} else {
+		if token == "" {
+			Logger{}.Fatal("ADMIN_TOKEN must be set to serve the admin API on a TCP address", "addr", addr)
+		}
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		Logger{}.Fatal("Error listening for the admin API", "addr", addr, "err", err)
+	}
+
+	Logger{}.Info("Serving the admin API", "addr", addr)
+	Logger{}.Fatal("Error serving the admin API", "addr", addr, "err", http.Serve(listener, adminHandler(token)))
+}
@@ -0,0 +1,356 @@
+package dashboard
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ALERT_WEBHOOK_TIMEOUT = 10 * time.Second
+const ALERT_OUTBOX_SIZE = 100
+
+// Statuses of alert notifications.
+const (
+	ALERT_FIRING   = "firing"
+	ALERT_RESOLVED = "resolved"
+)
+
+// Comparison operators of alert conditions. Two-character operators come first so
+// they're matched before their prefixes.
+var ALERT_OPERATORS = []string{">=", "<=", "==", "!=", ">", "<"}
+
+// An AlertRule fires when its condition holds for ForBlocks consecutive blocks, or, for
+// rules with NoBlockForMinutes set, when no block has been analyzed for that long.
+type AlertRule struct {
+	Name              string `json:"name"`
+	Condition         string `json:"condition,omitempty"`
+	ForBlocks         int64  `json:"for_blocks,omitempty"`
+	NoBlockForMinutes int64  `json:"no_block_for_minutes,omitempty"`
+}
+
+// AlertConfig is the contents of the file given by ALERTS_FILE.
+type AlertConfig struct {
+	Rules    []AlertRule `json:"rules"`
+	Webhooks []string    `json:"webhooks"`
+	File     string      `json:"file"`
+}
+
+// An Alert is a notification that a rule started or stopped firing.
+type Alert struct {
+	Rule    string    `json:"rule"`
+	Status  string    `json:"status"`
+	Network string    `json:"network"`
+	Height  int64     `json:"height,omitempty"`
+	Hash    string    `json:"hash,omitempty"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// An alertCondition compares two expressions over block_metrics fields, e.g. median_fee_rate > 200.
+type alertCondition struct {
+	left, right expression
+	op          string
+}
+
+// parseCondition splits a condition at its comparison operator and parses both sides.
+func parseCondition(source string) (alertCondition, error) {
+	for i := 0; i < len(source); i++ {
+		for _, op := range ALERT_OPERATORS {
+			if !strings.HasPrefix(source[i:], op) {
+				continue
+			}
+
+			left, err := parseExpression(source[:i])
+			if err != nil {
+				return alertCondition{}, err
+			}
+			right, err := parseExpression(source[i+len(op):])
+			if err != nil {
+				return alertCondition{}, err
+			}
+			return alertCondition{left, right, op}, nil
+		}
+	}
+
+	return alertCondition{}, fmt.Errorf("no comparison in %q", source)
+}
+
+// check returns whether the condition holds for a block, along with the value of its
+// left side. The second return value is false if a field is missing.
+func (c alertCondition) check(fields map[string]interface{}) (bool, float64, bool) {
+	left, ok := c.left.eval(fields, "")
+	if !ok {
+		return false, 0, false
+	}
+	right, ok := c.right.eval(fields, "")
+	if !ok {
+		return false, 0, false
+	}
+
+	switch c.op {
+	case ">=":
+		return left >= right, left, true
+	case "<=":
+		return left <= right, left, true
+	case "==":
+		return left == right, left, true
+	case "!=":
+		return left != right, left, true
+	case ">":
+		return left > right, left, true
+	}
+	return left < right, left, true
+}
+
+// conditionFields returns the field names used in a condition.
+func conditionFields(source string) []string {
+	fields := make([]string, 0)
+	for _, op := range ALERT_OPERATORS {
+		source = strings.Replace(source, op, " ", -1)
+	}
+
+	tokens, err := tokenize(source)
+	if err != nil {
+		return fields
+	}
+	for _, token := range tokens {
+		if isFieldNameByte(token[0]) && !(token[0] >= '0' && token[0] <= '9') {
+			fields = append(fields, token)
+		}
+	}
+	return fields
+}
+
+type alertRuleState struct {
+	AlertRule
+	condition   alertCondition
+	consecutive int64 // blocks in a row the condition has held for
+	firing      bool
+}
+
+// alertManager evaluates the alert rules and delivers notifications in order from a
+// single goroutine, so a resolve is never delivered before the alert it resolves.
+type alertManager struct {
+	sync.Mutex
+	config    AlertConfig
+	rules     []*alertRuleState
+	network   string
+	lastBlock time.Time
+	outbox    chan Alert
+}
+
+// Alert rules are evaluated on the blocks analyzed live by this process.
+var alerting alertManager
+
+// setupAlerts loads the alert rules from the file given by the ALERTS_FILE environment
+// variable and starts delivering notifications. Nothing is alerted on if it isn't set.
+func setupAlerts(network string) {
+	path := os.Getenv("ALERTS_FILE")
+	if path == "" {
+		return
+	}
+
+	contentsBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		Logger{}.Fatal("Error reading alerts file", "file", path, "err", err)
+	}
+
+	var config AlertConfig
+	err = json.Unmarshal(contentsBytes, &config)
+	if err != nil {
+		Logger{}.Fatal("Bad alerts file", "file", path, "err", err)
+	}
+
+	rules := make([]*alertRuleState, 0, len(config.Rules))
+	seen := make(map[string]bool)
+	for _, rule := range config.Rules {
+		if rule.Name == "" || seen[rule.Name] {
+			Logger{}.Fatal("Alert rules need a unique name", "file", path, "rule", rule.Name)
+		}
+		seen[rule.Name] = true
+
+		if (rule.Condition == "") == (rule.NoBlockForMinutes == 0) {
+			Logger{}.Fatal("Alert rules need either a condition or no_block_for_minutes", "file", path, "rule", rule.Name)
+		}
+		if rule.ForBlocks < 0 || rule.NoBlockForMinutes < 0 {
+			Logger{}.Fatal("Alert rule has a negative for_blocks or no_block_for_minutes", "file", path, "rule", rule.Name)
+		}
+		if rule.ForBlocks == 0 {
+			rule.ForBlocks = 1
+		}
+
+		state := &alertRuleState{AlertRule: rule}
+		if rule.Condition != "" {
+			state.condition, err = parseCondition(rule.Condition)
+			if err != nil {
+				Logger{}.Fatal("Bad condition in alert rule", "file", path, "rule", rule.Name, "err", err)
+			}
+			for _, field := range conditionFields(rule.Condition) {
+				if _, ok := lookupMetric("block_metrics", field); !ok {
+					Logger{}.Fatal("Alert rule uses a field that isn't in block_metrics", "file", path, "rule", rule.Name, "field", field)
+				}
+			}
+		}
+		rules = append(rules, state)
+	}
+
+	for _, webhook := range config.Webhooks {
+		if u, err := url.Parse(webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			Logger{}.Fatal("Bad alert webhook", "file", path, "webhook", webhook)
+		}
+	}
+
+	alerting.Lock()
+	defer alerting.Unlock()
+
+	alerting.config = config
+	alerting.rules = rules
+	alerting.network = network
+	alerting.lastBlock = time.Now()
+	alerting.outbox = make(chan Alert, ALERT_OUTBOX_SIZE)
+	go alerting.deliver(config, alerting.outbox)
+
+	Logger{}.Info("Loaded alert rules", "file", path, "rules", len(rules))
+}
+
+// notify queues a notification. Must be called with the manager locked.
+func (manager *alertManager) notify(alert Alert) {
+	alert.Network = manager.network
+	alert.Time = time.Now().UTC()
+	Logger{}.Warn("Alert "+alert.Status, "rule", alert.Rule, "height", alert.Height, "alert", alert.Message)
+
+	select {
+	case manager.outbox <- alert:
+	default:
+		Logger{}.Error("Alert outbox is full, dropping notification", "rule", alert.Rule, "height", alert.Height)
+	}
+}
+
+// evaluateBlock checks every rule against a block that was just written.
+func (manager *alertManager) evaluateBlock(height int64, fields map[string]interface{}) {
+	manager.Lock()
+	defer manager.Unlock()
+
+	manager.lastBlock = time.Now()
+	hash := fmt.Sprint(fields["hash"])
+
+	for _, rule := range manager.rules {
+		alert := Alert{Rule: rule.Name, Height: height, Hash: hash}
+
+		// A block arriving resolves a rule about blocks not arriving.
+		if rule.Condition == "" {
+			if rule.firing {
+				rule.firing = false
+				alert.Status = ALERT_RESOLVED
+				alert.Message = fmt.Sprintf("block %v arrived", height)
+				manager.notify(alert)
+			}
+			continue
+		}
+
+		// Blocks missing a field don't match, e.g. ratios of blocks with only a coinbase.
+		matches, value, _ := rule.condition.check(fields)
+		if matches {
+			rule.consecutive++
+		} else {
+			rule.consecutive = 0
+		}
+
+		if !rule.firing && rule.consecutive >= rule.ForBlocks {
+			rule.firing = true
+			alert.Status = ALERT_FIRING
+			alert.Message = fmt.Sprintf("%v for %v blocks (%v at block %v)", rule.Condition, rule.consecutive, value, height)
+			manager.notify(alert)
+		} else if rule.firing && !matches {
+			rule.firing = false
+			alert.Status = ALERT_RESOLVED
+			alert.Message = fmt.Sprintf("%v no longer holds at block %v", rule.Condition, height)
+			manager.notify(alert)
+		}
+	}
+}
+
+// checkStale fires the rules about blocks not arriving whose time has run out.
+func (manager *alertManager) checkStale(now time.Time) {
+	manager.Lock()
+	defer manager.Unlock()
+
+	for _, rule := range manager.rules {
+		if rule.Condition != "" || rule.firing {
+			continue
+		}
+
+		limit := time.Duration(rule.NoBlockForMinutes) * time.Minute
+		if now.Sub(manager.lastBlock) >= limit {
+			rule.firing = true
+			manager.notify(Alert{
+				Rule:    rule.Name,
+				Status:  ALERT_FIRING,
+				Message: fmt.Sprintf("no block for %v since %v", limit, manager.lastBlock.UTC().Format(time.RFC3339)),
+			})
+		}
+	}
+}
+
+// queueDepth returns the number of notifications waiting to be delivered.
+func (manager *alertManager) queueDepth() int {
+	manager.Lock()
+	defer manager.Unlock()
+
+	return len(manager.outbox)
+}
+
+// deliver sends queued notifications to the webhooks and appends them to the file, if set.
+func (manager *alertManager) deliver(config AlertConfig, outbox chan Alert) {
+	client := &http.Client{Timeout: ALERT_WEBHOOK_TIMEOUT}
+
+	for alert := range outbox {
+		body, err := json.Marshal(alert)
+		if err != nil {
+			Logger{}.Fatal("Error encoding alert", "rule", alert.Rule, "err", err)
+		}
+
+		if config.File != "" {
+			file, err := os.OpenFile(config.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+			if err != nil {
+				Logger{}.Error("Error opening alerts file", "file", config.File, "err", err)
+			} else {
+				_, err = file.Write(append(body, '\n'))
+				if err != nil {
+					Logger{}.Error("Error writing alert", "file", config.File, "rule", alert.Rule, "err", err)
+				}
+				file.Close()
+			}
+		}
+
+		for _, webhook := range config.Webhooks {
+			postAlert(client, webhook, body)
+		}
+	}
+}
+
+// postAlert posts a notification to a webhook, retrying up to MAX_ATTEMPTS times.
+func postAlert(client *http.Client, webhook string, body []byte) {
+	for attempts := 0; attempts <= MAX_ATTEMPTS; attempts++ {
+		res, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("status %v", res.Status)
+		}
+
+		Logger{}.Warn("Error posting alert, trying again", "webhook", webhook, "attempt", attempts+1, "err", err)
+		time.Sleep(1 * time.Second) // Sleep to give the webhook a break.
+	}
+
+	Logger{}.Error("Giving up on posting alert", "webhook", webhook, "attempt", MAX_ATTEMPTS+1)
+}
@@ -0,0 +1,155 @@
+package dashboard
+
+import (
+	influxClient "github.com/influxdata/influxdb/client/v2"
+	"math"
+	"sort"
+)
+
+// Blocks in the window ending at each block. The block is scored against the
+// ANOMALY_WINDOW-1 blocks before it, which make up its baseline.
+// Must be one of ROLLING_WINDOWS, since anomalies are computed as those windows complete.
+const ANOMALY_WINDOW = 144
+
+// Scores are only computed for fields present in at least this many baseline blocks.
+const ANOMALY_MIN_BASELINE = ANOMALY_WINDOW / 2
+
+// Robust z-scores at or above these are written to the anomalies measurement.
+// 3.5 is the usual cutoff for outliers with the modified z-score.
+const (
+	ANOMALY_WARNING  = 3.5
+	ANOMALY_CRITICAL = 7.0
+)
+
+// Fields that follow the chain's schedule rather than its usage.
+var ANOMALY_IGNORED_FIELDS = map[string]bool{
+	"height":               true,
+	"halving_epoch":        true,
+	"blocks_until_halving": true,
+	"subsidy":              true,
+}
+
+func init() {
+	found := false
+	for _, window := range ROLLING_WINDOWS {
+		found = found || window == ANOMALY_WINDOW
+	}
+	if !found {
+		Logger{}.Fatal("ANOMALY_WINDOW must be one of ROLLING_WINDOWS", "window", ANOMALY_WINDOW)
+	}
+}
+
+// median returns the median of the sorted values.
+func median(sorted []float64) float64 {
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// robustScore returns the modified z-score of a value against a baseline, using the
+// median absolute deviation (MAD). Fields that are usually constant, like most dust
+// bins, have a MAD of 0, so the mean absolute deviation is used instead. Neither is
+// allowed below minSpread, which is 1 for counts, so a spike in a field that's almost
+// always 0 is scored by its size. The last return value is false if the baseline has
+// no spread at all.
+func robustScore(value float64, baseline []float64, minSpread float64) (score, center, spread float64, ok bool) {
+	sorted := make([]float64, len(baseline))
+	copy(sorted, baseline)
+	sort.Float64s(sorted)
+	center = median(sorted)
+
+	deviations := make([]float64, len(sorted))
+	for i, v := range sorted {
+		deviations[i] = math.Abs(v - center)
+	}
+	sort.Float64s(deviations)
+	spread = median(deviations)
+
+	if spread != 0 {
+		spread = math.Max(spread, minSpread)
+		return 0.6745 * (value - center) / spread, center, spread, true
+	}
+
+	meanDeviation := 0.0
+	for _, d := range deviations {
+		meanDeviation += d
+	}
+	meanDeviation = math.Max(meanDeviation/float64(len(deviations)), minSpread)
+
+	// Avoid divide by 0 errors.
+	if meanDeviation == 0 {
+		return 0, center, 0, false
+	}
+	return (value - center) / (1.253314 * meanDeviation), center, meanDeviation, true
+}
+
+func anomalySeverity(score float64) string {
+	if math.Abs(score) >= ANOMALY_CRITICAL {
+		return "critical"
+	}
+	return "warning"
+}
+
+// anomalyPoints scores every field of the block at the given height against the
+// ANOMALY_WINDOW-1 blocks before it, and returns a point for each anomalous field.
+// Must be called with the store locked, once the window ending at the height is complete.
+func (store *rollingStore) anomalyPoints(height int64) []*influxClient.Point {
+	block := store.blocks[height]
+	points := make([]*influxClient.Point, 0)
+
+	for name, value := range block.fields {
+		if ANOMALY_IGNORED_FIELDS[name] {
+			continue
+		}
+
+		baseline := make([]float64, 0, ANOMALY_WINDOW-1)
+		for h := height - ANOMALY_WINDOW + 1; h < height; h++ {
+			if v, ok := store.blocks[h].fields[name]; ok {
+				baseline = append(baseline, v)
+			}
+		}
+		if len(baseline) < ANOMALY_MIN_BASELINE {
+			continue
+		}
+
+		minSpread := 0.0
+		if metric, ok := lookupMetric("block_metrics", name); ok && metric.Type == TYPE_INT {
+			minSpread = 1
+		}
+
+		score, center, spread, ok := robustScore(value, baseline, minSpread)
+		if !ok || math.Abs(score) < ANOMALY_WARNING {
+			continue
+		}
+
+		tags := make(map[string]string)        // for influxdb
+		fields := make(map[string]interface{}) // for influxdb
+
+		tags["field"] = name
+		tags["severity"] = anomalySeverity(score)
+		tags["network"] = block.network
+		setBlockKey(tags, fields, height, block.network)
+		fields["value"] = value
+		fields["baseline_median"] = center
+		fields["baseline_deviation"] = spread
+		fields["score"] = score
+
+		pt, err := newPoint(
+			"anomalies",
+			tags,
+			fields,
+			blockPointTime(block.time, height),
+		)
+		if err != nil {
+			Logger{}.Fatal("Error creating new point", "measurement", "anomalies", "height", height, "err", err)
+		}
+		points = append(points, pt)
+	}
+
+	if len(points) > 0 {
+		Logger{}.Info("Found anomalous fields", "height", height, "fields", len(points))
+	}
+	return points
+}
@@ -0,0 +1,422 @@
+package dashboard
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const API_ADDR_DEFAULT = ":8080"
+const API_PAGE_SIZE_DEFAULT = 100
+const API_PAGE_SIZE_MAX = 1000
+const API_CACHE_SIZE = 10000
+const API_TIP_REFRESH = 30 * time.Second
+
+// Block timestamps can be up to 2 hours ahead and needn't increase with height, so the
+// highest block is looked for among the blocks stored this long before the latest one.
+const API_TIP_WINDOW = 4 * time.Hour
+
+// A BlockResponse is the block_metrics point of a block, as returned by the API.
+type BlockResponse struct {
+	Height  int64                  `json:"height"`
+	Time    time.Time              `json:"time"`
+	Network string                 `json:"network"`
+	Tags    map[string]string      `json:"tags"`
+	Fields  map[string]interface{} `json:"fields"`
+}
+
+// A BlocksPage is a page of blocks in height order. Next is the URL of the next page,
+// and is empty on the last page.
+type BlocksPage struct {
+	Blocks []BlockResponse `json:"blocks"`
+	Next   string          `json:"next,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// blockCache keeps blocks that are deep enough in the chain that they won't be
+// reorganized, so repeated requests for them don't go to influxdb.
+type blockCache struct {
+	sync.Mutex
+	blocks     map[int64]BlockResponse
+	tip        int64
+	tipChecked time.Time
+}
+
+var apiCache = blockCache{blocks: make(map[int64]BlockResponse)}
+
+func (cache *blockCache) get(height int64) (BlockResponse, bool) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	block, ok := cache.blocks[height]
+	return block, ok
+}
+
+// add caches a block if it's at least BLOCK_NUM_DIFF blocks below the tip.
+func (cache *blockCache) add(block BlockResponse) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	if block.Height > cache.tip-BLOCK_NUM_DIFF {
+		return
+	}
+
+	// Evict an arbitrary block when full.
+	if len(cache.blocks) >= API_CACHE_SIZE {
+		for height := range cache.blocks {
+			delete(cache.blocks, height)
+			break
+		}
+	}
+	cache.blocks[block.Height] = block
+}
+
+// apiValue converts a field value read from influxdb to the type the field is registered
+// with, since query results don't distinguish integers from integral floats.
+func apiValue(name string, value interface{}) interface{} {
+	metric, ok := lookupMetric("block_metrics", name)
+	if !ok {
+		return value
+	}
+
+	switch metric.Type {
+	case TYPE_INT:
+		if f, ok := toFloat(value); ok {
+			return int64(f)
+		}
+	case TYPE_FLOAT:
+		if f, ok := toFloat(value); ok {
+			return f
+		}
+	}
+	return value
+}
+
+// blockResponse converts a block_metrics point to a BlockResponse.
+func (dash *Dashboard) blockResponse(point StoredPoint) (BlockResponse, error) {
+	height, err := point.height()
+	if err != nil {
+		return BlockResponse{}, err
+	}
+
+	block := BlockResponse{
+		Height:  height,
+		Time:    point.Time.UTC(),
+		Network: dash.network.Name,
+		Tags:    make(map[string]string),
+		Fields:  make(map[string]interface{}),
+	}
+
+	for name, value := range point.Tags {
+		if name != "height" && name != "network" && value != "" {
+			block.Tags[name] = value
+		}
+	}
+	for name, value := range point.Fields {
+		if name != "height" {
+			block.Fields[name] = apiValue(name, value)
+		}
+	}
+
+	return block, nil
+}
+
+// queryBlocks returns the blocks matching an InfluxQL condition, keyed by height. When
+// several nodes wrote the same block, the primary node's point is used.
+func (dash *Dashboard) queryBlocks(condition, suffix string) (map[int64]BlockResponse, error) {
+	query := strings.TrimSpace(fmt.Sprintf("SELECT * FROM block_metrics WHERE %v AND %v GROUP BY * %v", dash.networkCondition(), condition, suffix))
+	points, err := dash.queryPoints(query)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make(map[int64]BlockResponse)
+	for _, point := range points {
+		block, err := dash.blockResponse(point)
+		if err != nil {
+			return nil, err
+		}
+
+		if existing, ok := blocks[block.Height]; ok && existing.Tags["node"] == dash.node {
+			continue
+		}
+		blocks[block.Height] = block
+	}
+
+	return blocks, nil
+}
+
+// latestBlock returns the highest block in block_metrics.
+func (dash *Dashboard) latestBlock() (BlockResponse, bool, error) {
+	// Without GROUP BY *, last() reads one point across all series. Under schema v1
+	// every height is its own series, so grouping would read every block.
+	points, err := dash.queryPoints(fmt.Sprintf("SELECT last(hash) FROM block_metrics WHERE %v", dash.networkCondition()))
+	if err != nil {
+		return BlockResponse{}, false, err
+	}
+	if len(points) == 0 {
+		return BlockResponse{}, false, nil
+	}
+
+	since := points[0].Time.Add(-API_TIP_WINDOW)
+	blocks, err := dash.queryBlocks(fmt.Sprintf("time >= '%v'", since.UTC().Format(time.RFC3339)), "")
+	if err != nil {
+		return BlockResponse{}, false, err
+	}
+
+	latest, found := BlockResponse{}, false
+	for _, block := range blocks {
+		if !found || block.Height > latest.Height {
+			latest, found = block, true
+		}
+	}
+
+	if found {
+		apiCache.Lock()
+		apiCache.tip = latest.Height
+		apiCache.tipChecked = time.Now()
+		apiCache.Unlock()
+	}
+	return latest, found, nil
+}
+
+// refreshTip updates the height below which blocks are cached, at most every API_TIP_REFRESH.
+func (dash *Dashboard) refreshTip() error {
+	apiCache.Lock()
+	stale := time.Since(apiCache.tipChecked) > API_TIP_REFRESH
+	apiCache.Unlock()
+
+	if !stale {
+		return nil
+	}
+	_, _, err := dash.latestBlock()
+	return err
+}
+
+// blockRange returns the blocks with heights in [from, to], in height order, from the cache
+// if every block is cached and from influxdb otherwise. Heights that haven't been analyzed
+// are left out.
+func (dash *Dashboard) blockRange(from, to int64) ([]BlockResponse, error) {
+	cached := make([]BlockResponse, 0, to-from+1)
+	for h := from; h <= to; h++ {
+		block, ok := apiCache.get(h)
+		if !ok {
+			break
+		}
+		cached = append(cached, block)
+	}
+	if int64(len(cached)) == to-from+1 {
+		return cached, nil
+	}
+
+	err := dash.refreshTip()
+	if err != nil {
+		return nil, err
+	}
+
+	blocksByHeight, err := dash.queryBlocks(heightRangeCondition(from, to), "")
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make([]BlockResponse, 0, len(blocksByHeight))
+	for _, block := range blocksByHeight {
+		apiCache.add(block)
+		blocks = append(blocks, block)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Height < blocks[j].Height })
+
+	return blocks, nil
+}
+
+// writeJSON writes a JSON response with an ETag, or 304 Not Modified if the client
+// already has the same response.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, value interface{}) {
+	// Encode without HTML escaping, so links keep their &s.
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(value)
+	if err != nil {
+		Logger{}.Error("Error encoding response", "path", r.URL.Path, "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	body := buf.Bytes()
+	etag := fmt.Sprintf("\"%x\"", sha256.Sum256(body))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "application/json")
+
+	if status == http.StatusOK && r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	writeJSON(w, r, status, apiError{message})
+}
+
+// parseHeight parses a height from a path or query parameter.
+func parseHeight(value string) (int64, error) {
+	height, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || height < 0 {
+		return 0, fmt.Errorf("bad height %q", value)
+	}
+	return height, nil
+}
+
+// handleBlock serves GET /v1/blocks/{height}.
+func (dash *Dashboard) handleBlock(w http.ResponseWriter, r *http.Request) {
+	height, err := parseHeight(strings.TrimPrefix(r.URL.Path, "/v1/blocks/"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	blocks, err := dash.blockRange(height, height)
+	if err != nil {
+		dash.logger.Error("Error querying block", "height", height, "err", err)
+		writeError(w, r, http.StatusBadGateway, "error querying influxdb")
+		return
+	}
+	if len(blocks) == 0 {
+		writeError(w, r, http.StatusNotFound, fmt.Sprintf("block %v hasn't been analyzed", height))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, blocks[0])
+}
+
+// handleBlocks serves GET /v1/blocks?from=&to=&limit=. Pages cover at most limit heights,
+// and the response links to the next page until to is reached.
+func (dash *Dashboard) handleBlocks(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	from, err := parseHeight(query.Get("from"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "from: "+err.Error())
+		return
+	}
+	to, err := parseHeight(query.Get("to"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "to: "+err.Error())
+		return
+	}
+	if to < from {
+		writeError(w, r, http.StatusBadRequest, "to is below from")
+		return
+	}
+
+	limit := int64(API_PAGE_SIZE_DEFAULT)
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || limit <= 0 || limit > API_PAGE_SIZE_MAX {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("limit: must be between 1 and %v", API_PAGE_SIZE_MAX))
+			return
+		}
+	}
+
+	end := to
+	if from+limit-1 < end {
+		end = from + limit - 1
+	}
+
+	blocks, err := dash.blockRange(from, end)
+	if err != nil {
+		dash.logger.Error("Error querying blocks", "from", from, "to", end, "err", err)
+		writeError(w, r, http.StatusBadGateway, "error querying influxdb")
+		return
+	}
+
+	page := BlocksPage{Blocks: blocks}
+	if end < to {
+		page.Next = fmt.Sprintf("/v1/blocks?from=%v&to=%v&limit=%v", end+1, to, limit)
+	}
+	writeJSON(w, r, http.StatusOK, page)
+}
+
+// handleLatest serves GET /v1/latest.
+func (dash *Dashboard) handleLatest(w http.ResponseWriter, r *http.Request) {
+	block, found, err := dash.latestBlock()
+	if err != nil {
+		dash.logger.Error("Error querying latest block", "err", err)
+		writeError(w, r, http.StatusBadGateway, "error querying influxdb")
+		return
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, "no blocks have been analyzed")
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, block)
+}
+
+// handleFields serves GET /v1/fields, the registered fields of block_metrics.
+func handleFields(w http.ResponseWriter, r *http.Request) {
+	fields := make([]Metric, 0)
+	for _, metric := range registryOrder {
+		if metric.Measurement == "block_metrics" {
+			fields = append(fields, metric)
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, fields)
+}
+
+// handleOpenAPI serves GET /v1/openapi.json.
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, json.RawMessage(OPENAPI_SPEC))
+}
+
+// onlyGET wraps a handler so it rejects methods other than GET and HEAD.
+func onlyGET(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// apiHandler returns the handler for every API endpoint.
+func (dash *Dashboard) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/blocks/", onlyGET(dash.handleBlock))
+	mux.HandleFunc("/v1/blocks", onlyGET(dash.handleBlocks))
+	mux.HandleFunc("/v1/latest", onlyGET(dash.handleLatest))
+	mux.HandleFunc("/v1/fields", onlyGET(handleFields))
+	mux.HandleFunc("/v1/openapi.json", onlyGET(handleOpenAPI))
+	return mux
+}
+
+// serveCommand implements the serve subcommand, which serves block metrics from influxdb
+// over HTTP as JSON.
+func serveCommand(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addrPtr := flags.String("addr", API_ADDR_DEFAULT, "Address to listen on.")
+	flags.Parse(args)
+
+	dash := setupDashboard()
+	defer dash.shutdown()
+
+	dash.logger.Info("Serving block metrics", "network", dash.network.Name, "db", dash.DB, "addr", *addrPtr)
+	dash.logger.Fatal("Error serving the API", "addr", *addrPtr, "err", http.ListenAndServe(*addrPtr, dash.apiHandler()))
+}
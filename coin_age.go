@@ -0,0 +1,96 @@
+package dashboard
+
+import (
+	"sync"
+	"time"
+)
+
+const SATOSHIS_PER_BTC = 1e8
+
+// Upper bounds, in days, of the spent-output age bins. The last bin has no upper bound.
+// Bins = [(<1d), (1d-1w), (1w-1m), (1m-6m), (6m-1y), (1y-2y), (2y-5y), (5y+)]
+var AGE_BIN_LIMITS = []float64{1, 7, 30, 182, 365, 730, 1825}
+var AGE_BIN_NAMES = []string{"lt_1d", "1d_1w", "1w_1m", "1m_6m", "6m_1y", "1y_2y", "2y_5y", "5y_plus"}
+
+// blockTimes caches the timestamp of every block whose outputs have been spent,
+// so that each height only needs to be looked up once per process.
+var blockTimes = struct {
+	sync.Mutex
+	times map[int64]int64
+}{times: make(map[int64]int64)}
+
+// blockTime returns the timestamp of the block at the given height.
+func (dash *Dashboard) blockTime(height int64) int64 {
+	blockTimes.Lock()
+	t, ok := blockTimes.times[height]
+	blockTimes.Unlock()
+	if ok {
+		return t
+	}
+
+	header, err := dash.getBlockHeaderAtHeight(height)
+	if err != nil {
+		dash.logger.Fatal("Error getting block header", "height", height, "err", err)
+	}
+
+	blockTimes.Lock()
+	blockTimes.times[height] = header.Time
+	blockTimes.Unlock()
+
+	return header.Time
+}
+
+// ageBin returns the index of the age bin for an output that was held for the given number of days.
+func ageBin(days float64) int {
+	for i, limit := range AGE_BIN_LIMITS {
+		if days < limit {
+			return i
+		}
+	}
+	return len(AGE_BIN_LIMITS)
+}
+
+// CoinAgeStats describes the age of the outputs spent in a block, measured from the
+// time of the block that created them to the time of the block spending them.
+type CoinAgeStats struct {
+	SpentValue        int64   // in satoshis
+	CoinDaysDestroyed float64 // in BTC-days
+	AgeBinValues      []int64 // value spent from outputs in each age bin, in satoshis
+}
+
+// computeCoinAgeStats computes coin days destroyed and the value-weighted age distribution
+// of the outputs spent in a block.
+func (dash *Dashboard) computeCoinAgeStats(data *BlockData) CoinAgeStats {
+	stats := CoinAgeStats{AgeBinValues: make([]int64, len(AGE_BIN_NAMES))}
+
+	for i := 1; i < len(data.Transactions); i++ {
+		for _, prevout := range data.Prevouts[i] {
+			// Outputs created and spent in the same block have no age.
+			age := time.Duration(0)
+			if prevout.Height != data.Height {
+				age = time.Duration(data.Time-dash.blockTime(prevout.Height)) * time.Second
+			}
+
+			// Block timestamps aren't strictly increasing.
+			days := age.Hours() / 24
+			if days < 0 {
+				days = 0
+			}
+
+			stats.SpentValue += prevout.Value
+			stats.CoinDaysDestroyed += float64(prevout.Value) / SATOSHIS_PER_BTC * days
+			stats.AgeBinValues[ageBin(days)] += prevout.Value
+		}
+	}
+
+	return stats
+}
+
+func (metrics CoinAgeStats) setInfluxFields(fields map[string]interface{}) {
+	fields["spent_value"] = metrics.SpentValue
+	fields["coin_days_destroyed"] = metrics.CoinDaysDestroyed
+
+	for i, name := range AGE_BIN_NAMES {
+		fields["spent_value_age_"+name] = metrics.AgeBinValues[i]
+	}
+}
@@ -0,0 +1,412 @@
+package dashboard
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Placeholder in a derived metric that is filled in with every suffix for which
+// the field named by the numerator exists, e.g. the index of a bin.
+const WILDCARD = "{}"
+
+// A DerivedMetric is a block_metrics field computed from other fields. The numerator and
+// denominator are expressions over field names using + - * / and parentheses. If the
+// denominator is 0, any field is missing or the expression divides by 0, the field is
+// left out of the point. Metrics with a WILDCARD in their name are computed once for
+// every field matching the numerator.
+type DerivedMetric struct {
+	Name        string
+	Numerator   string
+	Denominator string // empty for metrics that aren't ratios
+	Unit        string
+}
+
+// DERIVED_METRICS are computed in order, so later metrics can use earlier ones.
+var DERIVED_METRICS = []DerivedMetric{
+	{"num_txs_creating_native_segwit_outputs", "num_txs_creating_P2WPKH + num_txs_creating_P2WSH", "", UNIT_COUNT},
+
+	// Batch ranges =  [(1), (2), (3-4), (5-9), (10-49), (50-99), (100+)]
+	{"batch_range_{}", "output_count_bin_{}", "num_txs", UNIT_RATIO},
+
+	{"percent_txs_signalling_RBF", "num_txs_signalling_rbf", "num_txs", UNIT_RATIO},
+	{"percent_txs_batching", "num_batching_txs", "num_txs", UNIT_RATIO},
+	{"percent_txs_consolidating", "num_consolidating_txs", "num_txs", UNIT_RATIO},
+	{"percent_txs_creating_native_segwit_outputs", "num_txs_creating_native_segwit_outputs", "num_txs", UNIT_RATIO},
+	{"percent_txs_creating_P2WSH_outputs", "num_txs_creating_P2WSH", "num_txs", UNIT_RATIO},
+	{"percent_txs_creating_P2WPKH_outputs", "num_txs_creating_P2WPKH", "num_txs", UNIT_RATIO},
+	{"percent_txs_spending_native_segwit_outputs", "txs_spending_native_p2wpkh_outputs + txs_spending_native_p2wsh_outputs", "num_txs", UNIT_RATIO},
+	{"percent_txs_spending_native_P2WPKH_outputs", "txs_spending_native_p2wpkh_outputs", "num_txs", UNIT_RATIO},
+	{"percent_txs_spending_native_P2WSH_outputs", "txs_spending_native_p2wsh_outputs", "num_txs", UNIT_RATIO},
+	{"percent_txs_spending_nested_P2WPKH_outputs", "txs_spending_nested_p2wpkh_outputs", "num_txs", UNIT_RATIO},
+	{"percent_txs_spending_nested_P2WSH_outputs", "txs_spending_nested_p2wsh_outputs", "num_txs", UNIT_RATIO},
+	{"percent_txs_spending_P2WSH_outputs", "txs_spending_native_p2wsh_outputs + txs_spending_nested_p2wsh_outputs", "num_txs", UNIT_RATIO},
+	{"percent_txs_spending_P2WPKH_outputs", "txs_spending_native_p2wpkh_outputs + txs_spending_nested_p2wpkh_outputs", "num_txs", UNIT_RATIO},
+	{"percent_txs_that_are_segwit_txs", "num_segwit_txs", "num_txs", UNIT_RATIO},
+	{"percent_txs_creating_P2TR_outputs", "num_txs_creating_P2TR", "num_txs", UNIT_RATIO},
+	{"percent_txs_spending_P2TR_outputs", "txs_spending_p2tr_outputs", "num_txs", UNIT_RATIO},
+
+	{"percent_of_inputs_spending_nested_P2WPKH_output", "nested_P2WPKH_outputs_spent", "num_inputs", UNIT_RATIO},
+	{"percent_of_inputs_spending_native_P2WPKH_outputs", "native_P2WPKH_outputs_spent", "num_inputs", UNIT_RATIO},
+	{"percent_of_inputs_spending_P2WPKH_outputs", "native_P2WPKH_outputs_spent + nested_P2WPKH_outputs_spent", "num_inputs", UNIT_RATIO},
+	{"percent_of_inputs_spending_nested_P2WSH_outputs", "nested_P2WSH_outputs_spent", "num_inputs", UNIT_RATIO},
+	{"percent_of_inputs_spending_native_P2WSH_outputs", "native_P2WSH_outputs_spent", "num_inputs", UNIT_RATIO},
+	{"percent_of_inputs_spending_P2WSH_outputs", "native_P2WSH_outputs_spent + nested_P2WSH_outputs_spent", "num_inputs", UNIT_RATIO},
+	{"percent_of_inputs_spending_native_sw_outputs", "native_P2WPKH_outputs_spent + native_P2WSH_outputs_spent", "num_inputs", UNIT_RATIO},
+	{"percent_of_inputs_spending_P2TR_outputs", "P2TR_outputs_spent", "num_inputs", UNIT_RATIO},
+	{"percent_of_inputs_spending_reused_scripts", "num_inputs_spending_reused_scripts", "num_inputs", UNIT_RATIO},
+	{"percent_inputs_consolidated", "num_outputs_consolidated", "num_inputs", UNIT_RATIO},
+
+	{"percent_new_outs_P2WPKH_outputs", "new_P2WPKH_outputs", "num_outputs", UNIT_RATIO},
+	{"percent_new_outs_P2WSH_outputs", "new_P2WSH_outputs", "num_outputs", UNIT_RATIO},
+	{"percent_new_outs_P2TR_outputs", "new_P2TR_outputs", "num_outputs", UNIT_RATIO},
+	{"percent_new_outs_in_dust_bin_{}", "dust_bin_{}", "num_outputs", UNIT_RATIO},
+	{"percent_new_outs_reusing_scripts", "num_outputs_reusing_scripts", "num_outputs", UNIT_RATIO},
+	{"percent_new_outs_dust", "num_dust_outputs", "num_outputs", UNIT_RATIO},
+
+	{"percent_txs_native_segwit_over_total_sw_txs", "txs_spending_native_p2wsh_outputs + txs_spending_native_p2wpkh_outputs", "num_segwit_txs", UNIT_RATIO},
+
+	{"percent_P2TR_spends_key_path", "P2TR_key_path_spends", "P2TR_outputs_spent", UNIT_RATIO},
+	{"percent_P2TR_spends_script_path", "P2TR_script_path_spends", "P2TR_outputs_spent", UNIT_RATIO},
+
+	{"percent_witness_bytes_inscriptions", "inscription_witness_bytes", "total_witness_bytes", UNIT_RATIO},
+	// Witness bytes count as one weight unit each.
+	{"percent_weight_inscriptions", "inscription_witness_bytes", "block_weight", UNIT_RATIO},
+	{"percent_weight_witness", "total_witness_bytes", "block_weight", UNIT_RATIO},
+
+	// coin_days_destroyed is in BTC-days and spent_value in satoshis.
+	{"avg_spent_output_age_days", "coin_days_destroyed * 100000000", "spent_value", UNIT_DAYS},
+	{"percent_spent_value_age_{}", "spent_value_age_{}", "spent_value", UNIT_RATIO},
+}
+
+// An expression is a parsed numerator or denominator. Field names containing the
+// WILDCARD have it replaced with the given suffix before they're looked up.
+type expression interface {
+	eval(fields map[string]interface{}, suffix string) (float64, bool)
+}
+
+type numberExpression float64
+
+type fieldExpression string
+
+type binaryExpression struct {
+	op          byte
+	left, right expression
+}
+
+func (e numberExpression) eval(fields map[string]interface{}, suffix string) (float64, bool) {
+	return float64(e), true
+}
+
+func (e fieldExpression) eval(fields map[string]interface{}, suffix string) (float64, bool) {
+	return toFloat(fields[strings.Replace(string(e), WILDCARD, suffix, 1)])
+}
+
+func (e binaryExpression) eval(fields map[string]interface{}, suffix string) (float64, bool) {
+	left, ok := e.left.eval(fields, suffix)
+	if !ok {
+		return 0, false
+	}
+	right, ok := e.right.eval(fields, suffix)
+	if !ok {
+		return 0, false
+	}
+
+	switch e.op {
+	case '+':
+		return left + right, true
+	case '-':
+		return left - right, true
+	case '*':
+		return left * right, true
+	}
+
+	// Avoid divide by 0 errors.
+	if right == 0 {
+		return 0, false
+	}
+	return left / right, true
+}
+
+// expressionParser is a recursive descent parser for derived metric expressions:
+//
+//	expr   = term { ("+" | "-") term }
+//	term   = factor { ("*" | "/") factor }
+//	factor = "-" factor | number | field | "(" expr ")"
+type expressionParser struct {
+	tokens []string
+	pos    int
+}
+
+// tokenize splits an expression into numbers, field names, operators and parentheses.
+func tokenize(source string) ([]string, error) {
+	tokens := make([]string, 0)
+
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == ' ':
+			i++
+		case strings.IndexByte("+-*/()", c) >= 0:
+			tokens = append(tokens, string(c))
+			i++
+		case isFieldNameByte(c) || (c >= '0' && c <= '9') || c == '.':
+			j := i
+			for j < len(source) && (isFieldNameByte(source[j]) || source[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, source[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q at %v", c, i)
+		}
+	}
+
+	return tokens, nil
+}
+
+func isFieldNameByte(c byte) bool {
+	return c == '_' || c == '{' || c == '}' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// parseExpression parses an expression, returning an error if it isn't well formed.
+func parseExpression(source string) (expression, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := expressionParser{tokens: tokens}
+	expr, err := parser.expr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos != len(parser.tokens) {
+		return nil, fmt.Errorf("unexpected %q", parser.tokens[parser.pos])
+	}
+	return expr, nil
+}
+
+func (p *expressionParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *expressionParser) expr() (expression, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "+" || p.peek() == "-" {
+		op := p.tokens[p.pos][0]
+		p.pos++
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpression{op, left, right}
+	}
+	return left, nil
+}
+
+func (p *expressionParser) term() (expression, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "*" || p.peek() == "/" {
+		op := p.tokens[p.pos][0]
+		p.pos++
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpression{op, left, right}
+	}
+	return left, nil
+}
+
+func (p *expressionParser) factor() (expression, error) {
+	token := p.peek()
+	p.pos++
+
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case token == "-":
+		operand, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return binaryExpression{'-', numberExpression(0), operand}, nil
+	case token == "(":
+		expr, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return expr, nil
+	case (token[0] >= '0' && token[0] <= '9') || token[0] == '.':
+		value, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", token)
+		}
+		return numberExpression(value), nil
+	case isFieldNameByte(token[0]):
+		if strings.Count(token, WILDCARD) > 1 || strings.Count(token, "{")+strings.Count(token, "}") != 2*strings.Count(token, WILDCARD) {
+			return nil, fmt.Errorf("bad field name %q", token)
+		}
+		return fieldExpression(token), nil
+	}
+
+	return nil, fmt.Errorf("unexpected %q", token)
+}
+
+// A compiledMetric is a DerivedMetric with its expressions parsed.
+type compiledMetric struct {
+	DerivedMetric
+	numerator   expression
+	denominator expression
+
+	// For metrics with a WILDCARD, the field name the numerator's matching fields are found with.
+	pattern string
+}
+
+// Parsed DERIVED_METRICS, in the same order.
+var compiledMetrics []compiledMetric
+
+// Every derived metric is checked when the program starts, so a bad definition
+// stops the dashboard before any points are written.
+func init() {
+	var err error
+	compiledMetrics, err = compileMetrics(DERIVED_METRICS)
+	if err != nil {
+		Logger{}.Fatal("Bad derived metric", "err", err)
+	}
+}
+
+// compileMetrics checks and parses derived metric definitions.
+func compileMetrics(metrics []DerivedMetric) ([]compiledMetric, error) {
+	compiled := make([]compiledMetric, 0, len(metrics))
+	seen := make(map[string]bool)
+
+	for _, metric := range metrics {
+		if seen[metric.Name] {
+			return nil, fmt.Errorf("%v is defined twice", metric.Name)
+		}
+		seen[metric.Name] = true
+
+		if metric.Unit != UNIT_RATIO && metric.Unit != UNIT_COUNT && metric.Unit != UNIT_DAYS {
+			return nil, fmt.Errorf("%v has unknown unit %q", metric.Name, metric.Unit)
+		}
+		if (metric.Unit == UNIT_RATIO && metric.Denominator == "") || (metric.Unit == UNIT_COUNT && metric.Denominator != "") {
+			return nil, fmt.Errorf("%v needs a denominator if it's a ratio, and can't have one if it's a count", metric.Name)
+		}
+
+		c := compiledMetric{DerivedMetric: metric}
+
+		var err error
+		c.numerator, err = parseExpression(metric.Numerator)
+		if err != nil {
+			return nil, fmt.Errorf("bad numerator for %v: %v", metric.Name, err)
+		}
+		if metric.Denominator != "" {
+			c.denominator, err = parseExpression(metric.Denominator)
+			if err != nil {
+				return nil, fmt.Errorf("bad denominator for %v: %v", metric.Name, err)
+			}
+		}
+
+		if strings.Contains(metric.Name, WILDCARD) {
+			c.pattern = wildcardField(c.numerator)
+			if c.pattern == "" {
+				return nil, fmt.Errorf("%v has a %v in its name but not in its numerator", metric.Name, WILDCARD)
+			}
+		}
+
+		compiled = append(compiled, c)
+	}
+
+	return compiled, nil
+}
+
+// wildcardField returns the first field name in an expression that contains the WILDCARD.
+func wildcardField(expr expression) string {
+	switch e := expr.(type) {
+	case fieldExpression:
+		if strings.Contains(string(e), WILDCARD) {
+			return string(e)
+		}
+	case binaryExpression:
+		if field := wildcardField(e.left); field != "" {
+			return field
+		}
+		return wildcardField(e.right)
+	}
+	return ""
+}
+
+// suffixes returns, in order, every string that makes the pattern a field name in fields.
+func suffixes(pattern string, fields map[string]interface{}) []string {
+	parts := strings.SplitN(pattern, WILDCARD, 2)
+	prefix, suffix := parts[0], parts[1]
+
+	matches := make([]string, 0)
+	for name := range fields {
+		if len(name) > len(prefix)+len(suffix) && strings.HasPrefix(name, prefix) && strings.HasSuffix(name, suffix) {
+			matches = append(matches, name[len(prefix):len(name)-len(suffix)])
+		}
+	}
+
+	sort.Strings(matches)
+	return matches
+}
+
+// evaluate computes the metric with the WILDCARD replaced by the given suffix.
+func (metric compiledMetric) evaluate(fields map[string]interface{}, suffix string) (interface{}, bool) {
+	value, ok := metric.numerator.eval(fields, suffix)
+	if !ok {
+		return nil, false
+	}
+
+	if metric.denominator != nil {
+		denominator, ok := metric.denominator.eval(fields, suffix)
+		// Avoid divide by 0 errors.
+		if !ok || denominator == 0 {
+			return nil, false
+		}
+		value /= denominator
+	}
+
+	// Counts are stored as integers like the fields they're computed from.
+	if metric.Unit == UNIT_COUNT {
+		return int64(value), true
+	}
+	return value, true
+}
+
+// setDerivedFields adds every derived metric that can be computed from the given fields.
+func setDerivedFields(fields map[string]interface{}) {
+	for _, metric := range compiledMetrics {
+		if metric.pattern == "" {
+			if value, ok := metric.evaluate(fields, ""); ok {
+				fields[metric.Name] = value
+			}
+			continue
+		}
+
+		for _, suffix := range suffixes(metric.pattern, fields) {
+			if value, ok := metric.evaluate(fields, suffix); ok {
+				fields[strings.Replace(metric.Name, WILDCARD, suffix, 1)] = value
+			}
+		}
+	}
+}
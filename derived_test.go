@@ -0,0 +1,275 @@
+package dashboard
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// derivedTestFields is a block whose fields give every derived metric a distinct value.
+func derivedTestFields() map[string]interface{} {
+	return map[string]interface{}{
+		"num_txs":        int64(200),
+		"num_inputs":     int64(400),
+		"num_outputs":    int64(500),
+		"num_segwit_txs": int64(100),
+
+		"num_txs_creating_P2WPKH": int64(30),
+		"num_txs_creating_P2WSH":  int64(10),
+		"num_txs_creating_P2TR":   int64(24),
+		"output_count_bin_1":      int64(120),
+		"output_count_bin_2":      int64(50),
+		"num_txs_signalling_rbf":  int64(20),
+		"num_batching_txs":        int64(50),
+		"num_consolidating_txs":   int64(8),
+
+		"txs_spending_native_p2wpkh_outputs": int64(60),
+		"txs_spending_native_p2wsh_outputs":  int64(6),
+		"txs_spending_nested_p2wpkh_outputs": int64(16),
+		"txs_spending_nested_p2wsh_outputs":  int64(2),
+		"txs_spending_p2tr_outputs":          int64(14),
+
+		"nested_P2WPKH_outputs_spent":        int64(20),
+		"native_P2WPKH_outputs_spent":        int64(100),
+		"nested_P2WSH_outputs_spent":         int64(4),
+		"native_P2WSH_outputs_spent":         int64(36),
+		"P2TR_outputs_spent":                 int64(40),
+		"P2TR_key_path_spends":               int64(30),
+		"P2TR_script_path_spends":            int64(10),
+		"num_inputs_spending_reused_scripts": int64(80),
+		"num_outputs_consolidated":           int64(12),
+
+		"new_P2WPKH_outputs":          int64(150),
+		"new_P2WSH_outputs":           int64(25),
+		"new_P2TR_outputs":            int64(50),
+		"dust_bin_0":                  int64(5),
+		"dust_bin_1":                  int64(10),
+		"num_outputs_reusing_scripts": int64(100),
+		"num_dust_outputs":            int64(15),
+
+		"inscription_witness_bytes": int64(1000),
+		"total_witness_bytes":       int64(4000),
+		"block_weight":              int64(10000),
+
+		"coin_days_destroyed": 2.5,
+		"spent_value":         int64(500000000),
+		"spent_value_age_0":   int64(100000000),
+		"spent_value_age_1":   int64(400000000),
+	}
+}
+
+// DERIVED_CASES maps every definition in DERIVED_METRICS to the fields it should produce
+// from derivedTestFields.
+var DERIVED_CASES = map[string]map[string]float64{
+	"num_txs_creating_native_segwit_outputs": {"num_txs_creating_native_segwit_outputs": 40},
+	"batch_range_{}":                         {"batch_range_1": 0.6, "batch_range_2": 0.25},
+
+	"percent_txs_signalling_RBF":                 {"percent_txs_signalling_RBF": 0.1},
+	"percent_txs_batching":                       {"percent_txs_batching": 0.25},
+	"percent_txs_consolidating":                  {"percent_txs_consolidating": 0.04},
+	"percent_txs_creating_native_segwit_outputs": {"percent_txs_creating_native_segwit_outputs": 0.2},
+	"percent_txs_creating_P2WSH_outputs":         {"percent_txs_creating_P2WSH_outputs": 0.05},
+	"percent_txs_creating_P2WPKH_outputs":        {"percent_txs_creating_P2WPKH_outputs": 0.15},
+	"percent_txs_spending_native_segwit_outputs": {"percent_txs_spending_native_segwit_outputs": 0.33},
+	"percent_txs_spending_native_P2WPKH_outputs": {"percent_txs_spending_native_P2WPKH_outputs": 0.3},
+	"percent_txs_spending_native_P2WSH_outputs":  {"percent_txs_spending_native_P2WSH_outputs": 0.03},
+	"percent_txs_spending_nested_P2WPKH_outputs": {"percent_txs_spending_nested_P2WPKH_outputs": 0.08},
+	"percent_txs_spending_nested_P2WSH_outputs":  {"percent_txs_spending_nested_P2WSH_outputs": 0.01},
+	"percent_txs_spending_P2WSH_outputs":         {"percent_txs_spending_P2WSH_outputs": 0.04},
+	"percent_txs_spending_P2WPKH_outputs":        {"percent_txs_spending_P2WPKH_outputs": 0.38},
+	"percent_txs_that_are_segwit_txs":            {"percent_txs_that_are_segwit_txs": 0.5},
+	"percent_txs_creating_P2TR_outputs":          {"percent_txs_creating_P2TR_outputs": 0.12},
+	"percent_txs_spending_P2TR_outputs":          {"percent_txs_spending_P2TR_outputs": 0.07},
+
+	"percent_of_inputs_spending_nested_P2WPKH_output":  {"percent_of_inputs_spending_nested_P2WPKH_output": 0.05},
+	"percent_of_inputs_spending_native_P2WPKH_outputs": {"percent_of_inputs_spending_native_P2WPKH_outputs": 0.25},
+	"percent_of_inputs_spending_P2WPKH_outputs":        {"percent_of_inputs_spending_P2WPKH_outputs": 0.3},
+	"percent_of_inputs_spending_nested_P2WSH_outputs":  {"percent_of_inputs_spending_nested_P2WSH_outputs": 0.01},
+	"percent_of_inputs_spending_native_P2WSH_outputs":  {"percent_of_inputs_spending_native_P2WSH_outputs": 0.09},
+	"percent_of_inputs_spending_P2WSH_outputs":         {"percent_of_inputs_spending_P2WSH_outputs": 0.1},
+	"percent_of_inputs_spending_native_sw_outputs":     {"percent_of_inputs_spending_native_sw_outputs": 0.34},
+	"percent_of_inputs_spending_P2TR_outputs":          {"percent_of_inputs_spending_P2TR_outputs": 0.1},
+	"percent_of_inputs_spending_reused_scripts":        {"percent_of_inputs_spending_reused_scripts": 0.2},
+	"percent_inputs_consolidated":                      {"percent_inputs_consolidated": 0.03},
+
+	"percent_new_outs_P2WPKH_outputs":  {"percent_new_outs_P2WPKH_outputs": 0.3},
+	"percent_new_outs_P2WSH_outputs":   {"percent_new_outs_P2WSH_outputs": 0.05},
+	"percent_new_outs_P2TR_outputs":    {"percent_new_outs_P2TR_outputs": 0.1},
+	"percent_new_outs_in_dust_bin_{}":  {"percent_new_outs_in_dust_bin_0": 0.01, "percent_new_outs_in_dust_bin_1": 0.02},
+	"percent_new_outs_reusing_scripts": {"percent_new_outs_reusing_scripts": 0.2},
+	"percent_new_outs_dust":            {"percent_new_outs_dust": 0.03},
+
+	"percent_txs_native_segwit_over_total_sw_txs": {"percent_txs_native_segwit_over_total_sw_txs": 0.66},
+
+	"percent_P2TR_spends_key_path":    {"percent_P2TR_spends_key_path": 0.75},
+	"percent_P2TR_spends_script_path": {"percent_P2TR_spends_script_path": 0.25},
+
+	"percent_witness_bytes_inscriptions": {"percent_witness_bytes_inscriptions": 0.25},
+	"percent_weight_inscriptions":        {"percent_weight_inscriptions": 0.1},
+	"percent_weight_witness":             {"percent_weight_witness": 0.4},
+
+	"avg_spent_output_age_days":  {"avg_spent_output_age_days": 0.5},
+	"percent_spent_value_age_{}": {"percent_spent_value_age_0": 0.2, "percent_spent_value_age_1": 0.8},
+}
+
+func TestDerivedMetrics(t *testing.T) {
+	fields := derivedTestFields()
+	setDerivedFields(fields)
+
+	for _, metric := range DERIVED_METRICS {
+		expected, ok := DERIVED_CASES[metric.Name]
+		if !ok {
+			t.Errorf("%v has no test case", metric.Name)
+			continue
+		}
+
+		for name, want := range expected {
+			got, ok := toFloat(fields[name])
+			if !ok {
+				t.Errorf("%v: %v wasn't set", metric.Name, name)
+				continue
+			}
+			if math.Abs(got-want) > 1e-9 {
+				t.Errorf("%v: %v = %v, want %v", metric.Name, name, got, want)
+			}
+		}
+	}
+}
+
+// The hand-written version added the native P2WSH spends twice and left out native P2WPKH.
+func TestNativeSegwitInputsRegression(t *testing.T) {
+	fields := map[string]interface{}{
+		"num_inputs":                  int64(100),
+		"native_P2WPKH_outputs_spent": int64(30),
+		"native_P2WSH_outputs_spent":  int64(5),
+	}
+	setDerivedFields(fields)
+
+	got := fields["percent_of_inputs_spending_native_sw_outputs"]
+	if got != 0.35 {
+		t.Errorf("percent_of_inputs_spending_native_sw_outputs = %v, want 0.35", got)
+	}
+}
+
+func TestDerivedCountsAreIntegers(t *testing.T) {
+	fields := derivedTestFields()
+	setDerivedFields(fields)
+
+	for _, metric := range DERIVED_METRICS {
+		if metric.Unit != UNIT_COUNT {
+			continue
+		}
+		if _, ok := fields[metric.Name].(int64); !ok {
+			t.Errorf("%v = %#v, want an int64", metric.Name, fields[metric.Name])
+		}
+	}
+}
+
+func TestDerivedZeroDenominators(t *testing.T) {
+	fields := derivedTestFields()
+	fields["num_txs"] = int64(0)
+	fields["num_inputs"] = int64(0)
+	fields["num_outputs"] = int64(0)
+	fields["num_segwit_txs"] = int64(0)
+	fields["P2TR_outputs_spent"] = int64(0)
+	fields["total_witness_bytes"] = int64(0)
+	fields["block_weight"] = int64(0)
+	fields["spent_value"] = int64(0)
+	setDerivedFields(fields)
+
+	for _, metric := range DERIVED_METRICS {
+		if metric.Denominator == "" {
+			continue
+		}
+		for name := range DERIVED_CASES[metric.Name] {
+			if value, ok := fields[name]; ok {
+				t.Errorf("%v = %v with a denominator of 0, want it left out", name, value)
+			}
+		}
+	}
+
+	// Counts don't have a denominator, so they're still computed.
+	if fields["num_txs_creating_native_segwit_outputs"] != int64(40) {
+		t.Errorf("num_txs_creating_native_segwit_outputs = %v, want 40", fields["num_txs_creating_native_segwit_outputs"])
+	}
+}
+
+func TestDerivedExpressions(t *testing.T) {
+	fields := map[string]interface{}{"a": int64(6), "b": int64(3), "zero": int64(0), "c_1": 1.5}
+
+	cases := []struct {
+		source string
+		value  float64
+		ok     bool
+	}{
+		{"a + b * 2", 12, true},
+		{"(a + b) * 2", 18, true},
+		{"a - b - 1", 2, true},
+		{"a / b / 2", 1, true},
+		{"-a + 10", 4, true},
+		{"c_{} * 2", 3, true},
+		{".5 * a", 3, true},
+		{"a / zero", 0, false},
+		{"(a / zero) * 0", 0, false},
+		{"missing + a", 0, false},
+	}
+
+	for _, c := range cases {
+		expr, err := parseExpression(c.source)
+		if err != nil {
+			t.Errorf("%q: %v", c.source, err)
+			continue
+		}
+
+		value, ok := expr.eval(fields, "1")
+		if ok != c.ok || (ok && value != c.value) {
+			t.Errorf("%q = %v, %v, want %v, %v", c.source, value, ok, c.value, c.ok)
+		}
+	}
+}
+
+func TestDerivedParserErrors(t *testing.T) {
+	for _, source := range []string{
+		"",
+		"a +",
+		"(a + b",
+		"a + b)",
+		"a b",
+		"a % b",
+		"* a",
+		"1.2.3",
+		"a_{}_{}",
+		"a_{",
+		"()",
+	} {
+		if _, err := parseExpression(source); err == nil {
+			t.Errorf("%q parsed, want an error", source)
+		}
+	}
+}
+
+func TestDerivedDefinitionErrors(t *testing.T) {
+	cases := []struct {
+		metrics []DerivedMetric
+		err     string
+	}{
+		{[]DerivedMetric{{"x", "a", "b", UNIT_RATIO}, {"x", "a", "b", UNIT_RATIO}}, "defined twice"},
+		{[]DerivedMetric{{"x", "a", "b", UNIT_BYTES}}, "unknown unit"},
+		{[]DerivedMetric{{"x", "a", "", UNIT_RATIO}}, "needs a denominator"},
+		{[]DerivedMetric{{"x", "a", "b", UNIT_COUNT}}, "needs a denominator"},
+		{[]DerivedMetric{{"x", "a +", "b", UNIT_RATIO}}, "bad numerator"},
+		{[]DerivedMetric{{"x", "a", "(b", UNIT_RATIO}}, "bad denominator"},
+		{[]DerivedMetric{{"x_{}", "a", "b", UNIT_RATIO}}, "not in its numerator"},
+	}
+
+	for _, c := range cases {
+		_, err := compileMetrics(c.metrics)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%v: got error %v, want one containing %q", c.metrics, err, c.err)
+		}
+	}
+
+	if _, err := compileMetrics(DERIVED_METRICS); err != nil {
+		t.Errorf("DERIVED_METRICS: %v", err)
+	}
+}
@@ -0,0 +1,211 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+// Expected time between blocks, in seconds.
+const TARGET_BLOCK_SPACING = 600
+
+// Number of blocks the network hashrate estimate is averaged over.
+const HASHRATE_WINDOW = 144
+
+// BlockHeader holds the fields we use from the verbose getblockheader RPC.
+// The rpcclient's GetBlockHeaderVerbose result doesn't include chainwork, so
+// the RPC response is decoded into this struct instead.
+type BlockHeader struct {
+	Hash         string  `json:"hash"`
+	Height       int64   `json:"height"`
+	Time         int64   `json:"time"`
+	MedianTime   int64   `json:"mediantime"`
+	Bits         string  `json:"bits"`
+	Difficulty   float64 `json:"difficulty"`
+	ChainWork    string  `json:"chainwork"`
+	PreviousHash string  `json:"previousblockhash"`
+}
+
+// chainWork returns the header's total chainwork as a big.Int.
+func (header *BlockHeader) chainWork() *big.Int {
+	work, ok := new(big.Int).SetString(header.ChainWork, 16)
+	if !ok {
+		Logger{}.Fatal("Bad chainwork in header", "hash", header.Hash, "height", header.Height, "chainwork", header.ChainWork)
+	}
+	return work
+}
+
+// getBlockHeader uses the getblockheader RPC to fetch the header of the block with the given hash.
+func (dash *Dashboard) getBlockHeader(hash string) (*BlockHeader, error) {
+	hashJSON, err := json.Marshal(hash)
+	if err != nil {
+		return nil, err
+	}
+	verboseJSON, err := json.Marshal(true)
+	if err != nil {
+		return nil, err
+	}
+
+	start := throttleRPC()
+	res, err := dash.client.RawRequest("getblockheader", []json.RawMessage{hashJSON, verboseJSON})
+	internal.observeRPC("getblockheader", start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	var header BlockHeader
+	err = json.Unmarshal(res, &header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &header, nil
+}
+
+// getBlockHeaderAtHeight fetches the header of the block at the given height.
+func (dash *Dashboard) getBlockHeaderAtHeight(blockHeight int64) (*BlockHeader, error) {
+	start := throttleRPC()
+	hash, err := dash.client.GetBlockHash(blockHeight)
+	internal.observeRPC("getblockhash", start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return dash.getBlockHeader(hash.String())
+}
+
+// analyzeDifficulty records difficulty, chainwork and hashrate metrics for a single block.
+// For the last block of a retarget epoch it also records a summary of the whole epoch.
+func (dash *Dashboard) analyzeDifficulty(blockHeight int64, hash string) {
+	tags := make(map[string]string)        // for influxdb
+	fields := make(map[string]interface{}) // for influxdb
+
+	header, err := dash.getBlockHeader(hash)
+	if err != nil {
+		dash.logger.Fatal("Error getting block header", "height", blockHeight, "hash", hash, "err", err)
+	}
+
+	bits, err := strconv.ParseUint(header.Bits, 16, 32)
+	if err != nil {
+		dash.logger.Fatal("Bad bits in header", "height", blockHeight, "hash", header.Hash, "bits", header.Bits)
+	}
+
+	chainWork := header.chainWork()
+	chainWorkDelta := new(big.Int).Set(chainWork)
+
+	tags["network"] = dash.network.Name
+	tags["node"] = dash.node
+	setBlockKey(tags, fields, blockHeight, dash.network.Name)
+	fields["difficulty"] = header.Difficulty
+	fields["bits"] = int64(bits)
+	fields["chainwork"], _ = new(big.Float).SetInt(chainWork).Float64()
+
+	// The genesis block has no previous block to compare against.
+	if blockHeight > 0 {
+		prevHeader, err := dash.getBlockHeader(header.PreviousHash)
+		if err != nil {
+			dash.logger.Fatal("Error getting block header", "height", blockHeight-1, "hash", header.PreviousHash, "err", err)
+		}
+
+		chainWorkDelta.Sub(chainWork, prevHeader.chainWork())
+		fields["time_since_prev_block"] = header.Time - prevHeader.Time
+
+		// On the testnets a block that comes long enough after the previous one may be
+		// mined at the minimum difficulty, which says nothing about the hashrate.
+		if dash.network.MinDifficultyTime > 0 {
+			fields["min_difficulty"] = header.Time-prevHeader.Time > dash.network.MinDifficultyTime &&
+				uint32(bits) == dash.network.ChainParams.PowLimitBits
+		}
+	}
+	fields["chainwork_delta"], _ = new(big.Float).SetInt(chainWorkDelta).Float64()
+
+	// Estimate hashrate as the work done over the last HASHRATE_WINDOW blocks
+	// divided by the time it took to do it.
+	if blockHeight >= HASHRATE_WINDOW {
+		windowStart, err := dash.getBlockHeaderAtHeight(blockHeight - HASHRATE_WINDOW)
+		if err != nil {
+			dash.logger.Fatal("Error getting block header", "height", blockHeight-HASHRATE_WINDOW, "err", err)
+		}
+
+		elapsed := header.Time - windowStart.Time
+		if elapsed > 0 {
+			work := new(big.Int).Sub(chainWork, windowStart.chainWork())
+			hashrate := new(big.Float).Quo(new(big.Float).SetInt(work), big.NewFloat(float64(elapsed)))
+			fields["hashrate_estimate"], _ = hashrate.Float64()
+		}
+	}
+
+	pt, err := newPoint(
+		"difficulty",
+		tags,
+		fields,
+		blockPointTime(time.Unix(header.Time, 0), blockHeight),
+	)
+	if err != nil {
+		dash.logger.Fatal("Error creating new point", "measurement", "difficulty", "height", blockHeight, "err", err)
+	}
+
+	dash.bp.AddPoint(pt)
+
+	if interval := dash.network.RetargetInterval; interval > 0 && (blockHeight+1)%interval == 0 {
+		dash.analyzeRetargetEpoch(header)
+	}
+}
+
+// analyzeRetargetEpoch records a summary of the retarget epoch ending with the given header.
+// The actual duration is measured the same way consensus does: from the first block
+// of the epoch to the last, which spans RetargetInterval-1 block intervals.
+func (dash *Dashboard) analyzeRetargetEpoch(lastHeader *BlockHeader) {
+	tags := make(map[string]string)        // for influxdb
+	fields := make(map[string]interface{}) // for influxdb
+
+	interval := dash.network.RetargetInterval
+	epoch := lastHeader.Height / interval
+	firstHeader, err := dash.getBlockHeaderAtHeight(epoch * interval)
+	if err != nil {
+		dash.logger.Fatal("Error getting block header", "height", epoch*interval, "err", err)
+	}
+
+	expectedDuration := interval * TARGET_BLOCK_SPACING
+	actualDuration := lastHeader.Time - firstHeader.Time
+
+	// The difficulty adjustment is clamped to the network's retarget factor in either direction.
+	factor := dash.network.RetargetFactor
+	adjustment := factor
+	if actualDuration > 0 {
+		adjustment = float64(expectedDuration) / float64(actualDuration)
+	}
+	if adjustment > factor {
+		adjustment = factor
+	} else if adjustment < 1/factor {
+		adjustment = 1 / factor
+	}
+
+	tags["epoch"] = strconv.Itoa(int(epoch))
+	tags["network"] = dash.network.Name
+	tags["node"] = dash.node
+	fields["start_height"] = firstHeader.Height
+	fields["end_height"] = lastHeader.Height
+	// The first block of an epoch always has the retargeted difficulty, while on the
+	// testnets any later block may be a minimum difficulty block.
+	fields["difficulty"] = firstHeader.Difficulty
+	fields["expected_duration"] = expectedDuration
+	fields["actual_duration"] = actualDuration
+	fields["duration_ratio"] = float64(actualDuration) / float64(expectedDuration)
+	fields["avg_block_interval"] = float64(actualDuration) / float64(interval-1)
+	fields["next_difficulty_adjustment"] = adjustment
+
+	pt, err := newPoint(
+		"difficulty_epochs",
+		tags,
+		fields,
+		time.Unix(lastHeader.Time, 0),
+	)
+	if err != nil {
+		dash.logger.Fatal("Error creating new point", "measurement", "difficulty_epochs", "height", lastHeader.Height, "err", err)
+	}
+
+	dash.logger.Info("Finished retarget epoch", "epoch", epoch, "height", lastHeader.Height, "took", time.Duration(actualDuration)*time.Second, "expected", time.Duration(expectedDuration)*time.Second)
+	dash.bp.AddPoint(pt)
+}
@@ -0,0 +1,466 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const GRAFANA_DATASOURCE = "${DS_BTC_DASHBOARD}"
+const GRAFANA_PANEL_WIDTH = 12
+const GRAFANA_PANEL_HEIGHT = 9
+const GRAFANA_ROW_HEIGHT = 1
+
+// Measurements whose points are tagged with the pool that mined the block.
+var GRAFANA_POOL_MEASUREMENTS = map[string]bool{
+	"block_metrics":             true,
+	"script_types":              true,
+	"op_return":                 true,
+	"inscription_content_types": true,
+}
+
+// GRAFANA_UNITS maps units to Grafana's y-axis formats. Units without a Grafana
+// format are shown as plain numbers with the unit as the axis label.
+var GRAFANA_UNITS = map[string]string{
+	UNIT_BYTES:   "decbytes",
+	UNIT_RATIO:   "percentunit",
+	UNIT_COUNT:   "short",
+	UNIT_SECONDS: "s",
+	UNIT_DAYS:    "d",
+	UNIT_NONE:    "none",
+}
+
+// A GrafanaSeries is a line in a panel. The alias is used as its name in the legend.
+type GrafanaSeries struct {
+	Field string
+	Alias string
+}
+
+// A GrafanaPanel graphs the mean of each series over Grafana's interval. If GroupByTag is
+// set, a panel with a single series draws a line for each value of the tag instead.
+type GrafanaPanel struct {
+	Title       string
+	Measurement string
+	Series      []GrafanaSeries
+	GroupByTag  string
+	Stack       bool
+}
+
+type GrafanaRow struct {
+	Title  string
+	Panels []GrafanaPanel
+}
+
+// binSeries returns a series for each bin of a field with a WILDCARD, named by the given aliases.
+func binSeries(pattern string, aliases []string) []GrafanaSeries {
+	s := make([]GrafanaSeries, 0, len(aliases))
+	for i, alias := range aliases {
+		s = append(s, GrafanaSeries{strings.Replace(pattern, WILDCARD, fmt.Sprint(i), 1), alias})
+	}
+	return s
+}
+
+var BATCH_RANGE_ALIASES = []string{"1 output", "2 outputs", "3-4 outputs", "5-9 outputs", "10-49 outputs", "50-99 outputs", "100+ outputs"}
+
+var DUST_BIN_ALIASES = []string{"Dust at 1 sat/vB", "Dust at 3 sat/vB", "Dust at 5 sat/vB", "Dust at 8 sat/vB", "Dust at 10 sat/vB",
+	"Dust at 15 sat/vB", "Dust at 20 sat/vB", "Dust at 25 sat/vB", "Dust at 30 sat/vB", "Dust at 40 sat/vB", "Dust at 50 sat/vB",
+	"Dust at 60 sat/vB", "Dust at 70 sat/vB", "Dust at 80 sat/vB", "Dust at 90 sat/vB", "Dust at 100 sat/vB", "Dust at 150 sat/vB",
+	"Dust at 200 sat/vB", "Dust at 250 sat/vB", "Dust at 350 sat/vB", "Dust at 500 sat/vB", "Dust at 1000 sat/vB"}
+
+// GRAFANA_ROWS defines the dashboard written by the grafana command.
+var GRAFANA_ROWS = []GrafanaRow{
+	{"Transactions", []GrafanaPanel{
+		{"Transactions per block", "block_metrics", []GrafanaSeries{{"num_txs", "Number of transactions"}}, "", false},
+		{"Batching Metrics", "block_metrics", binSeries("batch_range_{}", BATCH_RANGE_ALIASES), "", true},
+		{"Consolidation", "block_metrics", []GrafanaSeries{
+			{"num_consolidating_txs", "Number of consolidating transactions"},
+			{"num_outputs_consolidated", "Number of outputs consolidated"},
+		}, "", false},
+		{"Percent of inputs in block consolidated", "block_metrics", []GrafanaSeries{{"percent_inputs_consolidated", "Percent Consolidated"}}, "", false},
+		{"RBF Usage", "block_metrics", []GrafanaSeries{{"percent_txs_signalling_RBF", "RBF-signalling transactions"}}, "", false},
+		{"Address Reuse", "block_metrics", []GrafanaSeries{
+			{"percent_new_outs_reusing_scripts", "Outputs reusing scripts"},
+			{"percent_of_inputs_spending_reused_scripts", "Inputs spending reused scripts"},
+		}, "", false},
+	}},
+	{"Fees and Value", []GrafanaPanel{
+		{"Fee Rates", "block_metrics", []GrafanaSeries{
+			{"min_fee_rate", "Min"},
+			{"median_fee_rate", "Median"},
+			{"avg_fee_rate", "Average"},
+		}, "", false},
+		{"Total Fee", "block_metrics", []GrafanaSeries{{"total_fee", "Total fee"}}, "", false},
+		{"Volume", "block_metrics", []GrafanaSeries{{"volume_btc", "Volume"}}, "", false},
+		{"Age of Spent Outputs", "block_metrics", []GrafanaSeries{{"avg_spent_output_age_days", "Average age"}}, "", false},
+	}},
+	{"SegWit and Taproot", []GrafanaPanel{
+		{"Transactions creating SegWit Outputs", "block_metrics", []GrafanaSeries{
+			{"num_txs_creating_P2WPKH", "Transactions creating P2WPKH Outputs"},
+			{"num_txs_creating_P2WSH", "Transactions creating P2WSH Outputs"},
+			{"num_txs_creating_P2TR", "Transactions creating P2TR Outputs"},
+		}, "", false},
+		{"Transactions spending from SegWit address", "block_metrics", []GrafanaSeries{
+			{"percent_txs_spending_native_P2WPKH_outputs", "native"},
+			{"percent_txs_spending_nested_P2WPKH_outputs", "nested"},
+			{"percent_txs_that_are_segwit_txs", "percent segwit"},
+		}, "", false},
+		{"SegWit Outputs Created", "block_metrics", []GrafanaSeries{
+			{"new_P2WPKH_outputs", "P2WPKH Outputs"},
+			{"new_P2WSH_outputs", "P2WSH Outputs"},
+			{"new_P2TR_outputs", "P2TR Outputs"},
+		}, "", false},
+		{"Inputs spending from SegWit output", "block_metrics", []GrafanaSeries{
+			{"percent_of_inputs_spending_P2WPKH_outputs", "Outputs spending P2WPKH"},
+			{"percent_of_inputs_spending_P2WSH_outputs", "Outputs spending P2WSH"},
+			{"percent_of_inputs_spending_P2TR_outputs", "Outputs spending P2TR"},
+		}, "", false},
+		{"Taproot Spends", "block_metrics", []GrafanaSeries{
+			{"percent_P2TR_spends_key_path", "Key path"},
+			{"percent_P2TR_spends_script_path", "Script path"},
+		}, "", true},
+		{"Inscriptions", "block_metrics", []GrafanaSeries{
+			{"percent_weight_inscriptions", "Share of block weight"},
+			{"percent_witness_bytes_inscriptions", "Share of witness bytes"},
+		}, "", false},
+	}},
+	{"Script Types", []GrafanaPanel{
+		{"New Outputs by Script Type", "script_types", []GrafanaSeries{{"percent_new_outs", "$tag_script_type"}}, "script_type", false},
+		{"Inputs Spent by Script Type", "script_types", []GrafanaSeries{{"percent_of_inputs_spending", "$tag_script_type"}}, "script_type", false},
+		{"OP_RETURN Payloads by Protocol", "op_return", []GrafanaSeries{{"payload_bytes", "$tag_protocol"}}, "protocol", true},
+		{"Inscriptions by Content Type", "inscription_content_types", []GrafanaSeries{{"num_inscriptions", "$tag_content_type"}}, "content_type", true},
+	}},
+	{"UTXO Set", []GrafanaPanel{
+		{"UTXO Set Size Change", "block_metrics", []GrafanaSeries{{"utxo_size_increase", "Change in size"}}, "", false},
+		{"UTXO Set Change", "block_metrics", []GrafanaSeries{{"utxo_increase", "Number of outputs"}}, "", false},
+		{"New Dust Outputs", "block_metrics", binSeries("dust_bin_{}", DUST_BIN_ALIASES), "", false},
+		{"Dust at the Relay Fee", "block_metrics", []GrafanaSeries{{"percent_new_outs_dust", "Share of new outputs"}}, "", false},
+	}},
+	{"Mining", []GrafanaPanel{
+		{"Difficulty", "difficulty", []GrafanaSeries{{"difficulty", "Difficulty"}}, "", false},
+		{"Hashrate", "difficulty", []GrafanaSeries{{"hashrate_estimate", "Estimated hashrate"}}, "", false},
+		{"Time Between Blocks", "difficulty", []GrafanaSeries{{"time_since_prev_block", "Time since previous block"}}, "", false},
+		{"Blocks by Pool", "block_metrics", []GrafanaSeries{{"num_txs", "$tag_pool"}}, "pool", true},
+	}},
+	{"Anomalies", []GrafanaPanel{
+		{"Anomaly Scores by Field", "anomalies", []GrafanaSeries{{"score", "$tag_field"}}, "field", false},
+	}},
+}
+
+// unit returns the unit shared by every series in a panel.
+func (panel GrafanaPanel) unit() (string, error) {
+	unit := ""
+	for _, s := range panel.Series {
+		metric, ok := lookupMetric(panel.Measurement, s.Field)
+		if !ok {
+			return "", fmt.Errorf("panel %q uses field %v of %v, which isn't registered", panel.Title, s.Field, panel.Measurement)
+		}
+		if unit != "" && metric.Unit != unit {
+			return "", fmt.Errorf("panel %q mixes units %v and %v", panel.Title, unit, metric.Unit)
+		}
+		unit = metric.Unit
+	}
+	return unit, nil
+}
+
+// query returns the InfluxQL query for a series, filtered by the dashboard's variables.
+func (panel GrafanaPanel) query(s GrafanaSeries) string {
+	conditions := []string{"\"network\" =~ /^$network$/"}
+	if GRAFANA_POOL_MEASUREMENTS[panel.Measurement] {
+		conditions = append(conditions, "\"pool\" =~ /^$pool$/")
+	}
+	conditions = append(conditions, "$timeFilter")
+
+	groupBy := "time($__interval)"
+	if panel.GroupByTag != "" {
+		groupBy += fmt.Sprintf(", \"%v\"", panel.GroupByTag)
+	}
+
+	// Counting blocks per pool counts points rather than averaging the field.
+	aggregate := "mean"
+	if panel.GroupByTag == "pool" {
+		aggregate = "count"
+	}
+
+	return fmt.Sprintf("SELECT %v(\"%v\") FROM \"%v\" WHERE %v GROUP BY %v fill(null)",
+		aggregate, s.Field, panel.Measurement, strings.Join(conditions, " AND "), groupBy)
+}
+
+// json returns the Grafana graph panel.
+func (panel GrafanaPanel) json(id, x, y int) map[string]interface{} {
+	unit, err := panel.unit()
+	if err != nil {
+		Logger{}.Fatal("Bad Grafana panel", "panel", panel.Title, "err", err)
+	}
+	if panel.GroupByTag == "pool" {
+		unit = UNIT_BLOCKS
+	}
+
+	format, ok := GRAFANA_UNITS[unit]
+	label := interface{}(nil)
+	if !ok {
+		format = "short"
+		label = unit
+	}
+
+	targets := make([]map[string]interface{}, 0, len(panel.Series))
+	for i, s := range panel.Series {
+		targets = append(targets, map[string]interface{}{
+			"alias":        s.Alias,
+			"query":        panel.query(s),
+			"rawQuery":     true,
+			"refId":        string(rune('A' + i)),
+			"resultFormat": "time_series",
+		})
+	}
+
+	return map[string]interface{}{
+		"id":            id,
+		"type":          "graph",
+		"title":         panel.Title,
+		"datasource":    GRAFANA_DATASOURCE,
+		"gridPos":       map[string]int{"h": GRAFANA_PANEL_HEIGHT, "w": GRAFANA_PANEL_WIDTH, "x": x, "y": y},
+		"targets":       targets,
+		"stack":         panel.Stack,
+		"fill":          1,
+		"lines":         true,
+		"linewidth":     1,
+		"nullPointMode": "null",
+		"legend": map[string]interface{}{
+			"show": true, "alignAsTable": true, "rightSide": true, "values": true, "avg": true,
+		},
+		"tooltip": map[string]interface{}{"shared": true, "sort": 0, "value_type": "individual"},
+		"xaxis":   map[string]interface{}{"mode": "time", "show": true, "values": []string{}},
+		"yaxes": []map[string]interface{}{
+			{"format": format, "label": label, "logBase": 1, "show": true},
+			{"format": "short", "logBase": 1, "show": false},
+		},
+	}
+}
+
+// templateVariable returns a dashboard variable with the values of a tag of block_metrics.
+func templateVariable(name string, includeAll bool) map[string]interface{} {
+	variable := map[string]interface{}{
+		"name":       name,
+		"label":      strings.Title(name),
+		"type":       "query",
+		"datasource": GRAFANA_DATASOURCE,
+		"query":      fmt.Sprintf("SHOW TAG VALUES FROM \"block_metrics\" WITH KEY = \"%v\"", name),
+		"refresh":    1,
+		"sort":       1,
+		"includeAll": includeAll,
+		"multi":      includeAll,
+		"current":    map[string]interface{}{},
+		"options":    []string{},
+	}
+	if includeAll {
+		variable["allValue"] = ".*"
+	}
+	return variable
+}
+
+// grafanaDashboard builds the Grafana dashboard for GRAFANA_ROWS.
+func grafanaDashboard() map[string]interface{} {
+	panels := make([]map[string]interface{}, 0)
+	id, y := 1, 0
+	for _, row := range GRAFANA_ROWS {
+		panels = append(panels, map[string]interface{}{
+			"id":        id,
+			"type":      "row",
+			"title":     row.Title,
+			"collapsed": false,
+			"panels":    []string{},
+			"gridPos":   map[string]int{"h": GRAFANA_ROW_HEIGHT, "w": 2 * GRAFANA_PANEL_WIDTH, "x": 0, "y": y},
+		})
+		id++
+		y += GRAFANA_ROW_HEIGHT
+
+		for i, panel := range row.Panels {
+			x := (i % 2) * GRAFANA_PANEL_WIDTH
+			panels = append(panels, panel.json(id, x, y+(i/2)*GRAFANA_PANEL_HEIGHT))
+			id++
+		}
+		y += (len(row.Panels) + 1) / 2 * GRAFANA_PANEL_HEIGHT
+	}
+
+	return map[string]interface{}{
+		"__inputs": []map[string]interface{}{{
+			"name": "DS_BTC_DASHBOARD", "label": "btc-dashboard", "description": "",
+			"type": "datasource", "pluginId": "influxdb", "pluginName": "InfluxDB",
+		}},
+		"__requires": []map[string]interface{}{
+			{"type": "grafana", "id": "grafana", "name": "Grafana", "version": "5.1.3"},
+			{"type": "panel", "id": "graph", "name": "Graph", "version": "5.0.0"},
+			{"type": "datasource", "id": "influxdb", "name": "InfluxDB", "version": "5.0.0"},
+		},
+		"title":         "Bitcoin Blockchain",
+		"uid":           "btc-dashboard",
+		"editable":      true,
+		"graphTooltip":  1,
+		"schemaVersion": 16,
+		"version":       1,
+		"refresh":       false,
+		"tags":          []string{"bitcoin"},
+		"time":          map[string]string{"from": "now-90d", "to": "now"},
+		"timepicker":    map[string]interface{}{},
+		"timezone":      "utc",
+		"annotations":   map[string]interface{}{"list": []string{}},
+		"links":         []string{},
+		"templating": map[string]interface{}{
+			"list": []map[string]interface{}{
+				templateVariable("network", false),
+				templateVariable("pool", true),
+			},
+		},
+		"panels": panels,
+	}
+}
+
+var queryMeasurement = regexp.MustCompile(`(?i)\bFROM\s+"?([\w.]+)"?`)
+var queryFields = regexp.MustCompile(`\w+\(\s*"([^"]+)"\s*\)`)
+
+// targetFields returns the measurement and fields used by a Grafana InfluxDB target, from
+// its raw query if it's in raw mode and from the query builder otherwise.
+func targetFields(target map[string]interface{}) (string, []string) {
+	measurement, _ := target["measurement"].(string)
+	fields := make([]string, 0)
+
+	if raw, _ := target["rawQuery"].(bool); raw {
+		query, _ := target["query"].(string)
+		if m := queryMeasurement.FindStringSubmatch(query); m != nil {
+			measurement = m[1]
+		}
+		for _, m := range queryFields.FindAllStringSubmatch(query, -1) {
+			fields = append(fields, m[1])
+		}
+		return measurement, fields
+	}
+
+	selects, _ := target["select"].([]interface{})
+	for _, parts := range selects {
+		partList, _ := parts.([]interface{})
+		for _, part := range partList {
+			p, _ := part.(map[string]interface{})
+			if p["type"] != "field" {
+				continue
+			}
+			params, _ := p["params"].([]interface{})
+			for _, param := range params {
+				fields = append(fields, fmt.Sprint(param))
+			}
+		}
+	}
+	return measurement, fields
+}
+
+// collectPanels returns every panel in a dashboard, including those nested in rows.
+func collectPanels(dashboard map[string]interface{}) []map[string]interface{} {
+	panels := make([]map[string]interface{}, 0)
+
+	var add func(list interface{})
+	add = func(list interface{}) {
+		items, _ := list.([]interface{})
+		for _, item := range items {
+			panel, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			panels = append(panels, panel)
+			add(panel["panels"])
+		}
+	}
+
+	add(dashboard["panels"])
+	// Dashboards from before Grafana 5 keep panels in rows.
+	rows, _ := dashboard["rows"].([]interface{})
+	for _, row := range rows {
+		if r, ok := row.(map[string]interface{}); ok {
+			add(r["panels"])
+		}
+	}
+	return panels
+}
+
+// checkGrafanaDashboard returns a problem for every query in a dashboard file that uses a
+// field the ingester doesn't write.
+func checkGrafanaDashboard(path string) ([]string, error) {
+	contentsBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var dashboard map[string]interface{}
+	err = json.Unmarshal(contentsBytes, &dashboard)
+	if err != nil {
+		return nil, err
+	}
+
+	return checkDashboardQueries(dashboard), nil
+}
+
+// checkDashboardQueries returns a problem for every query in a dashboard that uses a
+// field the ingester doesn't write.
+func checkDashboardQueries(dashboard map[string]interface{}) []string {
+	problems := make([]string, 0)
+	for _, panel := range collectPanels(dashboard) {
+		targets, _ := panel["targets"].([]interface{})
+		for _, t := range targets {
+			target, _ := t.(map[string]interface{})
+			measurement, fields := targetFields(target)
+
+			for _, field := range fields {
+				// Fields chosen by dashboard variables can't be checked.
+				if strings.Contains(field, "$") || strings.Contains(measurement, "$") {
+					continue
+				}
+				if _, ok := lookupMetric(measurement, field); !ok {
+					problems = append(problems, fmt.Sprintf("panel %q (%v): %v isn't a field of %v", panel["title"], target["refId"], field, measurement))
+				}
+			}
+		}
+	}
+
+	sort.Strings(problems)
+	return problems
+}
+
+// grafanaCommand implements the grafana subcommand, which prints the dashboard JSON or,
+// with -check, checks the queries in an existing dashboard.
+func grafanaCommand(args []string) {
+	flags := flag.NewFlagSet("grafana", flag.ExitOnError)
+	checkPtr := flags.String("check", "", "Dashboard JSON file to check instead of generating one.")
+	flags.Parse(args)
+
+	if *checkPtr != "" {
+		problems, err := checkGrafanaDashboard(*checkPtr)
+		if err != nil {
+			Logger{}.Fatal("Error reading dashboard", "file", *checkPtr, "err", err)
+		}
+		for _, problem := range problems {
+			Logger{}.Error(problem, "file", *checkPtr)
+		}
+		if len(problems) > 0 {
+			Logger{}.Fatal("Queries use fields that aren't written", "file", *checkPtr, "queries", len(problems))
+		}
+		Logger{}.Info("Every query uses fields that are written", "file", *checkPtr)
+		return
+	}
+
+	contentsBytes, err := grafanaDashboardJSON()
+	if err != nil {
+		Logger{}.Fatal("Error encoding dashboard", "err", err)
+	}
+	fmt.Print(string(contentsBytes))
+}
+
+// grafanaDashboardJSON returns the dashboard as it's committed in grafana-dashboard-import.json.
+func grafanaDashboardJSON() ([]byte, error) {
+	contentsBytes, err := json.MarshalIndent(grafanaDashboard(), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(contentsBytes, '\n'), nil
+}
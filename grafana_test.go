@@ -0,0 +1,64 @@
+package dashboard
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const GRAFANA_DASHBOARD_FILE = "grafana-dashboard-import.json"
+
+// The committed dashboard has to be regenerated whenever panels or fields change.
+func TestGrafanaDashboardIsCurrent(t *testing.T) {
+	generated, err := grafanaDashboardJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	committed, err := ioutil.ReadFile(GRAFANA_DASHBOARD_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(generated, committed) {
+		generatedLines := strings.Split(string(generated), "\n")
+		committedLines := strings.Split(string(committed), "\n")
+		for i := 0; i < len(generatedLines) && i < len(committedLines); i++ {
+			if generatedLines[i] != committedLines[i] {
+				t.Fatalf("%v is out of date at line %v: got %q, generated %q; regenerate it with ./btc-dashboard grafana", GRAFANA_DASHBOARD_FILE, i+1, committedLines[i], generatedLines[i])
+			}
+		}
+		t.Fatalf("%v is out of date: it has %v lines, the generated dashboard has %v", GRAFANA_DASHBOARD_FILE, len(committedLines), len(generatedLines))
+	}
+}
+
+func TestGrafanaDashboardFields(t *testing.T) {
+	problems, err := checkGrafanaDashboard(GRAFANA_DASHBOARD_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, problem := range problems {
+		t.Error(problem)
+	}
+}
+
+// The check has to catch fields that aren't written, or passing it means nothing.
+func TestGrafanaDashboardFieldsCheck(t *testing.T) {
+	generated, err := grafanaDashboardJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dashboard map[string]interface{}
+	err = json.Unmarshal(bytes.Replace(generated, []byte(`mean(\"num_txs\")`), []byte(`mean(\"num_unwritten_field\")`), 1), &dashboard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	problems := checkDashboardQueries(dashboard)
+	if len(problems) != 1 || !strings.Contains(problems[0], "num_unwritten_field isn't a field of block_metrics") {
+		t.Fatalf("expected one problem with num_unwritten_field, got %q", problems)
+	}
+}
@@ -0,0 +1,289 @@
+package dashboard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"strings"
+	"time"
+)
+
+// Protocol identifier pushed at the start of an ordinal inscription envelope.
+var INSCRIPTION_PROTOCOL_ID = []byte("ord")
+
+// Content type used for inscriptions that don't declare one.
+const UNKNOWN_CONTENT_TYPE = "unknown"
+
+// Content type used for inscriptions that declare a type not in INSCRIPTION_CONTENT_TYPES.
+const OTHER_CONTENT_TYPE = "other"
+
+// Content types that get their own content_type tag value. The declared type is arbitrary
+// data, so anything else is counted as OTHER_CONTENT_TYPE to keep the tag's cardinality bounded.
+var INSCRIPTION_CONTENT_TYPES = map[string]bool{
+	"application/json":          true,
+	"application/pdf":           true,
+	"application/pgp-signature": true,
+	"application/octet-stream":  true,
+	"application/x-gzip":        true,
+	"application/yaml":          true,
+	"audio/flac":                true,
+	"audio/mpeg":                true,
+	"audio/wav":                 true,
+	"font/otf":                  true,
+	"font/ttf":                  true,
+	"font/woff":                 true,
+	"font/woff2":                true,
+	"image/apng":                true,
+	"image/avif":                true,
+	"image/gif":                 true,
+	"image/jpeg":                true,
+	"image/png":                 true,
+	"image/svg+xml":             true,
+	"image/webp":                true,
+	"model/gltf+json":           true,
+	"model/gltf-binary":         true,
+	"model/stl":                 true,
+	"text/css":                  true,
+	"text/html":                 true,
+	"text/javascript":           true,
+	"text/markdown":             true,
+	"text/plain":                true,
+	"video/mp4":                 true,
+	"video/webm":                true,
+}
+
+// A scriptOp is a single opcode in a script along with the data it pushes, if any.
+type scriptOp struct {
+	opcode byte
+	data   []byte
+}
+
+// parseScriptOps splits a script into opcodes. Parsing stops at the first
+// push that runs past the end of the script.
+func parseScriptOps(script []byte) []scriptOp {
+	ops := make([]scriptOp, 0)
+
+	for i := 0; i < len(script); {
+		opcode := script[i]
+		i++
+
+		dataLen := 0
+		switch {
+		case opcode >= txscript.OP_DATA_1 && opcode <= txscript.OP_DATA_75:
+			dataLen = int(opcode)
+		case opcode == txscript.OP_PUSHDATA1:
+			if i+1 > len(script) {
+				return ops
+			}
+			dataLen = int(script[i])
+			i++
+		case opcode == txscript.OP_PUSHDATA2:
+			if i+2 > len(script) {
+				return ops
+			}
+			dataLen = int(binary.LittleEndian.Uint16(script[i:]))
+			i += 2
+		case opcode == txscript.OP_PUSHDATA4:
+			if i+4 > len(script) {
+				return ops
+			}
+			dataLen = int(binary.LittleEndian.Uint32(script[i:]))
+			i += 4
+		}
+
+		if dataLen < 0 || i+dataLen > len(script) {
+			return ops
+		}
+
+		ops = append(ops, scriptOp{opcode, script[i : i+dataLen]})
+		i += dataLen
+	}
+
+	return ops
+}
+
+// An Inscription is an ordinal-style envelope found in a tapscript.
+type Inscription struct {
+	ContentType string
+	BodyBytes   int64
+}
+
+// isEmptyPush returns true for OP_0, which is how envelopes mark the start of the body.
+func (op scriptOp) isEmptyPush() bool {
+	return op.opcode == txscript.OP_0
+}
+
+// isTag returns true if the opcode pushes the given single-byte envelope tag,
+// either as data or as a small-integer opcode.
+func (op scriptOp) isTag(tag byte) bool {
+	if len(op.data) == 1 && op.data[0] == tag {
+		return true
+	}
+	return tag >= 1 && tag <= 16 && op.opcode == txscript.OP_1+tag-1
+}
+
+// findInscriptions returns every envelope of the form
+// OP_FALSE OP_IF "ord" [<tag> <value>]... [OP_0 <body>...] OP_ENDIF in a tapscript.
+func findInscriptions(tapscript []byte) []Inscription {
+	ops := parseScriptOps(tapscript)
+	inscriptions := make([]Inscription, 0)
+
+	for i := 0; i+2 < len(ops); i++ {
+		if !ops[i].isEmptyPush() || ops[i+1].opcode != txscript.OP_IF || !bytes.Equal(ops[i+2].data, INSCRIPTION_PROTOCOL_ID) {
+			continue
+		}
+
+		inscription := Inscription{ContentType: UNKNOWN_CONTENT_TYPE}
+		inBody := false
+		j := i + 3
+		for ; j < len(ops) && ops[j].opcode != txscript.OP_ENDIF; j++ {
+			switch {
+			case inBody:
+				inscription.BodyBytes += int64(len(ops[j].data))
+			case ops[j].isEmptyPush():
+				inBody = true
+			case ops[j].isTag(1) && j+1 < len(ops):
+				inscription.ContentType = normalizeContentType(string(ops[j+1].data))
+				j++
+			default:
+				// Skip the value of any other tag.
+				j++
+			}
+		}
+
+		inscriptions = append(inscriptions, inscription)
+		i = j
+	}
+
+	return inscriptions
+}
+
+// normalizeContentType strips parameters such as charset from a MIME type, and maps
+// types that aren't in INSCRIPTION_CONTENT_TYPES to OTHER_CONTENT_TYPE, so that the
+// content_type tag doesn't grow without bound.
+func normalizeContentType(contentType string) string {
+	contentType = strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+	if contentType == "" {
+		return UNKNOWN_CONTENT_TYPE
+	}
+	if !INSCRIPTION_CONTENT_TYPES[contentType] {
+		return OTHER_CONTENT_TYPE
+	}
+	return contentType
+}
+
+// tapscript returns the script of a taproot script-path spend, which is the
+// second-to-last witness element once any annex is removed.
+func tapscript(witness wire.TxWitness) []byte {
+	witness = withoutAnnex(witness)
+	if len(witness) < 2 {
+		return nil
+	}
+	return witness[len(witness)-2]
+}
+
+// witnessSize returns the number of bytes an input's witness takes up in its transaction.
+// Inputs without a witness only count if another input in the transaction has one,
+// so they're treated as taking up no space.
+func witnessSize(witness wire.TxWitness) int64 {
+	if len(witness) == 0 {
+		return 0
+	}
+	return int64(witness.SerializeSize())
+}
+
+// InscriptionStats counts inscription envelopes in a block and the block space they use.
+type InscriptionStats struct {
+	Inscriptions            int64
+	TxsWithInscriptions     int64
+	ContentBytes            int64
+	InscriptionWitnessBytes int64
+	TotalWitnessBytes       int64
+	TotalWeight             int64 // including the coinbase, unlike getblockstats' total_weight
+
+	ContentTypeCounts map[string]int64
+	ContentTypeBytes  map[string]int64
+}
+
+// computeInscriptionStats looks for inscription envelopes in the taproot script-path spends of a block.
+func computeInscriptionStats(data *BlockData) InscriptionStats {
+	stats := InscriptionStats{
+		ContentTypeCounts: make(map[string]int64),
+		ContentTypeBytes:  make(map[string]int64),
+	}
+
+	for i, tx := range data.Transactions {
+		stats.TotalWeight += int64(tx.SerializeSizeStripped()*3 + tx.SerializeSize())
+
+		hasInscription := false
+		for j, in := range tx.TxIn {
+			witnessBytes := witnessSize(in.Witness)
+			stats.TotalWitnessBytes += witnessBytes
+
+			if i == 0 || !isP2TR(data.Prevouts[i][j].PkScript) || isTaprootKeyPathSpend(in.Witness) {
+				continue
+			}
+
+			inscriptions := findInscriptions(tapscript(in.Witness))
+			if len(inscriptions) == 0 {
+				continue
+			}
+
+			hasInscription = true
+			stats.InscriptionWitnessBytes += witnessBytes
+			for _, inscription := range inscriptions {
+				stats.Inscriptions++
+				stats.ContentBytes += inscription.BodyBytes
+				stats.ContentTypeCounts[inscription.ContentType]++
+				stats.ContentTypeBytes[inscription.ContentType] += inscription.BodyBytes
+			}
+		}
+
+		if hasInscription {
+			stats.TxsWithInscriptions++
+		}
+	}
+
+	return stats
+}
+
+func (metrics InscriptionStats) setInfluxFields(fields map[string]interface{}) {
+	fields["num_inscriptions"] = metrics.Inscriptions
+	fields["num_txs_with_inscriptions"] = metrics.TxsWithInscriptions
+	fields["inscription_content_bytes"] = metrics.ContentBytes
+	fields["inscription_witness_bytes"] = metrics.InscriptionWitnessBytes
+	fields["total_witness_bytes"] = metrics.TotalWitnessBytes
+	fields["block_weight"] = metrics.TotalWeight
+}
+
+// analyzeInscriptionContentTypes adds a point to the inscription_content_types measurement
+// for each content type inscribed in the block, tagged with content_type in addition to
+// the block's tags.
+func (dash *Dashboard) analyzeInscriptionContentTypes(height int64, stats InscriptionStats, blockTags map[string]string, blockTime time.Time) {
+	for contentType, count := range stats.ContentTypeCounts {
+		tags := make(map[string]string)        // for influxdb
+		fields := make(map[string]interface{}) // for influxdb
+
+		for k, v := range blockTags {
+			tags[k] = v
+		}
+		tags["content_type"] = contentType
+		setBlockKey(tags, fields, height, tags["network"])
+
+		fields["num_inscriptions"] = count
+		fields["content_bytes"] = stats.ContentTypeBytes[contentType]
+
+		pt, err := newPoint(
+			"inscription_content_types",
+			tags,
+			fields,
+			blockTime,
+		)
+		if err != nil {
+			dash.logger.Fatal("Error creating new point", "measurement", "inscription_content_types", "height", height, "err", err)
+		}
+
+		dash.bp.AddPoint(pt)
+	}
+}
@@ -0,0 +1,414 @@
+package dashboard
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the latency histogram buckets, in seconds.
+var LATENCY_BUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Upper bounds of the batch size histogram buckets, in points.
+var BATCH_SIZE_BUCKETS = []float64{1, 10, 100, 1000, 10000, 100000}
+
+// Prefix of the names on the metrics endpoint.
+const INTERNAL_METRICS_PREFIX = "btc_dashboard_"
+
+// dashboard_internal points are written at most this often, along with the next batch.
+const INTERNAL_POINT_INTERVAL = 30 * time.Second
+
+// Fields of each worker's dashboard_internal point, and their names on the metrics endpoint.
+var INTERNAL_WORKER_FIELDS = []string{"blocks", "height", "blocks_per_second", "checkpoint_lag", "checkpoint_age", "tip_distance", "remaining_blocks"}
+var INTERNAL_WORKER_METRIC_NAMES = map[string]string{
+	"blocks":            "blocks_total",
+	"height":            "height",
+	"blocks_per_second": "blocks_per_second",
+	"checkpoint_lag":    "checkpoint_lag_blocks",
+	"checkpoint_age":    "checkpoint_age_seconds",
+	"tip_distance":      "tip_distance_blocks",
+	"remaining_blocks":  "remaining_blocks",
+}
+
+// A histogram counts observations in cumulative buckets, like Prometheus histograms.
+type histogram struct {
+	buckets []float64
+	counts  []int64 // counts[i] is the number of observations <= buckets[i]
+	count   int64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]int64, len(buckets))}
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// mean returns the mean of the observations, or 0 if there are none.
+func (h *histogram) mean() float64 {
+	// Avoid divide by 0 errors.
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / float64(h.count)
+}
+
+// workerStats tracks the progress of a worker analyzing a range of blocks, or of live analysis.
+type workerStats struct {
+	started          time.Time
+	finished         time.Time
+	blocks           int64
+	height           int64 // last height analyzed
+	end              int64 // end of the worker's range, or 0 for live analysis
+	checkpointHeight int64 // last height recorded in the worker's progress file
+	checkpointTime   time.Time
+}
+
+// internalMetrics instruments the ingester itself: how fast each worker is going, how
+// long RPC calls and influxdb writes take, and how far behind the workers are.
+type internalMetrics struct {
+	sync.Mutex
+	started       time.Time
+	tip           int64
+	workers       map[string]*workerStats
+	rpcLatency    map[string]*histogram
+	rpcErrors     map[string]int64
+	writeLatency  *histogram
+	writeErrors   int64 // failed write attempts, which are retried
+	writesFailed  int64 // batches given up on after MAX_ATTEMPTS
+	batchSizes    *histogram
+	lastPointTime time.Time
+}
+
+// Every worker in this process reports to the same metrics.
+var internal = internalMetrics{
+	started:      time.Now(),
+	workers:      make(map[string]*workerStats),
+	rpcLatency:   make(map[string]*histogram),
+	rpcErrors:    make(map[string]int64),
+	writeLatency: newHistogram(LATENCY_BUCKETS),
+	batchSizes:   newHistogram(BATCH_SIZE_BUCKETS),
+}
+
+// metricsAddr returns the address to serve the metrics endpoint on, which can be set with
+// the METRICS_ADDR environment variable. The endpoint isn't served if it's empty.
+func metricsAddr() string {
+	return os.Getenv("METRICS_ADDR")
+}
+
+// writeInternalPoints returns whether dashboard_internal points should be written, which
+// can be set with the WRITE_INTERNAL_METRICS environment variable.
+func writeInternalPoints() bool {
+	value := os.Getenv("WRITE_INTERNAL_METRICS")
+	if value == "" {
+		return false
+	}
+
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		Logger{}.Fatal("Bad WRITE_INTERNAL_METRICS", "value", value)
+	}
+	return enabled
+}
+
+// observeRPC records the latency of an RPC call that started at the given time.
+func (m *internalMetrics) observeRPC(method string, start time.Time, err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.rpcLatency[method] == nil {
+		m.rpcLatency[method] = newHistogram(LATENCY_BUCKETS)
+	}
+	m.rpcLatency[method].observe(time.Since(start).Seconds())
+	if err != nil {
+		m.rpcErrors[method]++
+	}
+}
+
+// observeWrite records the latency of an attempt to write a batch to influxdb.
+func (m *internalMetrics) observeWrite(start time.Time, err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.writeLatency.observe(time.Since(start).Seconds())
+	if err != nil {
+		m.writeErrors++
+	}
+}
+
+// observeBatch records the size of a batch once it's been written, or given up on.
+func (m *internalMetrics) observeBatch(points int, written bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.batchSizes.observe(float64(points))
+	if !written {
+		m.writesFailed++
+	}
+}
+
+// setTip records the height of the primary node's tip.
+func (m *internalMetrics) setTip(height int64) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.tip = height
+}
+
+// startWorker registers a worker analyzing blocks up to end, or live if end is 0.
+func (m *internalMetrics) startWorker(worker string, start, end int64) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.workers[worker] = &workerStats{
+		started:          time.Now(),
+		height:           start - 1,
+		end:              end,
+		checkpointHeight: start - 1,
+		checkpointTime:   time.Now(),
+	}
+}
+
+// worker returns the stats of a worker, registering it if it hasn't been started, as
+// with blocks left over from live analysis that are finished by the recovery process.
+// The height is the first one the worker analyzes. Must be called with the metrics locked.
+func (m *internalMetrics) worker(name string, height int64) *workerStats {
+	if m.workers[name] == nil {
+		m.workers[name] = &workerStats{
+			started:          time.Now(),
+			height:           height - 1,
+			checkpointHeight: height - 1,
+			checkpointTime:   time.Now(),
+		}
+	}
+	return m.workers[name]
+}
+
+// blockAnalyzed records that a worker finished analyzing a block.
+func (m *internalMetrics) blockAnalyzed(name string, height int64) {
+	m.Lock()
+	defer m.Unlock()
+
+	stats := m.worker(name, height)
+	stats.blocks++
+	stats.height = height
+}
+
+// checkpoint records that a worker's progress up to a height is safely written.
+func (m *internalMetrics) checkpoint(name string, height int64) {
+	m.Lock()
+	defer m.Unlock()
+
+	stats := m.worker(name, height)
+	stats.checkpointHeight = height
+	stats.checkpointTime = time.Now()
+}
+
+// finishWorker records that a started worker is done, so its rate stops going down.
+func (m *internalMetrics) finishWorker(name string) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.workers[name].finished = time.Now()
+}
+
+// blockCount uses the getblockcount RPC to get the height of the tip, and records it.
+func (dash *Dashboard) blockCount() (int64, error) {
+	start := throttleRPC()
+	blockCount, err := dash.client.GetBlockCount()
+	internal.observeRPC("getblockcount", start, err)
+	if err != nil {
+		return 0, err
+	}
+
+	internal.setTip(blockCount)
+	return blockCount, nil
+}
+
+// workerNames returns the names of the workers in order. Must be called with the metrics locked.
+func (m *internalMetrics) workerNames() []string {
+	names := make([]string, 0, len(m.workers))
+	for name := range m.workers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// workerFields returns the fields of a worker's dashboard_internal point.
+// Must be called with the metrics locked.
+func (m *internalMetrics) workerFields(stats *workerStats, now time.Time) map[string]interface{} {
+	fields := make(map[string]interface{}) // for influxdb
+
+	elapsed := now.Sub(stats.started)
+	if !stats.finished.IsZero() {
+		elapsed = stats.finished.Sub(stats.started)
+	}
+
+	fields["blocks"] = stats.blocks
+	fields["height"] = stats.height
+	fields["blocks_per_second"] = 0.0
+	if elapsed > 0 {
+		fields["blocks_per_second"] = float64(stats.blocks) / elapsed.Seconds()
+	}
+	fields["checkpoint_lag"] = stats.height - stats.checkpointHeight
+	fields["checkpoint_age"] = now.Sub(stats.checkpointTime).Seconds()
+	if m.tip > 0 {
+		fields["tip_distance"] = m.tip - stats.height
+	}
+	if stats.end > 0 {
+		fields["remaining_blocks"] = stats.end - stats.height - 1
+	}
+	return fields
+}
+
+// processFields returns the fields of the process's dashboard_internal point.
+// Must be called with the metrics locked.
+func (m *internalMetrics) processFields(now time.Time) map[string]interface{} {
+	fields := make(map[string]interface{}) // for influxdb
+
+	rpcCalls, rpcErrors, rpcSeconds := int64(0), int64(0), 0.0
+	for method, latency := range m.rpcLatency {
+		rpcCalls += latency.count
+		rpcSeconds += latency.sum
+		rpcErrors += m.rpcErrors[method]
+	}
+
+	fields["uptime"] = now.Sub(m.started).Seconds()
+	fields["rpc_calls"] = rpcCalls
+	fields["rpc_errors"] = rpcErrors
+	fields["rpc_seconds"] = rpcSeconds
+	fields["db_writes"] = m.writeLatency.count
+	fields["db_write_errors"] = m.writeErrors
+	fields["db_writes_failed"] = m.writesFailed
+	fields["db_write_seconds"] = m.writeLatency.sum
+	fields["batches"] = m.batchSizes.count
+	fields["avg_batch_size"] = m.batchSizes.mean()
+	fields["alert_queue"] = int64(alerting.queueDepth())
+	fields["stream_queue"] = int64(stream.queueDepth())
+	if m.tip > 0 {
+		fields["tip"] = m.tip
+	}
+	return fields
+}
+
+// addInternalPoints adds dashboard_internal points to the Dashboard's batch if they're
+// enabled and none were added in the last INTERNAL_POINT_INTERVAL.
+func (dash *Dashboard) addInternalPoints() {
+	if !writeInternalPoints() {
+		return
+	}
+
+	internal.Lock()
+	defer internal.Unlock()
+
+	now := time.Now()
+	if now.Sub(internal.lastPointTime) < INTERNAL_POINT_INTERVAL {
+		return
+	}
+	internal.lastPointTime = now
+
+	tags := map[string]string{"network": dash.network.Name, "node": dash.node} // for influxdb
+	pt, err := newPoint("dashboard_internal", tags, internal.processFields(now), now)
+	if err != nil {
+		dash.logger.Fatal("Error creating new point", "measurement", "dashboard_internal", "err", err)
+	}
+	dash.bp.AddPoint(pt)
+
+	for _, name := range internal.workerNames() {
+		workerTags := map[string]string{"network": dash.network.Name, "node": dash.node, "worker": name} // for influxdb
+		pt, err := newPoint("dashboard_internal", workerTags, internal.workerFields(internal.workers[name], now), now)
+		if err != nil {
+			dash.logger.Fatal("Error creating new point", "measurement", "dashboard_internal", "worker", name, "err", err)
+		}
+		dash.bp.AddPoint(pt)
+	}
+}
+
+func writeMetric(w io.Writer, name, labels string, value interface{}) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%v%v%v %v\n", INTERNAL_METRICS_PREFIX, name, labels, value)
+}
+
+func writeHistogram(w io.Writer, name, labels string, h *histogram) {
+	separator := ""
+	if labels != "" {
+		separator = ","
+	}
+	for i, bound := range h.buckets {
+		writeMetric(w, name+"_bucket", fmt.Sprintf("%v%vle=\"%v\"", labels, separator, bound), h.counts[i])
+	}
+	writeMetric(w, name+"_bucket", fmt.Sprintf("%v%vle=\"+Inf\"", labels, separator), h.count)
+	writeMetric(w, name+"_sum", labels, h.sum)
+	writeMetric(w, name+"_count", labels, h.count)
+}
+
+// writeTo writes the metrics in the Prometheus text format.
+func (m *internalMetrics) writeTo(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now()
+	process := m.processFields(now)
+	writeMetric(w, "uptime_seconds", "", process["uptime"])
+	if m.tip > 0 {
+		writeMetric(w, "tip_height", "", m.tip)
+	}
+	writeMetric(w, "alert_queue_depth", "", process["alert_queue"])
+	writeMetric(w, "stream_queue_depth", "", process["stream_queue"])
+	writeMetric(w, "db_write_errors_total", "", m.writeErrors)
+	writeMetric(w, "db_writes_failed_total", "", m.writesFailed)
+
+	for _, worker := range m.workerNames() {
+		labels := fmt.Sprintf("worker=%q", worker)
+		fields := m.workerFields(m.workers[worker], now)
+		for _, name := range INTERNAL_WORKER_FIELDS {
+			if value, ok := fields[name]; ok {
+				writeMetric(w, "worker_"+INTERNAL_WORKER_METRIC_NAMES[name], labels, value)
+			}
+		}
+	}
+
+	methods := make([]string, 0, len(m.rpcLatency))
+	for method := range m.rpcLatency {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		labels := fmt.Sprintf("method=%q", method)
+		writeHistogram(w, "rpc_duration_seconds", labels, m.rpcLatency[method])
+		writeMetric(w, "rpc_errors_total", labels, m.rpcErrors[method])
+	}
+
+	writeHistogram(w, "db_write_duration_seconds", "", m.writeLatency)
+	writeHistogram(w, "db_batch_points", "", m.batchSizes)
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	internal.writeTo(w)
+}
+
+// serveMetrics serves the ingester's own metrics on /metrics.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", onlyGET(handleMetrics))
+
+	Logger{}.Info("Serving internal metrics", "addr", addr)
+	Logger{}.Fatal("Error serving internal metrics", "addr", addr, "err", http.ListenAndServe(addr, mux))
+}
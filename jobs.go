@@ -0,0 +1,701 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How often a running job checks whether it was asked to be cancelled, and records the
+// number of blocks it has analyzed.
+const JOB_POLL_INTERVAL = 5 * time.Second
+
+// States of named jobs.
+const (
+	JOB_QUEUED    = "queued"
+	JOB_RUNNING   = "running"
+	JOB_FAILED    = "failed"
+	JOB_DONE      = "done"
+	JOB_CANCELLED = "cancelled"
+)
+
+// File that's locked while job records are read and changed, so that several processes can
+// share the jobs directory.
+const JOBS_LOCK_FILE = ".lock"
+
+// JobParams are what a job was asked to do: analyze the blocks in [Start, End) on Workers workers.
+type JobParams struct {
+	Start   int `json:"start"`
+	End     int `json:"end"`
+	Workers int `json:"workers"`
+}
+
+// A JobEvent is a change in the state of a job.
+type JobEvent struct {
+	Time    time.Time `json:"time"`
+	State   string    `json:"state"`
+	Message string    `json:"message,omitempty"`
+}
+
+// JobOutputs are the results of a job, updated while it runs.
+type JobOutputs struct {
+	Blocks    int           `json:"blocks"`              // blocks analyzed, over every attempt since the range was started
+	Remaining []HeightRange `json:"remaining,omitempty"` // heights left by a failed attempt
+	Error     string        `json:"error,omitempty"`
+}
+
+// A JobRecord is a named job, stored as jobs/<id>.json.
+type JobRecord struct {
+	ID              int        `json:"id"`
+	Name            string     `json:"name"`
+	Params          JobParams  `json:"params"`
+	State           string     `json:"state"`
+	Attempt         int        `json:"attempt"`
+	CancelRequested bool       `json:"cancel_requested,omitempty"`
+	Host            string     `json:"host,omitempty"` // where the latest attempt ran
+	PID             int        `json:"pid,omitempty"`
+	Created         time.Time  `json:"created"`
+	Outputs         JobOutputs `json:"outputs"`
+	History         []JobEvent `json:"history"`
+}
+
+// setState changes the state of a job and adds it to the job's history.
+func (record *JobRecord) setState(state, message string) {
+	record.State = state
+	record.History = append(record.History, JobEvent{time.Now().UTC(), state, message})
+}
+
+// claim marks a job as running in this process.
+func (record *JobRecord) claim() {
+	record.Attempt++
+	record.CancelRequested = false
+	record.Host, _ = os.Hostname()
+	record.PID = os.Getpid()
+	record.Outputs.Remaining = nil
+	record.Outputs.Error = ""
+	record.setState(JOB_RUNNING, fmt.Sprintf("attempt %v", record.Attempt))
+}
+
+// filePrefix returns the prefix of the progress files of a job's attempt.
+func (record JobRecord) filePrefix() string {
+	return fmt.Sprintf("job-%v.%v_", record.ID, record.Attempt)
+}
+
+// setupJobsDir creates the jobs directory if it doesn't already exist, and returns its path.
+func setupJobsDir() string {
+	currentDir, err := os.Getwd()
+	if err != nil {
+		Logger{}.Fatal("Error getting working directory", "err", err)
+	}
+
+	jobsDir := currentDir + "/jobs"
+	if _, err := os.Stat(jobsDir); os.IsNotExist(err) {
+		Logger{}.Info("Creating jobs directory", "dir", jobsDir)
+		err := os.Mkdir(jobsDir, 0777)
+		if err != nil {
+			Logger{}.Fatal("Error creating jobs directory", "dir", jobsDir, "err", err)
+		}
+	}
+	return jobsDir
+}
+
+// lockJobs locks the jobs directory against other processes, and returns a function that
+// unlocks it.
+func lockJobs(dir string) func() {
+	file, err := os.OpenFile(dir+"/"+JOBS_LOCK_FILE, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		Logger{}.Fatal("Error opening the jobs lock", "dir", dir, "err", err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		Logger{}.Fatal("Error locking the jobs directory", "dir", dir, "err", err)
+	}
+
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}
+}
+
+func jobFile(dir string, id int) string {
+	return fmt.Sprintf("%v/%v.json", dir, id)
+}
+
+func readJob(dir string, id int) (JobRecord, error) {
+	var record JobRecord
+	contentsBytes, err := ioutil.ReadFile(jobFile(dir, id))
+	if os.IsNotExist(err) {
+		return record, fmt.Errorf("no job with ID %v", id)
+	}
+	if err != nil {
+		return record, err
+	}
+
+	err = json.Unmarshal(contentsBytes, &record)
+	return record, err
+}
+
+// writeJob replaces a job's record, so it's never seen half written.
+func writeJob(dir string, record JobRecord) error {
+	contentsBytes, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile := jobFile(dir, record.ID) + ".tmp"
+	err = ioutil.WriteFile(tmpFile, contentsBytes, 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, jobFile(dir, record.ID))
+}
+
+// readJobs returns every job, ordered by ID.
+func readJobs(dir string) ([]JobRecord, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]JobRecord, 0, len(files))
+	for _, file := range files {
+		id, err := strconv.Atoi(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		record, err := readJob(dir, id)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ID < records[j].ID
+	})
+	return records, nil
+}
+
+// createJob stores a new job, either queued or already claimed by this process.
+func createJob(dir, name string, params JobParams, run bool) JobRecord {
+	unlock := lockJobs(dir)
+	defer unlock()
+
+	records, err := readJobs(dir)
+	if err != nil {
+		Logger{}.Fatal("Error reading jobs", "dir", dir, "err", err)
+	}
+
+	record := JobRecord{ID: 1, Name: name, Params: params, Created: time.Now().UTC(), History: make([]JobEvent, 0)}
+	if len(records) > 0 {
+		record.ID = records[len(records)-1].ID + 1
+	}
+	record.setState(JOB_QUEUED, "")
+	if run {
+		record.claim()
+	}
+
+	err = writeJob(dir, record)
+	if err != nil {
+		Logger{}.Fatal("Error writing job", "job_id", record.ID, "err", err)
+	}
+	return record
+}
+
+// updateJob changes a job's record with the given function, unless it returns an error.
+func updateJob(dir string, id int, update func(record *JobRecord) error) (JobRecord, error) {
+	unlock := lockJobs(dir)
+	defer unlock()
+
+	record, err := readJob(dir, id)
+	if err != nil {
+		return record, err
+	}
+
+	err = update(&record)
+	if err != nil {
+		return record, err
+	}
+	return record, writeJob(dir, record)
+}
+
+// processAlive reports whether the process a job ran in is still running. Processes on
+// other hosts can't be checked, so they're assumed to be running.
+func processAlive(host string, pid int) bool {
+	hostname, _ := os.Hostname()
+	if host != hostname {
+		return true
+	}
+
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// reapJobs marks running jobs whose process has exited (e.g. after a fatal RPC error) as failed.
+// Must be called with the jobs directory locked.
+func reapJobs(dir string) error {
+	records, err := readJobs(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if record.State != JOB_RUNNING || processAlive(record.Host, record.PID) {
+			continue
+		}
+
+		record.Outputs.Remaining = remainingHeights(record.ID)
+		record.Outputs.Error = "process exited while running the job"
+		record.setState(JOB_FAILED, record.Outputs.Error)
+		err = writeJob(dir, record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readJobsReaped returns every job, after marking the ones whose process exited as failed.
+func readJobsReaped(dir string) ([]JobRecord, error) {
+	unlock := lockJobs(dir)
+	defer unlock()
+
+	err := reapJobs(dir)
+	if err != nil {
+		return nil, err
+	}
+	return readJobs(dir)
+}
+
+// claimNextJob claims the queued job with the lowest ID, if there is one.
+func claimNextJob(dir string) (JobRecord, bool) {
+	unlock := lockJobs(dir)
+	defer unlock()
+
+	err := reapJobs(dir)
+	if err != nil {
+		Logger{}.Fatal("Error reading jobs", "dir", dir, "err", err)
+	}
+	records, err := readJobs(dir)
+	if err != nil {
+		Logger{}.Fatal("Error reading jobs", "dir", dir, "err", err)
+	}
+
+	for _, record := range records {
+		if record.State != JOB_QUEUED {
+			continue
+		}
+
+		record.claim()
+		err = writeJob(dir, record)
+		if err != nil {
+			Logger{}.Fatal("Error writing job", "job_id", record.ID, "err", err)
+		}
+		return record, true
+	}
+	return JobRecord{}, false
+}
+
+// jobProgressFiles returns the progress files left in ./worker-progress by any attempt of a job.
+func jobProgressFiles(id int) []string {
+	currentDir, err := os.Getwd()
+	if err != nil {
+		Logger{}.Fatal("Error getting working directory", "err", err)
+	}
+	workerProgressDir := currentDir + "/worker-progress"
+
+	files, err := ioutil.ReadDir(workerProgressDir)
+	if err != nil {
+		return nil
+	}
+
+	workFiles := make([]string, 0)
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), fmt.Sprintf("job-%v.", id)) {
+			workFiles = append(workFiles, workerProgressDir+"/"+file.Name())
+		}
+	}
+	return workFiles
+}
+
+// remainingHeights returns the heights left in a job's progress files.
+func remainingHeights(id int) []HeightRange {
+	remaining := make([]HeightRange, 0)
+	for _, workFile := range jobProgressFiles(id) {
+		contentsBytes, err := ioutil.ReadFile(workFile)
+		if err != nil {
+			continue
+		}
+
+		progress := parseProgress(string(contentsBytes))
+		remaining = append(remaining, HeightRange{int64(progress["Last"]), int64(progress["End"])})
+	}
+
+	sort.Slice(remaining, func(i, j int) bool {
+		return remaining[i].Start < remaining[j].Start
+	})
+	return remaining
+}
+
+// runJob runs a job claimed by this process, and records how it ended. Attempts after the
+// first resume the ranges left in the progress files of earlier attempts.
+func runJob(dir string, record JobRecord) {
+	logger := Logger{}.With("job", "analyze", "job_id", record.ID)
+
+	dash := setupDashboard()
+	defer dash.shutdown()
+	dash.logger = logger
+
+	workerProgressDir := setupWorkerProgressDir(dash.network.Name)
+	job := newRangeJob("analyze", workerProgressDir, record.Params.Workers)
+	job.id = record.ID
+	job.filePrefix = record.filePrefix()
+	job.logger = logger
+
+	workFiles := jobProgressFiles(record.ID)
+	for _, workFile := range workFiles {
+		contentsBytes, err := ioutil.ReadFile(workFile)
+		if err != nil {
+			logger.Fatal("Error reading progress file", "file", workFile, "err", err)
+		}
+
+		progress := parseProgress(string(contentsBytes))
+		logger.Info("Resuming range", "file", workFile, "start", progress["Start"], "end", progress["End"], "height", progress["Last"])
+		job.pending = append(job.pending, workRange{start: progress["Last"], end: progress["End"], workFile: workFile})
+	}
+
+	// Blocks are counted over every attempt that resumes the one before it. Cancelling a
+	// job removes its progress files, so retrying it analyzes the whole range again.
+	blocks := record.Outputs.Blocks
+	if len(workFiles) == 0 {
+		blocks = 0
+		start, end, nWorkers := record.Params.Start, record.Params.End, record.Params.Workers
+		workSplit := (end - start) / nWorkers
+		logger.Info("Starting analysis", "name", record.Name, "start", start, "end", end, "workers", nWorkers, "blocks_per_worker", workSplit)
+
+		for i := 0; i < nWorkers; i++ {
+			r := workRange{start: start + (workSplit * i), end: start + (workSplit * (i + 1)), workFile: job.workFile(i)}
+			// The last range also takes the heights left over by the split.
+			if i == nWorkers-1 {
+				r.end = end
+			}
+
+			// Record every range before starting, so none are lost if the process dies.
+			err := ioutil.WriteFile(r.workFile, []byte(progressRecord(r.start, r.start, r.end, time.Now())), 0666)
+			if err != nil {
+				logger.Fatal("Error writing progress", "file", r.workFile, "err", err)
+			}
+			job.pending = append(job.pending, r)
+		}
+	}
+
+	done := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(JOB_POLL_INTERVAL)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			analyzed, _ := job.results()
+			_, err := updateJob(dir, record.ID, func(r *JobRecord) error {
+				r.Outputs.Blocks = blocks + analyzed
+				if r.CancelRequested && !job.isCancelled() {
+					job.cancel()
+					control.wake()
+				}
+				return nil
+			})
+			if err != nil {
+				logger.Warn("Error updating job", "err", err)
+			}
+		}
+	}()
+
+	job.run()
+	close(done)
+
+	analyzed, failures := job.results()
+	if failures == 0 && !job.isCancelled() {
+		// Windows that span the edges of the range need blocks analyzed by earlier runs.
+		dash.completeRollingWindows()
+	}
+
+	record, err := updateJob(dir, record.ID, func(r *JobRecord) error {
+		r.Outputs.Blocks = blocks + analyzed
+		if job.isCancelled() {
+			r.setState(JOB_CANCELLED, "")
+		} else if failures > 0 {
+			r.Outputs.Remaining = remainingHeights(r.ID)
+			r.Outputs.Error = fmt.Sprintf("%v ranges couldn't be written to influxdb", failures)
+			r.setState(JOB_FAILED, r.Outputs.Error)
+		} else {
+			r.setState(JOB_DONE, "")
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Fatal("Error updating job", "err", err)
+	}
+	logger.Info("Finished job", "state", record.State, "blocks", analyzed)
+}
+
+func printJobs(records []JobRecord) {
+	if len(records) == 0 {
+		fmt.Println("No jobs.")
+		return
+	}
+
+	fmt.Printf("%-6v %-24v %-10v %-20v %8v %8v %10v %-20v\n", "ID", "NAME", "STATE", "RANGE", "WORKERS", "ATTEMPT", "BLOCKS", "CREATED")
+	for _, record := range records {
+		name := record.Name
+		if name == "" {
+			name = "-"
+		}
+		heights := fmt.Sprintf("[%v, %v)", record.Params.Start, record.Params.End)
+		fmt.Printf("%-6v %-24v %-10v %-20v %8v %8v %10v %-20v\n", record.ID, name, record.State, heights, record.Params.Workers, record.Attempt, record.Outputs.Blocks, record.Created.Format("2006-01-02 15:04:05"))
+	}
+}
+
+func printJob(record JobRecord) {
+	if record.Name != "" {
+		fmt.Printf("Job %v: %v\n\n", record.ID, record.Name)
+	} else {
+		fmt.Printf("Job %v\n\n", record.ID)
+	}
+	fmt.Printf("State:    %v\n", record.State)
+	fmt.Printf("Range:    [%v, %v)\n", record.Params.Start, record.Params.End)
+	fmt.Printf("Workers:  %v\n", record.Params.Workers)
+	fmt.Printf("Attempts: %v\n", record.Attempt)
+	if record.Attempt > 0 {
+		fmt.Printf("Process:  %v on %v\n", record.PID, record.Host)
+	}
+	fmt.Printf("Blocks:   %v\n", record.Outputs.Blocks)
+	if record.CancelRequested {
+		fmt.Println("Cancel requested")
+	}
+	if record.Outputs.Error != "" {
+		fmt.Printf("Error:    %v\n", record.Outputs.Error)
+	}
+	if len(record.Outputs.Remaining) > 0 {
+		ranges := make([]string, 0, len(record.Outputs.Remaining))
+		for _, heights := range record.Outputs.Remaining {
+			ranges = append(ranges, fmt.Sprintf("[%v, %v)", heights.Start, heights.End))
+		}
+		fmt.Printf("Left:     %v (retry the job to finish them)\n", strings.Join(ranges, " "))
+	}
+
+	fmt.Println("\nHistory:")
+	for _, event := range record.History {
+		fmt.Printf("  %v %-10v %v\n", event.Time.Format("2006-01-02 15:04:05"), event.State, event.Message)
+	}
+}
+
+func printJSON(value interface{}) {
+	contentsBytes, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		Logger{}.Fatal("Error encoding JSON", "err", err)
+	}
+	fmt.Println(string(contentsBytes))
+}
+
+// jobArg parses the job ID given to a jobs subcommand.
+func jobArg(flags *flag.FlagSet) int {
+	if flags.NArg() != 1 {
+		Logger{}.Fatal("Usage: btc-dashboard jobs " + flags.Name() + " <id>")
+	}
+	id, err := strconv.Atoi(flags.Arg(0))
+	if err != nil {
+		Logger{}.Fatal("Bad job ID", "job_id", flags.Arg(0))
+	}
+	return id
+}
+
+func formatFlag(flags *flag.FlagSet) *string {
+	return flags.String("format", "text", "Output format: text or json.")
+}
+
+func checkFormat(format string) {
+	if format != "text" && format != "json" {
+		Logger{}.Fatal("Unknown format", "format", format)
+	}
+}
+
+// JOBS_COMMANDS maps the subcommands of the jobs command to the functions that run them.
+var JOBS_COMMANDS = map[string]func(dir string, args []string){
+	"submit": jobsSubmit,
+	"run":    jobsRun,
+	"list":   jobsList,
+	"show":   jobsShow,
+	"cancel": jobsCancel,
+	"retry":  jobsRetry,
+}
+
+// jobsCommand implements the jobs subcommand, which queues, runs and manages the named jobs
+// stored in ./jobs.
+func jobsCommand(args []string) {
+	if len(args) == 0 {
+		Logger{}.Fatal("Usage: btc-dashboard jobs submit|run|list|show|cancel|retry")
+	}
+	command, ok := JOBS_COMMANDS[args[0]]
+	if !ok {
+		Logger{}.Fatal("Unknown jobs command", "command", args[0])
+	}
+
+	command(setupJobsDir(), args[1:])
+}
+
+func jobsSubmit(dir string, args []string) {
+	flags := flag.NewFlagSet("submit", flag.ExitOnError)
+	namePtr := flags.String("name", "", "Name of the job.")
+	startPtr := flags.Int("start", 0, "Starting blockheight.")
+	endPtr := flags.Int("end", 0, "Last blockheight to analyze.")
+	nWorkersPtr := flags.Int("workers", N_WORKERS_DEFAULT, "Number of concurrent RPC workers.")
+	flags.Parse(args)
+
+	if *startPtr <= 0 || *endPtr <= *startPtr {
+		Logger{}.Fatal("A start and an end after it are needed", "start", *startPtr, "end", *endPtr)
+	}
+	if *nWorkersPtr < 1 || *nWorkersPtr > MAX_WORKERS {
+		Logger{}.Fatal("workers must be from 1 to "+strconv.Itoa(MAX_WORKERS), "workers", *nWorkersPtr)
+	}
+	if *nWorkersPtr > *endPtr-*startPtr {
+		Logger{}.Fatal("There are more workers than blocks to analyze", "workers", *nWorkersPtr, "blocks", *endPtr-*startPtr)
+	}
+
+	record := createJob(dir, *namePtr, JobParams{*startPtr, *endPtr, *nWorkersPtr}, false)
+	fmt.Printf("Queued job %v\n", record.ID)
+}
+
+// jobsRun runs queued jobs one at a time, oldest first, until none are left.
+func jobsRun(dir string, args []string) {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	flags.Parse(args)
+
+	startServers()
+	for {
+		record, ok := claimNextJob(dir)
+		if !ok {
+			Logger{}.Info("No queued jobs left")
+			return
+		}
+		runJob(dir, record)
+	}
+}
+
+func jobsList(dir string, args []string) {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	formatPtr := formatFlag(flags)
+	statePtr := flags.String("state", "", "Only list jobs in this state.")
+	flags.Parse(args)
+	checkFormat(*formatPtr)
+
+	records, err := readJobsReaped(dir)
+	if err != nil {
+		Logger{}.Fatal("Error reading jobs", "dir", dir, "err", err)
+	}
+
+	filtered := make([]JobRecord, 0, len(records))
+	for _, record := range records {
+		if *statePtr == "" || record.State == *statePtr {
+			filtered = append(filtered, record)
+		}
+	}
+
+	if *formatPtr == "json" {
+		printJSON(filtered)
+		return
+	}
+	printJobs(filtered)
+}
+
+func jobsShow(dir string, args []string) {
+	flags := flag.NewFlagSet("show", flag.ExitOnError)
+	formatPtr := formatFlag(flags)
+	flags.Parse(args)
+	checkFormat(*formatPtr)
+	id := jobArg(flags)
+
+	_, err := readJobsReaped(dir)
+	if err != nil {
+		Logger{}.Fatal("Error reading jobs", "dir", dir, "err", err)
+	}
+	record, err := readJob(dir, id)
+	if err != nil {
+		Logger{}.Fatal("Error reading job", "job_id", id, "err", err)
+	}
+
+	if *formatPtr == "json" {
+		printJSON(record)
+		return
+	}
+	printJob(record)
+}
+
+// jobsCancel cancels a queued job right away. A running job is asked to stop, which it does
+// within JOB_POLL_INTERVAL.
+func jobsCancel(dir string, args []string) {
+	flags := flag.NewFlagSet("cancel", flag.ExitOnError)
+	flags.Parse(args)
+	id := jobArg(flags)
+
+	_, err := readJobsReaped(dir)
+	if err != nil {
+		Logger{}.Fatal("Error reading jobs", "dir", dir, "err", err)
+	}
+	record, err := updateJob(dir, id, func(record *JobRecord) error {
+		switch record.State {
+		case JOB_QUEUED:
+			record.setState(JOB_CANCELLED, "cancelled before it ran")
+		case JOB_RUNNING:
+			record.CancelRequested = true
+		default:
+			return fmt.Errorf("job %v is already %v", record.ID, record.State)
+		}
+		return nil
+	})
+	if err != nil {
+		Logger{}.Fatal("Can't cancel job", "job_id", id, "err", err)
+	}
+
+	if record.State == JOB_RUNNING {
+		fmt.Printf("Asked job %v to stop\n", record.ID)
+		return
+	}
+	fmt.Printf("Cancelled job %v\n", record.ID)
+}
+
+// jobsRetry queues a failed or cancelled job again. Failed jobs resume where they stopped.
+func jobsRetry(dir string, args []string) {
+	flags := flag.NewFlagSet("retry", flag.ExitOnError)
+	flags.Parse(args)
+	id := jobArg(flags)
+
+	_, err := readJobsReaped(dir)
+	if err != nil {
+		Logger{}.Fatal("Error reading jobs", "dir", dir, "err", err)
+	}
+	record, err := updateJob(dir, id, func(record *JobRecord) error {
+		if record.State != JOB_FAILED && record.State != JOB_CANCELLED {
+			return fmt.Errorf("job %v is %v, only failed or cancelled jobs can be retried", record.ID, record.State)
+		}
+		record.setState(JOB_QUEUED, "retried")
+		return nil
+	})
+	if err != nil {
+		Logger{}.Fatal("Can't retry job", "job_id", id, "err", err)
+	}
+
+	fmt.Printf("Queued job %v again; it runs with: btc-dashboard jobs run\n", record.ID)
+}
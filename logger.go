@@ -0,0 +1,246 @@
+package dashboard
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log levels, from least to most severe.
+const (
+	LEVEL_DEBUG = iota
+	LEVEL_INFO
+	LEVEL_WARN
+	LEVEL_ERROR
+	LEVEL_FATAL
+)
+
+var LEVEL_NAMES = []string{"debug", "info", "warn", "error", "fatal"}
+
+// Formats of log lines.
+const (
+	LOG_FORMAT_LOGFMT = "logfmt"
+	LOG_FORMAT_JSON   = "json"
+)
+
+// During backfills only one in this many per-block debug lines is logged by each worker,
+// unless LOG_SAMPLE is set.
+const LOG_SAMPLE_DEFAULT = 100
+
+// logSink is where every log line of the process goes, including lines logged with the
+// log package. It's set up from the LOG_LEVEL, LOG_FORMAT and LOG_FILE environment variables.
+type logSink struct {
+	sync.Mutex
+	out    io.Writer
+	level  int
+	format string
+	sample int64
+}
+
+var sink = logSink{out: os.Stderr, level: LEVEL_INFO, format: LOG_FORMAT_LOGFMT, sample: LOG_SAMPLE_DEFAULT}
+
+// A Logger writes structured log lines with a set of key-value pairs added to every line.
+// The zero Logger has no context.
+type Logger struct {
+	context []interface{}
+}
+
+// setupLogging configures the sink from the environment. LOG_LEVEL is one of LEVEL_NAMES
+// (info by default), LOG_FORMAT is logfmt (the default) or json, LOG_FILE is a file to append
+// to instead of stderr, and LOG_SAMPLE is the rate of per-block debug lines during backfills.
+func setupLogging() {
+	sink.Lock()
+	defer sink.Unlock()
+
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		found := false
+		for i, name := range LEVEL_NAMES {
+			if strings.ToLower(level) == name {
+				sink.level, found = i, true
+			}
+		}
+		if !found {
+			log.Fatal("Bad LOG_LEVEL: ", level)
+		}
+	}
+
+	if format := os.Getenv("LOG_FORMAT"); format != "" {
+		if format != LOG_FORMAT_LOGFMT && format != LOG_FORMAT_JSON {
+			log.Fatal("Bad LOG_FORMAT: ", format)
+		}
+		sink.format = format
+	}
+
+	if sample := os.Getenv("LOG_SAMPLE"); sample != "" {
+		n, err := strconv.ParseInt(sample, 10, 64)
+		if err != nil || n < 1 {
+			log.Fatal("Bad LOG_SAMPLE: ", sample)
+		}
+		sink.sample = n
+	}
+
+	if path := os.Getenv("LOG_FILE"); path != "" {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+		if err != nil {
+			log.Fatal("Error opening log file: ", err)
+		}
+		sink.out = file
+	}
+
+	// Lines logged with the log package are written as info lines.
+	log.SetFlags(0)
+	log.SetOutput(legacyWriter{})
+}
+
+// legacyWriter turns lines from the log package into structured lines.
+type legacyWriter struct{}
+
+func (legacyWriter) Write(p []byte) (int, error) {
+	Logger{}.write(legacyLevel(), strings.TrimSpace(string(p)), nil)
+	return len(p), nil
+}
+
+// legacyLevel returns the level of a line from the log package. Lines from log.Fatal and
+// log.Panic are logged at fatal level, so they aren't filtered out before the process exits.
+func legacyLevel() int {
+	pcs := make([]uintptr, 16)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		name := strings.TrimPrefix(frame.Function, "log.")
+		if name != frame.Function && (strings.Contains(name, "Fatal") || strings.Contains(name, "Panic")) {
+			return LEVEL_FATAL
+		}
+		if !more {
+			return LEVEL_INFO
+		}
+	}
+}
+
+// With returns a Logger that adds the given key-value pairs to every line.
+func (logger Logger) With(keyvals ...interface{}) Logger {
+	context := make([]interface{}, 0, len(logger.context)+len(keyvals))
+	context = append(context, logger.context...)
+	context = append(context, keyvals...)
+	return Logger{context}
+}
+
+func (logger Logger) Debug(msg string, keyvals ...interface{}) {
+	logger.write(LEVEL_DEBUG, msg, keyvals)
+}
+
+func (logger Logger) Info(msg string, keyvals ...interface{}) {
+	logger.write(LEVEL_INFO, msg, keyvals)
+}
+
+func (logger Logger) Warn(msg string, keyvals ...interface{}) {
+	logger.write(LEVEL_WARN, msg, keyvals)
+}
+
+func (logger Logger) Error(msg string, keyvals ...interface{}) {
+	logger.write(LEVEL_ERROR, msg, keyvals)
+}
+
+// Fatal logs a line and exits, like log.Fatal.
+func (logger Logger) Fatal(msg string, keyvals ...interface{}) {
+	logger.write(LEVEL_FATAL, msg, keyvals)
+	os.Exit(1)
+}
+
+// Sampled logs a per-block debug line for one in every LOG_SAMPLE blocks.
+func (logger Logger) Sampled(n int64, msg string, keyvals ...interface{}) {
+	sink.Lock()
+	sample := sink.sample
+	sink.Unlock()
+
+	if n%sample == 0 {
+		logger.write(LEVEL_DEBUG, msg, keyvals)
+	}
+}
+
+// write formats a line and writes it to the sink if its level is enabled.
+func (logger Logger) write(level int, msg string, keyvals []interface{}) {
+	sink.Lock()
+	defer sink.Unlock()
+
+	if level < sink.level {
+		return
+	}
+
+	pairs := []interface{}{"time", time.Now().UTC().Format(time.RFC3339Nano), "level", LEVEL_NAMES[level], "msg", msg}
+	pairs = append(pairs, logger.context...)
+	pairs = append(pairs, keyvals...)
+	if len(pairs)%2 == 1 {
+		pairs = append(pairs, "(missing)")
+	}
+
+	var line []byte
+	if sink.format == LOG_FORMAT_JSON {
+		line = jsonLine(pairs)
+	} else {
+		line = logfmtLine(pairs)
+	}
+
+	// There's nowhere left to report errors writing logs.
+	sink.out.Write(line)
+}
+
+// logValue converts values to something that formats well, e.g. errors to their message.
+func logValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+func logfmtLine(pairs []interface{}) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+
+		value := fmt.Sprint(logValue(pairs[i+1]))
+		if value == "" || strings.ContainsAny(value, " =\"\n\t") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&buf, "%v=%v", pairs[i], value)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+func jsonLine(pairs []interface{}) []byte {
+	// Keys are written in order, so lines can't be built from a map.
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		key, _ := json.Marshal(fmt.Sprint(pairs[i]))
+		value, err := json.Marshal(logValue(pairs[i+1]))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(pairs[i+1]))
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
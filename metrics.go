@@ -0,0 +1,410 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	influxClient "github.com/influxdata/influxdb/client/v2"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Go types of field values.
+const (
+	TYPE_INT    = "int64"
+	TYPE_FLOAT  = "float64"
+	TYPE_STRING = "string"
+	TYPE_BOOL   = "bool"
+)
+
+// Units of field values.
+const (
+	UNIT_SATS              = "sats"
+	UNIT_SAT_PER_VB        = "sat/vB"
+	UNIT_BYTES             = "bytes"
+	UNIT_WEIGHT            = "WU"
+	UNIT_RATIO             = "ratio"
+	UNIT_COUNT             = "count"
+	UNIT_BLOCKS            = "blocks"
+	UNIT_BLOCKS_PER_SECOND = "blocks/s"
+	UNIT_SECONDS           = "seconds"
+	UNIT_DAYS              = "days"
+	UNIT_BTC_DAYS          = "BTC-days"
+	UNIT_HASHES            = "hashes"
+	UNIT_HASHES_PER_SECOND = "hashes/s"
+	UNIT_NONE              = "none"
+)
+
+var UNITS = []string{UNIT_SATS, UNIT_SAT_PER_VB, UNIT_BYTES, UNIT_WEIGHT, UNIT_RATIO, UNIT_COUNT, UNIT_BLOCKS,
+	UNIT_BLOCKS_PER_SECOND, UNIT_SECONDS, UNIT_DAYS, UNIT_BTC_DAYS, UNIT_HASHES, UNIT_HASHES_PER_SECOND, UNIT_NONE}
+
+// Where field values come from.
+const (
+	SOURCE_GETBLOCKSTATS = "getblockstats"
+	SOURCE_RAW_BLOCK     = "raw block"
+	SOURCE_SCRIPT_INDEX  = "script index"
+	SOURCE_HEADERS       = "block headers"
+	SOURCE_NETWORK       = "network parameters"
+	SOURCE_NODES         = "node comparison"
+	SOURCE_SCHEMA        = "schema"
+	SOURCE_DERIVED       = "derived"
+	SOURCE_ROLLING       = "rolling window"
+	SOURCE_ROLLUP        = "rollup"
+	SOURCE_ANOMALIES     = "anomaly detection"
+	SOURCE_INTERNAL      = "ingester"
+)
+
+// A Metric describes a field written to influxdb. Names may contain a WILDCARD, which
+// stands for a bin index or bucket name.
+type Metric struct {
+	Measurement string `json:"measurement"`
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Unit        string `json:"unit"`
+	Description string `json:"description"`
+	Source      string `json:"source"`
+}
+
+// Measurements whose points belong to a single block and get a height field in schema v2.
+var BLOCK_MEASUREMENTS = []string{"block_metrics", "script_types", "op_return", "inscription_content_types", "difficulty", "node_divergence", "anomalies"}
+
+// METRICS lists every field written by the ingester, except for derived metrics and
+// aggregates of block_metrics, which are registered from DERIVED_METRICS and ROLLUP_RULES.
+var METRICS = []Metric{
+	{"block_metrics", "avg_fee", TYPE_INT, UNIT_SATS, "Average fee per transaction", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "avg_fee_rate", TYPE_INT, UNIT_SAT_PER_VB, "Average fee rate", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "avg_tx_size", TYPE_INT, UNIT_BYTES, "Average transaction size", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "max_fee", TYPE_INT, UNIT_SATS, "Largest transaction fee", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "max_fee_rate", TYPE_INT, UNIT_SAT_PER_VB, "Largest fee rate", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "max_tx_size", TYPE_INT, UNIT_BYTES, "Largest transaction size", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "min_fee", TYPE_INT, UNIT_SATS, "Smallest transaction fee", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "min_fee_rate", TYPE_INT, UNIT_SAT_PER_VB, "Smallest fee rate", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "min_tx_size", TYPE_INT, UNIT_BYTES, "Smallest transaction size", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "median_fee", TYPE_INT, UNIT_SATS, "Median transaction fee", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "median_fee_rate", TYPE_INT, UNIT_SAT_PER_VB, "Median fee rate", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "median_tx_size", TYPE_INT, UNIT_BYTES, "Median transaction size", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "block_size", TYPE_INT, UNIT_BYTES, "Total size of the block's transactions, excluding the coinbase", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "volume_btc", TYPE_INT, UNIT_SATS, "Total value of outputs, excluding the coinbase (in satoshis despite the name)", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "num_txs", TYPE_INT, UNIT_COUNT, "Transactions, including the coinbase", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "hash", TYPE_STRING, UNIT_NONE, "Block hash", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "num_inputs", TYPE_INT, UNIT_COUNT, "Inputs, excluding the coinbase", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "num_outputs", TYPE_INT, UNIT_COUNT, "Outputs, including the coinbase's", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "subsidy", TYPE_INT, UNIT_SATS, "Block subsidy", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "segwit_total_size", TYPE_INT, UNIT_BYTES, "Total size of segwit transactions", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "segwit_total_weight", TYPE_INT, UNIT_WEIGHT, "Total weight of segwit transactions", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "num_segwit_txs", TYPE_INT, UNIT_COUNT, "Segwit transactions", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "total_amount_out", TYPE_INT, UNIT_SATS, "Total value of outputs, excluding the coinbase", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "total_size", TYPE_INT, UNIT_BYTES, "Total size of the block's transactions, excluding the coinbase", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "total_weight", TYPE_INT, UNIT_WEIGHT, "Total weight of the block's transactions, excluding the coinbase", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "total_fee", TYPE_INT, UNIT_SATS, "Total fees", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "utxo_increase", TYPE_INT, UNIT_COUNT, "Change in the number of unspent outputs", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "utxo_size_increase", TYPE_INT, UNIT_BYTES, "Change in the size of the UTXO set", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "nested_P2WPKH_outputs_spent", TYPE_INT, UNIT_COUNT, "Inputs spending P2SH-wrapped P2WPKH outputs", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "native_P2WPKH_outputs_spent", TYPE_INT, UNIT_COUNT, "Inputs spending native P2WPKH outputs", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "nested_P2WSH_outputs_spent", TYPE_INT, UNIT_COUNT, "Inputs spending P2SH-wrapped P2WSH outputs", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "native_P2WSH_outputs_spent", TYPE_INT, UNIT_COUNT, "Inputs spending native P2WSH outputs", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "txs_spending_nested_p2wpkh_outputs", TYPE_INT, UNIT_COUNT, "Transactions spending P2SH-wrapped P2WPKH outputs", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "txs_spending_nested_p2wsh_outputs", TYPE_INT, UNIT_COUNT, "Transactions spending P2SH-wrapped P2WSH outputs", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "txs_spending_native_p2wpkh_outputs", TYPE_INT, UNIT_COUNT, "Transactions spending native P2WPKH outputs", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "txs_spending_native_p2wsh_outputs", TYPE_INT, UNIT_COUNT, "Transactions spending native P2WSH outputs", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "new_P2WPKH_outputs", TYPE_INT, UNIT_COUNT, "P2WPKH outputs created", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "new_P2WSH_outputs", TYPE_INT, UNIT_COUNT, "P2WSH outputs created", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "num_txs_creating_P2WPKH", TYPE_INT, UNIT_COUNT, "Transactions creating P2WPKH outputs", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "num_txs_creating_P2WSH", TYPE_INT, UNIT_COUNT, "Transactions creating P2WSH outputs", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "num_txs_signalling_rbf", TYPE_INT, UNIT_COUNT, "Transactions signalling replace-by-fee", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "num_consolidating_txs", TYPE_INT, UNIT_COUNT, "Transactions consolidating many inputs into few outputs", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "num_outputs_consolidated", TYPE_INT, UNIT_COUNT, "Inputs of consolidating transactions", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "num_batching_txs", TYPE_INT, UNIT_COUNT, "Transactions paying to many outputs", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "dust_bin_{}", TYPE_INT, UNIT_COUNT, "Outputs in each dust bin of the extended getblockstats", SOURCE_GETBLOCKSTATS},
+	{"block_metrics", "output_count_bin_{}", TYPE_INT, UNIT_COUNT, "Transactions with 1, 2, 3-4, 5-9, 10-49, 50-99 and 100+ outputs", SOURCE_GETBLOCKSTATS},
+
+	{"block_metrics", "new_P2TR_outputs", TYPE_INT, UNIT_COUNT, "P2TR outputs created", SOURCE_RAW_BLOCK},
+	{"block_metrics", "num_txs_creating_P2TR", TYPE_INT, UNIT_COUNT, "Transactions creating P2TR outputs", SOURCE_RAW_BLOCK},
+	{"block_metrics", "P2TR_outputs_spent", TYPE_INT, UNIT_COUNT, "Inputs spending P2TR outputs", SOURCE_RAW_BLOCK},
+	{"block_metrics", "P2TR_key_path_spends", TYPE_INT, UNIT_COUNT, "P2TR outputs spent with a single signature", SOURCE_RAW_BLOCK},
+	{"block_metrics", "P2TR_script_path_spends", TYPE_INT, UNIT_COUNT, "P2TR outputs spent by revealing a script", SOURCE_RAW_BLOCK},
+	{"block_metrics", "txs_spending_p2tr_outputs", TYPE_INT, UNIT_COUNT, "Transactions spending P2TR outputs", SOURCE_RAW_BLOCK},
+
+	{"block_metrics", "num_inscriptions", TYPE_INT, UNIT_COUNT, "Inscription envelopes in taproot script-path spends", SOURCE_RAW_BLOCK},
+	{"block_metrics", "num_txs_with_inscriptions", TYPE_INT, UNIT_COUNT, "Transactions with inscriptions", SOURCE_RAW_BLOCK},
+	{"block_metrics", "inscription_content_bytes", TYPE_INT, UNIT_BYTES, "Size of inscription bodies", SOURCE_RAW_BLOCK},
+	{"block_metrics", "inscription_witness_bytes", TYPE_INT, UNIT_BYTES, "Witness bytes of inputs carrying inscriptions", SOURCE_RAW_BLOCK},
+	{"block_metrics", "total_witness_bytes", TYPE_INT, UNIT_BYTES, "Witness bytes of all inputs", SOURCE_RAW_BLOCK},
+	{"block_metrics", "block_weight", TYPE_INT, UNIT_WEIGHT, "Weight of every transaction, including the coinbase", SOURCE_RAW_BLOCK},
+
+	{"block_metrics", "num_outputs_reusing_scripts", TYPE_INT, UNIT_COUNT, "Outputs paying to a script used in an earlier block or earlier in the block", SOURCE_SCRIPT_INDEX},
+	{"block_metrics", "num_outputs_reusing_scripts_in_block", TYPE_INT, UNIT_COUNT, "Outputs paying to a script first used earlier in the same block", SOURCE_SCRIPT_INDEX},
+	{"block_metrics", "num_inputs_spending_reused_scripts", TYPE_INT, UNIT_COUNT, "Inputs spending from scripts paid to at least twice before the block", SOURCE_SCRIPT_INDEX},
+
+	{"block_metrics", "spent_value", TYPE_INT, UNIT_SATS, "Value of the outputs spent", SOURCE_RAW_BLOCK},
+	{"block_metrics", "coin_days_destroyed", TYPE_FLOAT, UNIT_BTC_DAYS, "Value of each spent output times the days since it was created", SOURCE_RAW_BLOCK},
+	{"block_metrics", "spent_value_age_{}", TYPE_INT, UNIT_SATS, "Value spent from outputs in each age bucket", SOURCE_RAW_BLOCK},
+
+	{"block_metrics", "halving_epoch", TYPE_INT, UNIT_NONE, "Number of halvings before the block", SOURCE_NETWORK},
+	{"block_metrics", "blocks_until_halving", TYPE_INT, UNIT_BLOCKS, "Blocks until the next halving", SOURCE_NETWORK},
+	{"block_metrics", "num_dust_outputs", TYPE_INT, UNIT_COUNT, "Outputs below the dust threshold at the default dust relay fee", SOURCE_NETWORK},
+
+	{"script_types", "new_outputs", TYPE_INT, UNIT_COUNT, "Outputs of the script type created", SOURCE_RAW_BLOCK},
+	{"script_types", "new_output_value", TYPE_INT, UNIT_SATS, "Value of the outputs created", SOURCE_RAW_BLOCK},
+	{"script_types", "num_txs_creating", TYPE_INT, UNIT_COUNT, "Transactions creating outputs of the script type", SOURCE_RAW_BLOCK},
+	{"script_types", "outputs_spent", TYPE_INT, UNIT_COUNT, "Outputs of the script type spent", SOURCE_RAW_BLOCK},
+	{"script_types", "spent_value", TYPE_INT, UNIT_SATS, "Value of the outputs spent", SOURCE_RAW_BLOCK},
+	{"script_types", "num_txs_spending", TYPE_INT, UNIT_COUNT, "Transactions spending outputs of the script type", SOURCE_RAW_BLOCK},
+	{"script_types", "witness_bytes", TYPE_INT, UNIT_BYTES, "Witness bytes of the inputs spending outputs of the script type", SOURCE_RAW_BLOCK},
+	{"script_types", "percent_new_outs", TYPE_FLOAT, UNIT_RATIO, "Share of the block's outputs with the script type", SOURCE_RAW_BLOCK},
+	{"script_types", "percent_of_inputs_spending", TYPE_FLOAT, UNIT_RATIO, "Share of the block's inputs spending the script type", SOURCE_RAW_BLOCK},
+
+	{"op_return", "num_outputs", TYPE_INT, UNIT_COUNT, "OP_RETURN outputs of the protocol", SOURCE_RAW_BLOCK},
+	{"op_return", "payload_bytes", TYPE_INT, UNIT_BYTES, "Data pushed after OP_RETURN", SOURCE_RAW_BLOCK},
+	{"op_return", "script_bytes", TYPE_INT, UNIT_BYTES, "Size of the OP_RETURN scripts", SOURCE_RAW_BLOCK},
+	{"op_return", "num_txs", TYPE_INT, UNIT_COUNT, "Transactions with OP_RETURN outputs of the protocol", SOURCE_RAW_BLOCK},
+
+	{"inscription_content_types", "num_inscriptions", TYPE_INT, UNIT_COUNT, "Inscriptions of the content type", SOURCE_RAW_BLOCK},
+	{"inscription_content_types", "content_bytes", TYPE_INT, UNIT_BYTES, "Size of the inscription bodies", SOURCE_RAW_BLOCK},
+
+	{"difficulty", "difficulty", TYPE_FLOAT, UNIT_NONE, "Difficulty of the block", SOURCE_HEADERS},
+	{"difficulty", "bits", TYPE_INT, UNIT_NONE, "Compact target of the block", SOURCE_HEADERS},
+	{"difficulty", "chainwork", TYPE_FLOAT, UNIT_HASHES, "Expected number of hashes to produce the chain up to the block", SOURCE_HEADERS},
+	{"difficulty", "time_since_prev_block", TYPE_INT, UNIT_SECONDS, "Time between the previous block's timestamp and this one's", SOURCE_HEADERS},
+	{"difficulty", "chainwork_delta", TYPE_FLOAT, UNIT_HASHES, "Work added by the block", SOURCE_HEADERS},
+	{"difficulty", "min_difficulty", TYPE_BOOL, UNIT_NONE, "Whether the block was mined at the minimum difficulty allowed long after the previous block (testnets only)", SOURCE_HEADERS},
+	{"difficulty", "hashrate_estimate", TYPE_FLOAT, UNIT_HASHES_PER_SECOND, "Work over the last 144 blocks divided by the time they took", SOURCE_HEADERS},
+
+	{"difficulty_epochs", "start_height", TYPE_INT, UNIT_NONE, "Height of the first block of the epoch", SOURCE_HEADERS},
+	{"difficulty_epochs", "end_height", TYPE_INT, UNIT_NONE, "Height of the last block of the epoch", SOURCE_HEADERS},
+	{"difficulty_epochs", "difficulty", TYPE_FLOAT, UNIT_NONE, "Difficulty during the epoch", SOURCE_HEADERS},
+	{"difficulty_epochs", "expected_duration", TYPE_INT, UNIT_SECONDS, "Time the epoch should have taken", SOURCE_HEADERS},
+	{"difficulty_epochs", "actual_duration", TYPE_INT, UNIT_SECONDS, "Time from the first to the last block of the epoch", SOURCE_HEADERS},
+	{"difficulty_epochs", "duration_ratio", TYPE_FLOAT, UNIT_RATIO, "Actual duration over expected duration", SOURCE_HEADERS},
+	{"difficulty_epochs", "avg_block_interval", TYPE_FLOAT, UNIT_SECONDS, "Average time between blocks", SOURCE_HEADERS},
+	{"difficulty_epochs", "next_difficulty_adjustment", TYPE_FLOAT, UNIT_RATIO, "Factor the next epoch's difficulty is multiplied by", SOURCE_HEADERS},
+
+	{"node_divergence", "block_count", TYPE_INT, UNIT_BLOCKS, "Height of the node's tip", SOURCE_NODES},
+	{"node_divergence", "tip_lag", TYPE_INT, UNIT_BLOCKS, "Blocks the node's tip is behind the primary node's", SOURCE_NODES},
+	{"node_divergence", "has_block", TYPE_BOOL, UNIT_NONE, "Whether the node has a block at the height", SOURCE_NODES},
+	{"node_divergence", "hash_matches", TYPE_BOOL, UNIT_NONE, "Whether the node's block hash matches the primary node's", SOURCE_NODES},
+	{"node_divergence", "num_stats_differ", TYPE_INT, UNIT_COUNT, "getblockstats results that differ from the primary node's", SOURCE_NODES},
+	{"node_divergence", "stats_differ", TYPE_STRING, UNIT_NONE, "Comma-separated names of the differing getblockstats results", SOURCE_NODES},
+	{"node_divergence", "rpc_error", TYPE_BOOL, UNIT_NONE, "Whether the node returned an error", SOURCE_NODES},
+
+	{"anomalies", "value", TYPE_FLOAT, UNIT_NONE, "Value of the field in the block, in the field's unit", SOURCE_ANOMALIES},
+	{"anomalies", "baseline_median", TYPE_FLOAT, UNIT_NONE, "Median of the field over the previous blocks", SOURCE_ANOMALIES},
+	{"anomalies", "baseline_deviation", TYPE_FLOAT, UNIT_NONE, "Median absolute deviation of the field over the previous blocks, or the mean absolute deviation if that's 0", SOURCE_ANOMALIES},
+	{"anomalies", "score", TYPE_FLOAT, UNIT_NONE, "Robust z-score of the value", SOURCE_ANOMALIES},
+
+	{"dashboard_internal", "uptime", TYPE_FLOAT, UNIT_SECONDS, "Time since the process started", SOURCE_INTERNAL},
+	{"dashboard_internal", "rpc_calls", TYPE_INT, UNIT_COUNT, "RPC calls made to bitcoind since the process started", SOURCE_INTERNAL},
+	{"dashboard_internal", "rpc_errors", TYPE_INT, UNIT_COUNT, "RPC calls that returned an error", SOURCE_INTERNAL},
+	{"dashboard_internal", "rpc_seconds", TYPE_FLOAT, UNIT_SECONDS, "Total time spent in RPC calls", SOURCE_INTERNAL},
+	{"dashboard_internal", "db_writes", TYPE_INT, UNIT_COUNT, "Attempts to write a batch to influxdb", SOURCE_INTERNAL},
+	{"dashboard_internal", "db_write_errors", TYPE_INT, UNIT_COUNT, "Write attempts that failed and were retried", SOURCE_INTERNAL},
+	{"dashboard_internal", "db_writes_failed", TYPE_INT, UNIT_COUNT, "Batches given up on after every attempt failed", SOURCE_INTERNAL},
+	{"dashboard_internal", "db_write_seconds", TYPE_FLOAT, UNIT_SECONDS, "Total time spent writing to influxdb", SOURCE_INTERNAL},
+	{"dashboard_internal", "batches", TYPE_INT, UNIT_COUNT, "Batches written or given up on", SOURCE_INTERNAL},
+	{"dashboard_internal", "avg_batch_size", TYPE_FLOAT, UNIT_COUNT, "Average number of points per batch", SOURCE_INTERNAL},
+	{"dashboard_internal", "alert_queue", TYPE_INT, UNIT_COUNT, "Alert notifications waiting to be delivered", SOURCE_INTERNAL},
+	{"dashboard_internal", "stream_queue", TYPE_INT, UNIT_COUNT, "Events waiting to be sent to the slowest stream subscriber", SOURCE_INTERNAL},
+	{"dashboard_internal", "tip", TYPE_INT, UNIT_NONE, "Height of the primary node's tip", SOURCE_INTERNAL},
+	{"dashboard_internal", "blocks", TYPE_INT, UNIT_BLOCKS, "Blocks the worker has analyzed", SOURCE_INTERNAL},
+	{"dashboard_internal", "height", TYPE_INT, UNIT_NONE, "Last height the worker analyzed", SOURCE_INTERNAL},
+	{"dashboard_internal", "blocks_per_second", TYPE_FLOAT, UNIT_BLOCKS_PER_SECOND, "Blocks the worker has analyzed per second since it started", SOURCE_INTERNAL},
+	{"dashboard_internal", "checkpoint_lag", TYPE_INT, UNIT_BLOCKS, "Blocks analyzed since the worker last recorded its progress", SOURCE_INTERNAL},
+	{"dashboard_internal", "checkpoint_age", TYPE_FLOAT, UNIT_SECONDS, "Time since the worker last recorded its progress", SOURCE_INTERNAL},
+	{"dashboard_internal", "tip_distance", TYPE_INT, UNIT_BLOCKS, "Blocks between the last height the worker analyzed and the tip", SOURCE_INTERNAL},
+	{"dashboard_internal", "remaining_blocks", TYPE_INT, UNIT_BLOCKS, "Blocks left in the worker's range", SOURCE_INTERNAL},
+}
+
+// registry maps each measurement to its fields by name, including every
+// registered field of the measurements built from block_metrics.
+var registry = make(map[string]map[string]Metric)
+
+// registryOrder holds every registered field in the order they're listed by the schema command.
+var registryOrder []Metric
+
+func register(metric Metric) {
+	if registry[metric.Measurement] == nil {
+		registry[metric.Measurement] = make(map[string]Metric)
+	}
+	if _, ok := registry[metric.Measurement][metric.Name]; ok {
+		Logger{}.Fatal("Field registered twice", "measurement", metric.Measurement, "field", metric.Name)
+	}
+
+	known := false
+	for _, unit := range UNITS {
+		known = known || unit == metric.Unit
+	}
+	if !known {
+		Logger{}.Fatal("Field has an unknown unit", "measurement", metric.Measurement, "field", metric.Name, "unit", metric.Unit)
+	}
+
+	registry[metric.Measurement][metric.Name] = metric
+	registryOrder = append(registryOrder, metric)
+}
+
+// derivedDescription describes how a derived metric is computed.
+func derivedDescription(metric DerivedMetric) string {
+	if metric.Denominator == "" {
+		return metric.Numerator
+	}
+
+	numerator, denominator := metric.Numerator, metric.Denominator
+	if strings.ContainsAny(numerator, "+-*/") {
+		numerator = "(" + numerator + ")"
+	}
+	if strings.ContainsAny(denominator, "+-*/") {
+		denominator = "(" + denominator + ")"
+	}
+	return numerator + " / " + denominator
+}
+
+// The registry is built when the program starts from METRICS, DERIVED_METRICS and
+// ROLLUP_RULES, so that every field that can be written is known before any is.
+func init() {
+	for _, metric := range METRICS {
+		register(metric)
+	}
+
+	for _, measurement := range BLOCK_MEASUREMENTS {
+		register(Metric{measurement, "height", TYPE_INT, UNIT_NONE, "Block height (schema v2 only)", SOURCE_SCHEMA})
+	}
+
+	for _, derived := range DERIVED_METRICS {
+		metricType := TYPE_FLOAT
+		if derived.Unit == UNIT_COUNT {
+			metricType = TYPE_INT
+		}
+		register(Metric{"block_metrics", derived.Name, metricType, derived.Unit, derivedDescription(derived), SOURCE_DERIVED})
+	}
+
+	// Rolling windows average every numeric block_metrics field, and rollups aggregate them
+	// according to ROLLUP_RULES.
+	blockMetrics := make([]Metric, 0)
+	for _, metric := range registryOrder {
+		if metric.Measurement == "block_metrics" && metric.Type != TYPE_STRING && metric.Type != TYPE_BOOL {
+			blockMetrics = append(blockMetrics, metric)
+		}
+	}
+
+	for _, metric := range blockMetrics {
+		rolling := metric
+		rolling.Measurement = "block_metrics_rolling"
+		rolling.Type = TYPE_FLOAT
+		rolling.Description = "Average over the window of " + metric.Name
+		rolling.Source = SOURCE_ROLLING
+		if metric.Name == "height" {
+			rolling.Type = TYPE_INT
+			rolling.Description = "Height of the last block in the window (schema v2 only)"
+		}
+		register(rolling)
+	}
+
+	for _, measurement := range []string{"block_metrics_daily", "block_metrics_weekly"} {
+		for _, metric := range blockMetrics {
+			rollup := metric
+			rollup.Measurement = measurement
+			rollup.Type = TYPE_FLOAT
+			rollup.Source = SOURCE_ROLLUP
+
+			rule := rollupRule(metric.Name)
+			switch rule.Kind {
+			case ROLLUP_SUM:
+				rollup.Description = "Sum of " + metric.Name
+			case ROLLUP_WEIGHTED_AVG:
+				rollup.Description = fmt.Sprintf("Average of %v weighted by %v", metric.Name, rule.WeightField)
+			case ROLLUP_MIN:
+				rollup.Description = "Smallest " + metric.Name
+			case ROLLUP_MAX:
+				rollup.Description = "Largest " + metric.Name
+			case ROLLUP_AVG:
+				rollup.Description = "Average of " + metric.Name
+			case ROLLUP_PERCENTILES:
+				for _, p := range ROLLUP_PERCENTILE_RANKS {
+					percentile := rollup
+					percentile.Name = fmt.Sprintf("%v_p%v", metric.Name, p)
+					percentile.Description = fmt.Sprintf("%vth percentile of %v", p, metric.Name)
+					register(percentile)
+				}
+				continue
+			}
+			register(rollup)
+		}
+
+		register(Metric{measurement, "num_blocks", TYPE_INT, UNIT_COUNT, "Blocks in the bucket", SOURCE_ROLLUP})
+	}
+
+	// Keep each measurement's fields together, in the order the measurements were first registered.
+	measurementOrder := make(map[string]int)
+	for _, metric := range registryOrder {
+		if _, ok := measurementOrder[metric.Measurement]; !ok {
+			measurementOrder[metric.Measurement] = len(measurementOrder)
+		}
+	}
+	sort.SliceStable(registryOrder, func(i, j int) bool {
+		return measurementOrder[registryOrder[i].Measurement] < measurementOrder[registryOrder[j].Measurement]
+	})
+}
+
+// lookupMetric returns the registered field with the given name, matching names with a WILDCARD.
+func lookupMetric(measurement, name string) (Metric, bool) {
+	fields := registry[measurement]
+	if metric, ok := fields[name]; ok {
+		return metric, true
+	}
+
+	for pattern, metric := range fields {
+		parts := strings.SplitN(pattern, WILDCARD, 2)
+		if len(parts) == 2 && len(name) > len(parts[0])+len(parts[1]) && strings.HasPrefix(name, parts[0]) && strings.HasSuffix(name, parts[1]) {
+			return metric, true
+		}
+	}
+	return Metric{}, false
+}
+
+// newPoint creates a point after checking that every field is registered for the
+// measurement with the type it's given.
+func newPoint(measurement string, tags map[string]string, fields map[string]interface{}, t time.Time) (*influxClient.Point, error) {
+	for name, value := range fields {
+		metric, ok := lookupMetric(measurement, name)
+		if !ok {
+			return nil, fmt.Errorf("field %v of %v isn't registered", name, measurement)
+		}
+		if fmt.Sprintf("%T", value) != metric.Type {
+			return nil, fmt.Errorf("field %v of %v is a %T, but is registered as %v", name, measurement, value, metric.Type)
+		}
+	}
+
+	return influxClient.NewPoint(measurement, tags, fields, t)
+}
+
+// schemaCommand implements the schema subcommand, which prints every registered field
+// as Markdown tables or as JSON.
+func schemaCommand(args []string) {
+	flags := flag.NewFlagSet("schema", flag.ExitOnError)
+	formatPtr := flags.String("format", "markdown", "Output format: markdown or json.")
+	flags.Parse(args)
+
+	switch *formatPtr {
+	case "json":
+		contentsBytes, err := json.MarshalIndent(registryOrder, "", "  ")
+		if err != nil {
+			Logger{}.Fatal("Error encoding schema", "err", err)
+		}
+		fmt.Println(string(contentsBytes))
+
+	case "markdown":
+		measurement := ""
+		for _, metric := range registryOrder {
+			if metric.Measurement != measurement {
+				measurement = metric.Measurement
+				fmt.Printf("\n### %v\n\n", measurement)
+				fmt.Println("| Field | Type | Unit | Source | Description |")
+				fmt.Println("| --- | --- | --- | --- | --- |")
+			}
+			fmt.Printf("| `%v` | %v | %v | %v | %v |\n", metric.Name, metric.Type, metric.Unit, metric.Source, metric.Description)
+		}
+
+	default:
+		Logger{}.Fatal("Unknown format", "format", *formatPtr)
+	}
+}
@@ -0,0 +1,334 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	influxClient "github.com/influxdata/influxdb/client/v2"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const MIGRATION_PROGRESS_DIR = "migration-progress"
+const MIGRATION_CHUNK_DAYS_DEFAULT = 7
+
+// query runs an InfluxQL statement that doesn't return points against the given database.
+func (dash *Dashboard) query(database, command string) *influxClient.Response {
+	res, err := dash.iClient.Query(influxClient.NewQuery(command, database, ""))
+	if err != nil {
+		dash.logger.Fatal("Error querying influxdb", "db", database, "query", command, "err", err)
+	}
+	if res.Error() != nil {
+		dash.logger.Fatal("Error querying influxdb", "db", database, "query", command, "err", res.Error())
+	}
+	return res
+}
+
+// firstColumn returns the first column of every row in a SHOW query's response.
+func firstColumn(res *influxClient.Response) []string {
+	values := make([]string, 0)
+	for _, result := range res.Results {
+		for _, row := range result.Series {
+			for _, rowValues := range row.Values {
+				if len(rowValues) > 0 {
+					values = append(values, fmt.Sprint(rowValues[0]))
+				}
+			}
+		}
+	}
+	return values
+}
+
+// fieldTypes returns the type influxdb stores each field of a measurement as.
+func (dash *Dashboard) fieldTypes(measurement string) map[string]string {
+	res := dash.query(dash.DB, fmt.Sprintf("SHOW FIELD KEYS FROM \"%v\"", measurement))
+
+	types := make(map[string]string)
+	for _, result := range res.Results {
+		for _, row := range result.Series {
+			for _, values := range row.Values {
+				types[fmt.Sprint(values[0])] = fmt.Sprint(values[1])
+			}
+		}
+	}
+	return types
+}
+
+// boundaryTime returns the time of the first (order ASC) or last (order DESC) point in a measurement.
+func (dash *Dashboard) boundaryTime(measurement, order string) (time.Time, bool) {
+	points, err := dash.queryPoints(fmt.Sprintf("SELECT * FROM \"%v\" ORDER BY time %v LIMIT 1", measurement, order))
+	if err != nil {
+		dash.logger.Fatal("Error querying influxdb", "measurement", measurement, "err", err)
+	}
+	if len(points) == 0 {
+		return time.Time{}, false
+	}
+	return points[0].Time, true
+}
+
+// convertField converts a field value read from a query back to the type influxdb stores it as.
+// Query results don't distinguish integers from floats with integral values, so without this
+// the first point written to the new database could fix a field to the wrong type.
+func convertField(value interface{}, fieldType string) interface{} {
+	switch fieldType {
+	case "integer":
+		if f, ok := toFloat(value); ok {
+			return int64(f)
+		}
+	case "float":
+		if f, ok := toFloat(value); ok {
+			return f
+		}
+	}
+	return value
+}
+
+// migratePoint converts a point to schema v2. Points with a height tag get a height field
+// and an epoch tag instead, and are moved to the timestamp schema v2 uses for their block.
+// Points that don't belong to a block are copied unchanged.
+func migratePoint(point StoredPoint, fieldTypes map[string]string) StoredPoint {
+	migrated := StoredPoint{
+		Time:   point.Time,
+		Tags:   make(map[string]string),
+		Fields: make(map[string]interface{}),
+	}
+
+	for name, value := range point.Tags {
+		// Empty tags are how query results show series without the tag.
+		if name != "height" && value != "" {
+			migrated.Tags[name] = value
+		}
+	}
+	for name, value := range point.Fields {
+		migrated.Fields[name] = convertField(value, fieldTypes[name])
+	}
+
+	if point.Tags["height"] != "" {
+		height, err := point.height()
+		if err != nil {
+			Logger{}.Fatal("Bad height in point", "err", err)
+		}
+
+		setBlockKeyV2(migrated.Tags, migrated.Fields, height, migrated.Tags["network"])
+		migrated.Time = blockPointTimeV2(point.Time, height)
+	}
+
+	return migrated
+}
+
+// pointKey identifies a point by its tags, its time to the second and its height if it has one.
+func pointKey(point StoredPoint) string {
+	parts := make([]string, 0, len(point.Tags)+2)
+	for name, value := range point.Tags {
+		if value != "" {
+			parts = append(parts, name+"="+value)
+		}
+	}
+	sort.Strings(parts)
+
+	parts = append(parts, fmt.Sprint(point.Time.Unix()))
+	if height, ok := toFloat(point.Fields["height"]); ok {
+		parts = append(parts, fmt.Sprint(int64(height)))
+	}
+	return strings.Join(parts, ",")
+}
+
+// sameValue compares field values, treating integers and floats as numbers.
+func sameValue(a, b interface{}) bool {
+	aFloat, aOk := toFloat(a)
+	bFloat, bOk := toFloat(b)
+	if aOk && bOk {
+		return aFloat == bFloat
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+// verifyChunk checks that every migrated point was stored in the target database with the same fields.
+func verifyChunk(migrated, stored []StoredPoint) error {
+	if len(stored) != len(migrated) {
+		return fmt.Errorf("wrote %v points but found %v", len(migrated), len(stored))
+	}
+
+	storedByKey := make(map[string]StoredPoint)
+	for _, point := range stored {
+		storedByKey[pointKey(point)] = point
+	}
+
+	for _, point := range migrated {
+		key := pointKey(point)
+		storedPoint, ok := storedByKey[key]
+		if !ok {
+			return fmt.Errorf("point %v is missing", key)
+		}
+
+		for name, value := range point.Fields {
+			if !sameValue(value, storedPoint.Fields[name]) {
+				return fmt.Errorf("point %v has %v=%v, expected %v", key, name, storedPoint.Fields[name], value)
+			}
+		}
+	}
+
+	return nil
+}
+
+// MigrationProgress records, for each measurement, the time up to which every point has been
+// migrated and verified.
+type MigrationProgress map[string]time.Time
+
+func migrationProgressFile(source, target string) string {
+	return fmt.Sprintf("%v/%v-to-%v.json", MIGRATION_PROGRESS_DIR, source, target)
+}
+
+func loadMigrationProgress(path string) MigrationProgress {
+	progress := make(MigrationProgress)
+
+	contentsBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return progress
+	}
+	if err != nil {
+		Logger{}.Fatal("Error reading migration progress", "file", path, "err", err)
+	}
+
+	err = json.Unmarshal(contentsBytes, &progress)
+	if err != nil {
+		Logger{}.Fatal("Bad migration progress", "file", path, "err", err)
+	}
+	return progress
+}
+
+func (progress MigrationProgress) save(path string) {
+	contentsBytes, err := json.MarshalIndent(progress, "", "  ")
+	if err != nil {
+		Logger{}.Fatal("Error encoding migration progress", "err", err)
+	}
+
+	err = ioutil.WriteFile(path, contentsBytes, 0666)
+	if err != nil {
+		Logger{}.Fatal("Error writing migration progress", "file", path, "err", err)
+	}
+}
+
+// migrateMeasurement copies a measurement into the target database in chunks of the given
+// duration, converting points to schema v2. Each chunk is verified before the progress is
+// recorded, so an interrupted migration restarts at the first unverified chunk.
+func (dash *Dashboard) migrateMeasurement(target *Dashboard, measurement string, chunk time.Duration, progress MigrationProgress, progressFile string) {
+	first, ok := dash.boundaryTime(measurement, "ASC")
+	if !ok {
+		return
+	}
+	last, _ := dash.boundaryTime(measurement, "DESC")
+
+	start := first
+	if done, ok := progress[measurement]; ok {
+		start = done
+	}
+	fieldTypes := dash.fieldTypes(measurement)
+	total := 0
+
+	for ; !start.After(last); start = start.Add(chunk) {
+		end := start.Add(chunk)
+		query := fmt.Sprintf("SELECT * FROM \"%v\" WHERE time >= '%v' AND time < '%v' GROUP BY *",
+			measurement, start.Format(time.RFC3339), end.Format(time.RFC3339))
+
+		points, err := dash.queryPoints(query)
+		if err != nil {
+			dash.logger.Fatal("Error reading points to migrate", "measurement", measurement, "start", start, "err", err)
+		}
+
+		migrated := make([]StoredPoint, 0, len(points))
+		for _, point := range points {
+			m := migratePoint(point, fieldTypes)
+			migrated = append(migrated, m)
+
+			pt, err := influxClient.NewPoint(measurement, m.Tags, m.Fields, m.Time)
+			if err != nil {
+				dash.logger.Fatal("Error creating new point", "measurement", measurement, "err", err)
+			}
+			target.bp.AddPoint(pt)
+		}
+
+		if len(migrated) > 0 {
+			if !target.writePoints() {
+				dash.logger.Fatal("Migration stopped. Run it again to resume.", "measurement", measurement, "start", start)
+			}
+
+			stored, err := target.queryPoints(query)
+			if err != nil {
+				dash.logger.Fatal("Error reading migrated points", "measurement", measurement, "start", start, "err", err)
+			}
+
+			err = verifyChunk(migrated, stored)
+			if err != nil {
+				dash.logger.Fatal("Verification failed", "measurement", measurement, "start", start, "end", end, "err", err)
+			}
+		}
+
+		// Blocks arriving during an online migration are after the last point, so the
+		// last chunk is redone by the next run.
+		if end.After(last) {
+			progress[measurement] = last
+		} else {
+			progress[measurement] = end
+		}
+		progress.save(progressFile)
+
+		total += len(migrated)
+		dash.logger.Info("Migrated points", "measurement", measurement, "points", total, "end", end)
+	}
+}
+
+// migrateCommand implements the migrate subcommand, which copies every measurement in the
+// database to a new database in schema v2.
+func migrateCommand(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	toPtr := flags.String("to", "", "Database to write schema v2 points to.")
+	chunkDaysPtr := flags.Int("chunk-days", MIGRATION_CHUNK_DAYS_DEFAULT, "Days of points to migrate and verify at a time.")
+	flags.Parse(args)
+
+	if *toPtr == "" || *toPtr == os.Getenv("DB") {
+		Logger{}.Fatal("Give a new database to migrate to with -to")
+	}
+	if *chunkDaysPtr <= 0 {
+		Logger{}.Fatal("Bad -chunk-days", "value", *chunkDaysPtr)
+	}
+
+	dash := setupDashboard()
+	defer dash.shutdown()
+
+	if !dash.hasHeightTag(dash.DB) {
+		dash.logger.Info("Database doesn't use height tags, points will be copied as they are", "db", dash.DB)
+	}
+
+	dash.query("", fmt.Sprintf("CREATE DATABASE \"%v\"", *toPtr))
+
+	// The target shares the source's clients but writes to and reads from the new database.
+	target := dash
+	target.DB = *toPtr
+	bp, err := influxClient.NewBatchPoints(influxClient.BatchPointsConfig{
+		Database: target.DB,
+	})
+	if err != nil {
+		dash.logger.Fatal("Error creating new batchpoints", "db", target.DB, "err", err)
+	}
+	target.bp = bp
+
+	if _, err := os.Stat(MIGRATION_PROGRESS_DIR); os.IsNotExist(err) {
+		err := os.Mkdir(MIGRATION_PROGRESS_DIR, 0777)
+		if err != nil {
+			dash.logger.Fatal("Error creating migration progress directory", "dir", MIGRATION_PROGRESS_DIR, "err", err)
+		}
+	}
+	progressFile := migrationProgressFile(dash.DB, target.DB)
+	progress := loadMigrationProgress(progressFile)
+
+	chunk := time.Duration(*chunkDaysPtr) * 24 * time.Hour
+	for _, measurement := range firstColumn(dash.query(dash.DB, "SHOW MEASUREMENTS")) {
+		dash.migrateMeasurement(&target, measurement, chunk, progress, progressFile)
+	}
+
+	dash.logger.Info("Migration is done. Set DB to the new database to start using schema v2.", "from", dash.DB, "to", target.DB)
+}
@@ -0,0 +1,160 @@
+package dashboard
+
+import (
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Name of the file in the worker-progress directory that records which network its progress belongs to.
+const NETWORK_FILE = "network"
+
+// Network name of mainnet, as reported by getblockchaininfo.
+const MAINNET = "main"
+
+// NetworkParams holds the parameters of a chain that derived metrics depend on.
+type NetworkParams struct {
+	Name              string // as reported by getblockchaininfo
+	ChainParams       *chaincfg.Params
+	HalvingInterval   int64
+	DustRelayFee      int64   // in satoshis per 1000 vbytes, used to compute dust thresholds
+	RetargetInterval  int64   // blocks between difficulty retargets, or 0 if the difficulty never changes
+	RetargetFactor    float64 // most a retarget can multiply or divide the difficulty by
+	MinDifficultyTime int64   // seconds after the previous block when a block may have the minimum difficulty, or 0
+}
+
+// NETWORKS maps the chain names reported by getblockchaininfo to their parameters.
+// Signet and testnet4 addresses are encoded the same way as testnet3 addresses, so
+// they use the testnet3 chain parameters. Regtest never retargets, and only the
+// testnets allow minimum difficulty blocks 20 minutes after the previous block.
+var NETWORKS = map[string]NetworkParams{
+	"main":     {"main", &chaincfg.MainNetParams, 210000, 3000, 2016, 4, 0},
+	"test":     {"test", &chaincfg.TestNet3Params, 210000, 3000, 2016, 4, 1200},
+	"testnet4": {"testnet4", &chaincfg.TestNet3Params, 210000, 3000, 2016, 4, 1200},
+	"signet":   {"signet", &chaincfg.TestNet3Params, 210000, 3000, 2016, 4, 0},
+	"regtest":  {"regtest", &chaincfg.RegressionNetParams, 150, 3000, 0, 4, 0},
+}
+
+// detectNetwork uses the getblockchaininfo RPC to find out which chain bitcoind is on.
+func (dash *Dashboard) detectNetwork() NetworkParams {
+	info, err := dash.client.GetBlockChainInfo()
+	if err != nil {
+		dash.logger.Fatal("Error getting blockchain info", "err", err)
+	}
+
+	network, ok := NETWORKS[info.Chain]
+	if !ok {
+		dash.logger.Fatal("Unsupported network", "network", info.Chain)
+	}
+
+	return network
+}
+
+// networkCondition returns an InfluxQL condition that selects points from the Dashboard's network.
+// Points written before the network tag was added are all from mainnet.
+func (dash *Dashboard) networkCondition() string {
+	if dash.network.Name == MAINNET {
+		return fmt.Sprintf("(network = '%v' OR network = '')", MAINNET)
+	}
+	return fmt.Sprintf("network = '%v'", dash.network.Name)
+}
+
+// setupWorkerProgressDir creates the worker-progress directory if it doesn't already exist,
+// and returns its path. The directory is marked with the network its progress files belong
+// to, and using it with a different network is refused so that recovering from failures
+// never mixes blocks from different chains.
+func setupWorkerProgressDir(network string) string {
+	currentDir, err := os.Getwd()
+	if err != nil {
+		Logger{}.Fatal("Error getting working directory", "err", err)
+	}
+
+	// Create the progress directory if it doesn't already exist.
+	workerProgressDir := currentDir + "/worker-progress"
+	if _, err := os.Stat(workerProgressDir); os.IsNotExist(err) {
+		Logger{}.Info("Creating worker progress directory", "dir", workerProgressDir)
+		err := os.Mkdir(workerProgressDir, 0777)
+		if err != nil {
+			Logger{}.Fatal("Error creating worker progress directory", "dir", workerProgressDir, "err", err)
+		}
+	}
+
+	checkProgressNetwork(workerProgressDir, network)
+	return workerProgressDir
+}
+
+// checkProgressNetwork makes sure the worker-progress directory belongs to the given network,
+// marking it as such if it isn't marked yet.
+func checkProgressNetwork(workerProgressDir, network string) {
+	networkFile := workerProgressDir + "/" + NETWORK_FILE
+
+	contentsBytes, err := ioutil.ReadFile(networkFile)
+	if os.IsNotExist(err) {
+		err = ioutil.WriteFile(networkFile, []byte(network), 0666)
+		if err != nil {
+			Logger{}.Fatal("Error marking the network of the worker progress directory", "file", networkFile, "err", err)
+		}
+		return
+	}
+	if err != nil {
+		Logger{}.Fatal("Error reading the network of the worker progress directory", "file", networkFile, "err", err)
+	}
+
+	progressNetwork := strings.TrimSpace(string(contentsBytes))
+	if progressNetwork != network {
+		Logger{}.Fatal("Worker progress directory has progress for a different network than bitcoind's. Use a different working directory for each network.", "dir", workerProgressDir, "progress_network", progressNetwork, "network", network)
+	}
+}
+
+// dustThreshold returns the value below which an output is considered dust, using
+// the same calculation as bitcoind: the cost of creating and later spending the
+// output at the dust relay fee rate.
+func dustThreshold(out *wire.TxOut, dustRelayFee int64) int64 {
+	if len(out.PkScript) > 0 && out.PkScript[0] == txscript.OP_RETURN {
+		return 0
+	}
+
+	size := int64(out.SerializeSize())
+	if isWitnessProgram(out.PkScript) {
+		// Outpoint, script length, sequence and a discounted witness of a typical spend.
+		size += 32 + 4 + 1 + (107 / 4) + 4
+	} else {
+		size += 32 + 4 + 1 + 107 + 4
+	}
+
+	return size * dustRelayFee / 1000
+}
+
+// NetworkStats holds the block metrics that depend on the network's parameters.
+type NetworkStats struct {
+	HalvingEpoch       int64
+	BlocksUntilHalving int64
+	DustOutputs        int64
+}
+
+// computeNetworkStats computes the block metrics that depend on the network's parameters.
+func (dash *Dashboard) computeNetworkStats(data *BlockData) NetworkStats {
+	stats := NetworkStats{}
+	stats.HalvingEpoch = data.Height / dash.network.HalvingInterval
+	stats.BlocksUntilHalving = (stats.HalvingEpoch+1)*dash.network.HalvingInterval - data.Height
+
+	for _, tx := range data.Transactions {
+		for _, out := range tx.TxOut {
+			if out.Value < dustThreshold(out, dash.network.DustRelayFee) {
+				stats.DustOutputs++
+			}
+		}
+	}
+
+	return stats
+}
+
+func (metrics NetworkStats) setInfluxFields(fields map[string]interface{}) {
+	fields["halving_epoch"] = metrics.HalvingEpoch
+	fields["blocks_until_halving"] = metrics.BlocksUntilHalving
+	fields["num_dust_outputs"] = metrics.DustOutputs
+}
@@ -0,0 +1,333 @@
+package dashboard
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/btcsuite/btcd/rpcclient"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const PRIMARY_NODE_DEFAULT = "primary"
+const DIVERGENCE_REPORT_DIR_DEFAULT = "divergence-reports"
+
+// A NodeConfig is an entry in the nodes file, describing an extra bitcoind to compare against.
+type NodeConfig struct {
+	Name     string `json:"name"`
+	Host     string `json:"host"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// A Node is an extra bitcoind polled during live analysis.
+type Node struct {
+	Name   string
+	client *rpcclient.Client
+}
+
+// newRPCClient connects to a bitcoin core RPC server using HTTP POST mode.
+func newRPCClient(host, username, password string) *rpcclient.Client {
+	connCfg := &rpcclient.ConnConfig{
+		Host:         host,
+		User:         username,
+		Pass:         password,
+		HTTPPostMode: true, // Bitcoin core only supports HTTP POST mode
+		DisableTLS:   true, // Bitcoin core does not provide TLS by default
+	}
+	// Notice the notification parameter is nil since notifications are
+	// not supported in HTTP POST mode.
+	client, err := rpcclient.New(connCfg, nil)
+	if err != nil {
+		Logger{}.Fatal("Error creating RPC client", "host", host, "err", err)
+	}
+
+	return client
+}
+
+// primaryNodeName returns the name of the node set up with the BITCOIND_* environment
+// variables, which can be set with BITCOIND_NODE.
+func primaryNodeName() string {
+	if name := os.Getenv("BITCOIND_NODE"); name != "" {
+		return name
+	}
+	return PRIMARY_NODE_DEFAULT
+}
+
+// divergenceReportDir returns the directory divergence reports are written to, which
+// can be set with the DIVERGENCE_REPORT_DIR environment variable.
+func divergenceReportDir() string {
+	if path := os.Getenv("DIVERGENCE_REPORT_DIR"); path != "" {
+		return path
+	}
+	return DIVERGENCE_REPORT_DIR_DEFAULT
+}
+
+// connectNodes connects to every node listed in the file given by the NODES_FILE
+// environment variable. Returns no nodes if NODES_FILE isn't set.
+func (dash *Dashboard) connectNodes() []Node {
+	path := os.Getenv("NODES_FILE")
+	if path == "" {
+		return nil
+	}
+
+	contentsBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		dash.logger.Fatal("Error reading nodes file", "file", path, "err", err)
+	}
+
+	var configs []NodeConfig
+	err = json.Unmarshal(contentsBytes, &configs)
+	if err != nil {
+		dash.logger.Fatal("Error parsing nodes file", "file", path, "err", err)
+	}
+
+	nodes := make([]Node, 0, len(configs))
+	for _, config := range configs {
+		if config.Name == "" || config.Name == dash.node {
+			dash.logger.Fatal("Nodes need a unique name", "file", path, "host", config.Host)
+		}
+
+		node := Node{config.Name, newRPCClient(config.Host, config.Username, config.Password)}
+
+		// Comparing nodes on different chains would report every block as divergent.
+		info, err := node.client.GetBlockChainInfo()
+		if err != nil {
+			dash.logger.Fatal("Error connecting to node", "node", node.Name, "err", err)
+		}
+		if info.Chain != dash.network.Name {
+			dash.logger.Fatal("Node is on a different network", "node", node.Name, "node_network", info.Chain, "network", dash.network.Name)
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	dash.logger.Info("Comparing against other nodes", "node", dash.node, "nodes", len(nodes))
+	return nodes
+}
+
+func shutdownNodes(nodes []Node) {
+	for _, node := range nodes {
+		node.client.Shutdown()
+	}
+}
+
+// rawBlockStats uses the getblockstats RPC and returns every stat in the result by name.
+// Nodes running different versions of bitcoind return different sets of stats.
+func rawBlockStats(client *rpcclient.Client, height int64) (map[string]json.RawMessage, error) {
+	heightJSON, err := json.Marshal(height)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.RawRequest("getblockstats", []json.RawMessage{heightJSON})
+	if err != nil {
+		return nil, err
+	}
+
+	var stats map[string]json.RawMessage
+	err = json.Unmarshal(res, &stats)
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// A NodeView is what a single node reports about a block.
+type NodeView struct {
+	Node        string   `json:"node"`
+	BlockCount  int64    `json:"block_count"`
+	Hash        string   `json:"hash,omitempty"`
+	Error       string   `json:"error,omitempty"`
+	StatsDiffer []string `json:"stats_differ,omitempty"`
+
+	stats map[string]json.RawMessage
+}
+
+// A DivergenceReport describes a block that nodes disagree on.
+type DivergenceReport struct {
+	Network string                                `json:"network"`
+	Height  int64                                 `json:"height"`
+	Time    time.Time                             `json:"time"`
+	Nodes   []NodeView                            `json:"nodes"`
+	Stats   map[string]map[string]json.RawMessage `json:"stats,omitempty"` // stat name -> node -> value
+}
+
+// viewBlock asks a node for its tip and for the hash and stats of the block at the given height.
+func viewBlock(name string, client *rpcclient.Client, height int64) NodeView {
+	view := NodeView{Node: name}
+
+	blockCount, err := client.GetBlockCount()
+	if err != nil {
+		view.Error = err.Error()
+		return view
+	}
+	view.BlockCount = blockCount
+
+	// A node with a stale tip doesn't have the block yet.
+	if blockCount < height {
+		return view
+	}
+
+	hash, err := client.GetBlockHash(height)
+	if err != nil {
+		view.Error = err.Error()
+		return view
+	}
+	view.Hash = hash.String()
+
+	view.stats, err = rawBlockStats(client, height)
+	if err != nil {
+		view.Error = err.Error()
+	}
+
+	return view
+}
+
+// differingStats returns the names of stats both nodes report with different values, in order.
+func differingStats(a, b map[string]json.RawMessage) []string {
+	names := make([]string, 0)
+	for name, aValue := range a {
+		bValue, ok := b[name]
+		if !ok {
+			continue
+		}
+
+		var aCompact, bCompact bytes.Buffer
+		if json.Compact(&aCompact, aValue) != nil || json.Compact(&bCompact, bValue) != nil {
+			continue
+		}
+		if !bytes.Equal(aCompact.Bytes(), bCompact.Bytes()) {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// checkNodeDivergence compares what every node reports about the block at the given height
+// with what the Dashboard's node reports. A point is added to the node_divergence measurement
+// for every node, tagged with node, and a divergence report is written if any node disagrees
+// on the block hash or on getblockstats results, or doesn't have the block yet.
+func (dash *Dashboard) checkNodeDivergence(height int64, nodes []Node) {
+	if len(nodes) == 0 {
+		return
+	}
+
+	primary := viewBlock(dash.node, dash.client, height)
+	if primary.Error != "" || primary.Hash == "" {
+		dash.logger.Warn("Can't check node divergence, the primary node has no block", "height", height, "node", dash.node, "err", primary.Error)
+		return
+	}
+
+	// Points are written at the primary node's block time like the other block
+	// measurements, so checking a height again overwrites them and a reorg deletes them.
+	header, err := dash.getBlockHeader(primary.Hash)
+	if err != nil {
+		dash.logger.Warn("Can't check node divergence, error getting the primary node's header", "height", height, "node", dash.node, "err", err)
+		return
+	}
+	pointTime := blockPointTime(time.Unix(header.Time, 0), height)
+
+	report := DivergenceReport{
+		Network: dash.network.Name,
+		Height:  height,
+		Time:    time.Now().UTC(),
+		Nodes:   []NodeView{primary},
+		Stats:   make(map[string]map[string]json.RawMessage),
+	}
+	diverged := false
+
+	for _, node := range nodes {
+		view := viewBlock(node.Name, node.client, height)
+
+		hashMatches := view.Hash == primary.Hash
+		if hashMatches {
+			view.StatsDiffer = differingStats(primary.stats, view.stats)
+		}
+
+		for _, name := range view.StatsDiffer {
+			if report.Stats[name] == nil {
+				report.Stats[name] = map[string]json.RawMessage{primary.Node: primary.stats[name]}
+			}
+			report.Stats[name][view.Node] = view.stats[name]
+		}
+
+		if !hashMatches || len(view.StatsDiffer) > 0 || view.Error != "" {
+			diverged = true
+		}
+		report.Nodes = append(report.Nodes, view)
+
+		tags := make(map[string]string)        // for influxdb
+		fields := make(map[string]interface{}) // for influxdb
+
+		tags["node"] = view.Node
+		tags["network"] = dash.network.Name
+		setBlockKey(tags, fields, height, dash.network.Name)
+
+		fields["block_count"] = view.BlockCount
+		fields["tip_lag"] = primary.BlockCount - view.BlockCount
+		fields["has_block"] = view.Hash != ""
+		fields["hash_matches"] = hashMatches
+		fields["num_stats_differ"] = int64(len(view.StatsDiffer))
+		fields["stats_differ"] = strings.Join(view.StatsDiffer, ",")
+		fields["rpc_error"] = view.Error != ""
+
+		pt, err := newPoint(
+			"node_divergence",
+			tags,
+			fields,
+			pointTime,
+		)
+		if err != nil {
+			dash.logger.Fatal("Error creating new point", "measurement", "node_divergence", "height", height, "err", err)
+		}
+
+		dash.bp.AddPoint(pt)
+	}
+
+	if diverged {
+		dash.writeDivergenceReport(report)
+	}
+}
+
+// writeDivergenceReport logs a summary of a divergence report and writes it in full
+// to the divergence report directory.
+func (dash *Dashboard) writeDivergenceReport(report DivergenceReport) {
+	for _, view := range report.Nodes[1:] {
+		switch {
+		case view.Error != "":
+			dash.logger.Warn("DIVERGENCE: node returned an error", "height", report.Height, "node", view.Node, "err", view.Error)
+		case view.Hash == "":
+			dash.logger.Warn("DIVERGENCE: node is behind", "height", report.Height, "node", view.Node, "block_count", view.BlockCount)
+		case view.Hash != report.Nodes[0].Hash:
+			dash.logger.Warn("DIVERGENCE: node has a different block", "height", report.Height, "node", view.Node, "hash", view.Hash, "primary_hash", report.Nodes[0].Hash)
+		case len(view.StatsDiffer) > 0:
+			dash.logger.Warn("DIVERGENCE: node disagrees on stats", "height", report.Height, "node", view.Node, "stats", strings.Join(view.StatsDiffer, ","))
+		}
+	}
+
+	dir := divergenceReportDir()
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		err := os.Mkdir(dir, 0777)
+		if err != nil {
+			dash.logger.Fatal("Error creating divergence report directory", "dir", dir, "err", err)
+		}
+	}
+
+	contentsBytes, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		dash.logger.Fatal("Error encoding divergence report", "height", report.Height, "err", err)
+	}
+
+	reportFile := fmt.Sprintf("%v/%v-%v.json", dir, report.Network, report.Height)
+	err = ioutil.WriteFile(reportFile, contentsBytes, 0666)
+	if err != nil {
+		dash.logger.Error("Error writing divergence report", "file", reportFile, "err", err)
+	}
+}
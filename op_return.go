@@ -0,0 +1,278 @@
+package dashboard
+
+import (
+	"bytes"
+	"crypto/rc4"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const OP_RETURN_PROTOCOLS_FILE_DEFAULT = "op_return_protocols.json"
+
+// Protocol names for OP_RETURN outputs that don't match any entry in the protocol table.
+const (
+	OP_RETURN_UNKNOWN = "unknown"
+	OP_RETURN_EMPTY   = "empty"
+)
+
+// An OpReturnProtocol is an entry in the OP_RETURN protocol table.
+// An output matches if its data starts with Prefix (hex). By default the prefix is
+// compared against the data pushed after OP_RETURN; if MatchScript is set it's compared
+// against the script bytes that follow the OP_RETURN opcode instead, for protocols
+// that are marked by an opcode. If Length is set, the pushed data must also be exactly
+// that many bytes long. If ARC4FirstInput is set, the pushed data is decrypted with
+// ARC4 keyed by the txid of the transaction's first input before matching, as
+// Counterparty does. Heuristic entries, for protocols without a marker of their own,
+// may match on Length alone. They're only used when OP_RETURN_HEURISTICS is set, and
+// only after every other entry.
+type OpReturnProtocol struct {
+	Name           string `json:"name"`
+	Prefix         string `json:"prefix"`
+	MatchScript    bool   `json:"match_script"`
+	Length         int    `json:"length"`
+	ARC4FirstInput bool   `json:"arc4_first_input"`
+	Heuristic      bool   `json:"heuristic"`
+
+	prefixBytes []byte
+}
+
+// opReturnCache holds the most recently loaded protocol table. Like the pool
+// definitions, the file is reloaded whenever its modification time changes.
+var opReturnCache struct {
+	sync.Mutex
+	protocols []OpReturnProtocol
+	modTime   time.Time
+	loaded    bool
+}
+
+// opReturnProtocolsFile returns the path of the OP_RETURN protocol table, which can be
+// set with the OP_RETURN_PROTOCOLS_FILE environment variable.
+func opReturnProtocolsFile() string {
+	if path := os.Getenv("OP_RETURN_PROTOCOLS_FILE"); path != "" {
+		return path
+	}
+	return OP_RETURN_PROTOCOLS_FILE_DEFAULT
+}
+
+// opReturnHeuristics returns whether heuristic entries of the protocol table are used,
+// which can be set with the OP_RETURN_HEURISTICS environment variable.
+func opReturnHeuristics() bool {
+	value := os.Getenv("OP_RETURN_HEURISTICS")
+	if value == "" {
+		return false
+	}
+
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		Logger{}.Fatal("Bad OP_RETURN_HEURISTICS", "value", value)
+	}
+	return enabled
+}
+
+// loadOpReturnProtocols returns the current protocol table, reloading it from disk
+// if the file has changed since it was last read. Entries are matched in order.
+func loadOpReturnProtocols() []OpReturnProtocol {
+	opReturnCache.Lock()
+	defer opReturnCache.Unlock()
+
+	path := opReturnProtocolsFile()
+	info, err := os.Stat(path)
+	if err != nil {
+		if !opReturnCache.loaded {
+			Logger{}.Warn("No OP_RETURN protocols loaded, outputs will be tagged with protocol="+OP_RETURN_UNKNOWN, "file", path, "err", err)
+			opReturnCache.loaded = true
+		}
+		return opReturnCache.protocols
+	}
+
+	if opReturnCache.loaded && info.ModTime().Equal(opReturnCache.modTime) {
+		return opReturnCache.protocols
+	}
+
+	contentsBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		Logger{}.Error("Error reading OP_RETURN protocols", "file", path, "err", err)
+		return opReturnCache.protocols
+	}
+
+	var protocols []OpReturnProtocol
+	err = json.Unmarshal(contentsBytes, &protocols)
+	if err != nil {
+		Logger{}.Error("Error parsing OP_RETURN protocols", "file", path, "err", err)
+		return opReturnCache.protocols
+	}
+
+	for i := range protocols {
+		protocols[i].prefixBytes, err = hex.DecodeString(protocols[i].Prefix)
+		if err != nil {
+			Logger{}.Error("Bad prefix for OP_RETURN protocol", "file", path, "protocol", protocols[i].Name, "err", err)
+			return opReturnCache.protocols
+		}
+
+		// Without a prefix, an entry would claim every output of its length, which is
+		// only allowed for heuristics.
+		if len(protocols[i].prefixBytes) == 0 && !(protocols[i].Heuristic && protocols[i].Length != 0) {
+			Logger{}.Error("OP_RETURN protocol has no prefix and isn't a heuristic with a length", "file", path, "protocol", protocols[i].Name)
+			return opReturnCache.protocols
+		}
+	}
+
+	// Heuristics are dropped unless they're enabled, and otherwise matched last.
+	matched := make([]OpReturnProtocol, 0, len(protocols))
+	for _, protocol := range protocols {
+		if !protocol.Heuristic {
+			matched = append(matched, protocol)
+		}
+	}
+	if opReturnHeuristics() {
+		for _, protocol := range protocols {
+			if protocol.Heuristic {
+				matched = append(matched, protocol)
+			}
+		}
+	}
+	protocols = matched
+
+	Logger{}.Info("Loaded OP_RETURN protocols", "file", path, "protocols", len(protocols))
+	opReturnCache.protocols = protocols
+	opReturnCache.modTime = info.ModTime()
+	opReturnCache.loaded = true
+
+	return protocols
+}
+
+// opReturnPayload returns the data pushed after the OP_RETURN opcode.
+// If the rest of the script doesn't parse, its raw bytes are returned instead.
+func opReturnPayload(pkScript []byte) []byte {
+	pushes, err := txscript.PushedData(pkScript[1:])
+	if err != nil {
+		return pkScript[1:]
+	}
+	return bytes.Join(pushes, nil)
+}
+
+// arc4Decrypt decrypts data with ARC4, keyed by the txid of the transaction's first input.
+func arc4Decrypt(tx *wire.MsgTx, data []byte) []byte {
+	if len(tx.TxIn) == 0 {
+		return data
+	}
+
+	key, err := hex.DecodeString(tx.TxIn[0].PreviousOutPoint.Hash.String())
+	if err != nil {
+		return data
+	}
+	cipher, err := rc4.NewCipher(key)
+	if err != nil {
+		return data
+	}
+
+	decrypted := make([]byte, len(data))
+	cipher.XORKeyStream(decrypted, data)
+	return decrypted
+}
+
+// classifyOpReturn returns the name of the protocol that created an OP_RETURN output.
+func classifyOpReturn(tx *wire.MsgTx, pkScript []byte, protocols []OpReturnProtocol) string {
+	if len(pkScript) == 1 {
+		return OP_RETURN_EMPTY
+	}
+	payload := opReturnPayload(pkScript)
+
+	for _, protocol := range protocols {
+		data := payload
+		if protocol.MatchScript {
+			data = pkScript[1:]
+		} else if protocol.ARC4FirstInput {
+			data = arc4Decrypt(tx, payload)
+		}
+
+		if protocol.Length != 0 && len(payload) != protocol.Length {
+			continue
+		}
+		if bytes.HasPrefix(data, protocol.prefixBytes) {
+			return protocol.Name
+		}
+	}
+
+	return OP_RETURN_UNKNOWN
+}
+
+// OpReturnCounts holds the number and size of OP_RETURN outputs created by a single protocol in a block.
+type OpReturnCounts struct {
+	Outputs      int64
+	PayloadBytes int64
+	ScriptBytes  int64
+	Txs          int64
+}
+
+func (counts OpReturnCounts) setInfluxFields(fields map[string]interface{}) {
+	fields["num_outputs"] = counts.Outputs
+	fields["payload_bytes"] = counts.PayloadBytes
+	fields["script_bytes"] = counts.ScriptBytes
+	fields["num_txs"] = counts.Txs
+}
+
+// analyzeOpReturns adds a point to the op_return measurement for each known protocol,
+// tagged with protocol in addition to the block's tags.
+func (dash *Dashboard) analyzeOpReturns(data *BlockData, blockTags map[string]string, blockTime time.Time) {
+	protocols := loadOpReturnProtocols()
+
+	counts := make(map[string]*OpReturnCounts)
+	names := []string{OP_RETURN_EMPTY, OP_RETURN_UNKNOWN}
+	for _, protocol := range protocols {
+		names = append(names, protocol.Name)
+	}
+	for _, name := range names {
+		counts[name] = &OpReturnCounts{}
+	}
+
+	for _, tx := range data.Transactions {
+		seen := make(map[string]bool)
+		for _, out := range tx.TxOut {
+			if len(out.PkScript) == 0 || out.PkScript[0] != txscript.OP_RETURN {
+				continue
+			}
+
+			name := classifyOpReturn(tx, out.PkScript, protocols)
+			counts[name].Outputs++
+			counts[name].PayloadBytes += int64(len(opReturnPayload(out.PkScript)))
+			counts[name].ScriptBytes += int64(len(out.PkScript))
+			seen[name] = true
+		}
+		for name := range seen {
+			counts[name].Txs++
+		}
+	}
+
+	for name, protocolCounts := range counts {
+		tags := make(map[string]string)        // for influxdb
+		fields := make(map[string]interface{}) // for influxdb
+
+		for k, v := range blockTags {
+			tags[k] = v
+		}
+		tags["protocol"] = name
+		setBlockKey(tags, fields, data.Height, tags["network"])
+
+		protocolCounts.setInfluxFields(fields)
+
+		pt, err := newPoint(
+			"op_return",
+			tags,
+			fields,
+			blockTime,
+		)
+		if err != nil {
+			dash.logger.Fatal("Error creating new point", "measurement", "op_return", "height", data.Height, "err", err)
+		}
+
+		dash.bp.AddPoint(pt)
+	}
+}
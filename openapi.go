@@ -0,0 +1,116 @@
+package dashboard
+
+// OPENAPI_SPEC describes the API served by the serve command.
+const OPENAPI_SPEC = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "btc-dashboard",
+    "version": "1.0.0",
+    "description": "Per-block statistics computed by btc-dashboard. Fields are the same as those written to the block_metrics measurement in influxdb, and are listed by /v1/fields. Every response has an ETag; send it back in If-None-Match to get 304 Not Modified if nothing changed."
+  },
+  "paths": {
+    "/v1/blocks/{height}": {
+      "get": {
+        "summary": "Metrics of the block at a height",
+        "parameters": [
+          {"name": "height", "in": "path", "required": true, "schema": {"type": "integer", "minimum": 0}}
+        ],
+        "responses": {
+          "200": {"description": "The block", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Block"}}}},
+          "304": {"description": "Not modified"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/blocks": {
+      "get": {
+        "summary": "Metrics of the blocks with heights in [from, to]",
+        "description": "Each page covers at most limit heights. Heights that haven't been analyzed are left out, so a page can have fewer blocks than limit. Follow next until it's absent to get every block in the range.",
+        "parameters": [
+          {"name": "from", "in": "query", "required": true, "schema": {"type": "integer", "minimum": 0}},
+          {"name": "to", "in": "query", "required": true, "schema": {"type": "integer", "minimum": 0}},
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 1000, "default": 100}}
+        ],
+        "responses": {
+          "200": {"description": "A page of blocks", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/BlocksPage"}}}},
+          "304": {"description": "Not modified"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/latest": {
+      "get": {
+        "summary": "Metrics of the highest analyzed block",
+        "responses": {
+          "200": {"description": "The block", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Block"}}}},
+          "304": {"description": "Not modified"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/fields": {
+      "get": {
+        "summary": "Every field a block can have",
+        "responses": {
+          "200": {"description": "The fields", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Field"}}}}},
+          "304": {"description": "Not modified"}
+        }
+      }
+    },
+    "/v1/openapi.json": {
+      "get": {
+        "summary": "This document",
+        "responses": {
+          "200": {"description": "The OpenAPI document", "content": {"application/json": {}}}
+        }
+      }
+    }
+  },
+  "components": {
+    "schemas": {
+      "Block": {
+        "type": "object",
+        "required": ["height", "time", "network", "tags", "fields"],
+        "properties": {
+          "height": {"type": "integer"},
+          "time": {"type": "string", "format": "date-time"},
+          "network": {"type": "string"},
+          "tags": {"type": "object", "additionalProperties": {"type": "string"}, "description": "Tags of the point, such as node, pool and epoch."},
+          "fields": {"type": "object", "additionalProperties": {"oneOf": [{"type": "integer"}, {"type": "number"}, {"type": "string"}]}, "description": "Fields of the point, as described by /v1/fields."}
+        }
+      },
+      "BlocksPage": {
+        "type": "object",
+        "required": ["blocks"],
+        "properties": {
+          "blocks": {"type": "array", "items": {"$ref": "#/components/schemas/Block"}},
+          "next": {"type": "string", "description": "URL of the next page. Absent on the last page."}
+        }
+      },
+      "Field": {
+        "type": "object",
+        "properties": {
+          "measurement": {"type": "string"},
+          "name": {"type": "string", "description": "Name of the field. {} stands for a bin index or bucket name."},
+          "type": {"type": "string", "enum": ["int64", "float64", "string", "bool"]},
+          "unit": {"type": "string"},
+          "description": {"type": "string"},
+          "source": {"type": "string"}
+        }
+      },
+      "Error": {
+        "type": "object",
+        "properties": {
+          "error": {"type": "string"}
+        }
+      }
+    },
+    "responses": {
+      "Error": {"description": "An error", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    }
+  }
+}`
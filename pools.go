@@ -0,0 +1,130 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const POOLS_FILE_DEFAULT = "pools.json"
+const UNKNOWN_POOL = "unknown"
+
+// A Pool is an entry in the pool-definition file.
+type Pool struct {
+	Name string `json:"name"`
+	Link string `json:"link"`
+}
+
+// PoolDefinitions maps coinbase scriptSig tags and payout addresses to mining pools.
+// The format follows the pools.json files maintained by block explorers, so an
+// updated copy can be dropped in without any conversion.
+type PoolDefinitions struct {
+	CoinbaseTags    map[string]Pool `json:"coinbase_tags"`
+	PayoutAddresses map[string]Pool `json:"payout_addresses"`
+}
+
+// poolCache holds the most recently loaded pool definitions. The file is
+// reloaded whenever its modification time changes so that the definitions
+// can be updated while a live analysis is running.
+var poolCache struct {
+	sync.Mutex
+	defs    PoolDefinitions
+	modTime time.Time
+	loaded  bool
+}
+
+// poolsFile returns the path of the pool-definition file, which can be set
+// with the POOLS_FILE environment variable.
+func poolsFile() string {
+	if path := os.Getenv("POOLS_FILE"); path != "" {
+		return path
+	}
+	return POOLS_FILE_DEFAULT
+}
+
+// loadPoolDefinitions returns the current pool definitions, reloading them
+// from disk if the file has changed since it was last read.
+func loadPoolDefinitions() PoolDefinitions {
+	poolCache.Lock()
+	defer poolCache.Unlock()
+
+	path := poolsFile()
+	info, err := os.Stat(path)
+	if err != nil {
+		if !poolCache.loaded {
+			Logger{}.Warn("No pool definitions loaded, blocks will be tagged with pool="+UNKNOWN_POOL, "file", path, "err", err)
+			poolCache.loaded = true
+		}
+		return poolCache.defs
+	}
+
+	if poolCache.loaded && info.ModTime().Equal(poolCache.modTime) {
+		return poolCache.defs
+	}
+
+	contentsBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		Logger{}.Error("Error reading pool definitions", "file", path, "err", err)
+		return poolCache.defs
+	}
+
+	var defs PoolDefinitions
+	err = json.Unmarshal(contentsBytes, &defs)
+	if err != nil {
+		// Keep using the previous definitions so a bad edit doesn't wipe out attribution.
+		Logger{}.Error("Error parsing pool definitions", "file", path, "err", err)
+		return poolCache.defs
+	}
+
+	Logger{}.Info("Loaded pool definitions", "file", path, "coinbase_tags", len(defs.CoinbaseTags), "payout_addresses", len(defs.PayoutAddresses))
+	poolCache.defs = defs
+	poolCache.modTime = info.ModTime()
+	poolCache.loaded = true
+
+	return defs
+}
+
+// identifyPool attributes a block to a mining pool by looking for a known tag in
+// its coinbase scriptSig, and then for a known payout address in the coinbase outputs.
+// Blocks that can't be attributed are given the pool name UNKNOWN_POOL.
+func identifyPool(coinbase *wire.MsgTx, chainParams *chaincfg.Params) string {
+	if len(coinbase.TxIn) == 0 {
+		return UNKNOWN_POOL
+	}
+
+	defs := loadPoolDefinitions()
+	scriptSig := string(coinbase.TxIn[0].SignatureScript)
+
+	// Use the longest matching tag so that the result doesn't depend on map
+	// iteration order when one pool's tag contains another's.
+	matchedTag := ""
+	for tag := range defs.CoinbaseTags {
+		if len(tag) > len(matchedTag) && strings.Contains(scriptSig, tag) {
+			matchedTag = tag
+		}
+	}
+	if matchedTag != "" {
+		return defs.CoinbaseTags[matchedTag].Name
+	}
+
+	for _, out := range coinbase.TxOut {
+		_, addrs, _, err := txscript.ExtractPkScriptAddrs(out.PkScript, chainParams)
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			if pool, ok := defs.PayoutAddresses[addr.EncodeAddress()]; ok {
+				return pool.Name
+			}
+		}
+	}
+
+	return UNKNOWN_POOL
+}
@@ -0,0 +1,127 @@
+package dashboard
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+// A Prevout is the output spent by a transaction input.
+type Prevout struct {
+	PkScript  []byte
+	Value     int64 // in satoshis
+	Height    int64 // height of the block that created the output
+	Generated bool  // true if the output was created by a coinbase transaction
+}
+
+// BlockData is a block's transactions along with the outputs spent by each of their inputs.
+// Prevouts[i][j] is the output spent by input j of transaction i. The coinbase
+// transaction has no prevouts.
+type BlockData struct {
+	Hash         string
+	Height       int64
+	Time         int64
+	Transactions []*wire.MsgTx
+	Prevouts     [][]Prevout
+}
+
+// The parts of the getblock RPC result (with verbosity 3) that we decode.
+type getBlockResult struct {
+	Hash   string `json:"hash"`
+	Height int64  `json:"height"`
+	Time   int64  `json:"time"`
+	Tx     []struct {
+		Hex string `json:"hex"`
+		Vin []struct {
+			Prevout *struct {
+				Generated    bool    `json:"generated"`
+				Height       int64   `json:"height"`
+				Value        float64 `json:"value"`
+				ScriptPubKey struct {
+					Hex string `json:"hex"`
+				} `json:"scriptPubKey"`
+			} `json:"prevout"`
+		} `json:"vin"`
+	} `json:"tx"`
+}
+
+// getBlockData uses the getblock RPC to fetch a block along with the outputs spent by its inputs.
+// This needs verbosity level 3 of getblock, which is available in stock bitcoind since v23.0.
+func (dash *Dashboard) getBlockData(hash string) (*BlockData, error) {
+	hashJSON, err := json.Marshal(hash)
+	if err != nil {
+		return nil, err
+	}
+	verbosityJSON, err := json.Marshal(3)
+	if err != nil {
+		return nil, err
+	}
+
+	start := throttleRPC()
+	res, err := dash.client.RawRequest("getblock", []json.RawMessage{hashJSON, verbosityJSON})
+	internal.observeRPC("getblock", start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	var result getBlockResult
+	err = json.Unmarshal(res, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &BlockData{
+		Hash:         result.Hash,
+		Height:       result.Height,
+		Time:         result.Time,
+		Transactions: make([]*wire.MsgTx, len(result.Tx)),
+		Prevouts:     make([][]Prevout, len(result.Tx)),
+	}
+
+	for i, tx := range result.Tx {
+		txBytes, err := hex.DecodeString(tx.Hex)
+		if err != nil {
+			return nil, err
+		}
+
+		msgTx := wire.NewMsgTx(wire.TxVersion)
+		err = msgTx.Deserialize(bytes.NewReader(txBytes))
+		if err != nil {
+			return nil, err
+		}
+		data.Transactions[i] = msgTx
+
+		// The coinbase input doesn't spend anything.
+		if i == 0 {
+			continue
+		}
+
+		prevouts := make([]Prevout, len(tx.Vin))
+		for j, in := range tx.Vin {
+			if in.Prevout == nil {
+				continue
+			}
+
+			pkScript, err := hex.DecodeString(in.Prevout.ScriptPubKey.Hex)
+			if err != nil {
+				return nil, err
+			}
+			value, err := btcutil.NewAmount(in.Prevout.Value)
+			if err != nil {
+				return nil, err
+			}
+
+			prevouts[j] = Prevout{
+				PkScript:  pkScript,
+				Value:     int64(value),
+				Height:    in.Prevout.Height,
+				Generated: in.Prevout.Generated,
+			}
+		}
+		data.Prevouts[i] = prevouts
+	}
+
+	return data, nil
+}
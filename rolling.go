@@ -0,0 +1,266 @@
+package dashboard
+
+import (
+	"fmt"
+	influxClient "github.com/influxdata/influxdb/client/v2"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Window sizes, in blocks, of the rolling averages written to block_metrics_rolling.
+var ROLLING_WINDOWS = []int64{6, 144, 1008}
+
+// Number of heights put in a single influxdb query when loading blocks for rolling windows.
+const ROLLING_QUERY_BATCH = 100
+
+// A rollingBlock holds the numeric fields of a block that's still needed by a rolling window.
+type rollingBlock struct {
+	time    time.Time
+	network string
+	fields  map[string]float64
+}
+
+// rollingStore keeps the fields of recently analyzed blocks so that rolling windows can be
+// computed as soon as every block in them has been seen. Workers analyze blocks out of
+// order, so a window is only computed once all of its blocks are present. Blocks are
+// dropped once every window that contains them has been computed.
+type rollingStore struct {
+	sync.Mutex
+	blocks map[int64]rollingBlock
+	done   map[int64]bool // heights whose windows have all been computed
+}
+
+// All workers in the process share a single rolling store.
+var rolling = rollingStore{
+	blocks: make(map[int64]rollingBlock),
+	done:   make(map[int64]bool),
+}
+
+// maxRollingWindow returns the largest window in ROLLING_WINDOWS.
+func maxRollingWindow() int64 {
+	max := int64(0)
+	for _, w := range ROLLING_WINDOWS {
+		if w > max {
+			max = w
+		}
+	}
+	return max
+}
+
+// has reports whether the block at the given height is available for rolling windows.
+// Must be called with the store locked.
+func (store *rollingStore) has(height int64) bool {
+	_, ok := store.blocks[height]
+	return ok || store.done[height]
+}
+
+// addBlock stores the numeric fields of a block and returns a point for every rolling
+// window that was completed by adding it, along with the anomalies of the blocks ending
+// the completed windows of ANOMALY_WINDOW blocks.
+func (store *rollingStore) addBlock(height int64, blockTime time.Time, network string, fields map[string]interface{}) []*influxClient.Point {
+	store.Lock()
+	defer store.Unlock()
+
+	if store.done[height] {
+		return nil
+	}
+
+	block := rollingBlock{blockTime, network, make(map[string]float64)}
+	for name, value := range fields {
+		// Blocks loaded from influxdb can have fields that are no longer written.
+		if _, ok := lookupMetric("block_metrics", name); !ok {
+			continue
+		}
+		if f, ok := toFloat(value); ok {
+			block.fields[name] = f
+		}
+	}
+
+	// A block that's analyzed twice only needs its fields updated, since any window
+	// containing it is still waiting on some other block.
+	_, seen := store.blocks[height]
+	store.blocks[height] = block
+	if seen {
+		return nil
+	}
+
+	// Find the contiguous run of available blocks around this one. Every window that
+	// became complete lies inside this run, and no window ending past the largest
+	// window size away can include this block.
+	maxWindow := maxRollingWindow()
+	low, high := height, height
+	for low > height-2*maxWindow && low > 0 && store.has(low-1) {
+		low--
+	}
+	for high < height+2*maxWindow && store.has(high+1) {
+		high++
+	}
+
+	points := make([]*influxClient.Point, 0)
+	for _, window := range ROLLING_WINDOWS {
+		firstEnd := height
+		if low+window-1 > firstEnd {
+			firstEnd = low + window - 1
+		}
+		lastEnd := height + window - 1
+		if high < lastEnd {
+			lastEnd = high
+		}
+
+		for end := firstEnd; end <= lastEnd; end++ {
+			points = append(points, store.windowPoint(end, window))
+			if window == ANOMALY_WINDOW {
+				points = append(points, store.anomalyPoints(end)...)
+			}
+		}
+	}
+
+	// Drop blocks whose windows have now all been computed.
+	for h := low + maxWindow - 1; h <= high-maxWindow+1; h++ {
+		if _, ok := store.blocks[h]; ok {
+			delete(store.blocks, h)
+			store.done[h] = true
+		}
+	}
+
+	return points
+}
+
+// windowPoint computes the average of each field over the window of blocks ending at the given height.
+// A field that is missing from some blocks is averaged over the blocks that have it.
+// Must be called with the store locked.
+func (store *rollingStore) windowPoint(end, window int64) *influxClient.Point {
+	tags := make(map[string]string)        // for influxdb
+	fields := make(map[string]interface{}) // for influxdb
+
+	sums := make(map[string]float64)
+	counts := make(map[string]int)
+	for h := end - window + 1; h <= end; h++ {
+		for name, value := range store.blocks[h].fields {
+			sums[name] += value
+			counts[name]++
+		}
+	}
+
+	for name, sum := range sums {
+		fields[name] = sum / float64(counts[name])
+	}
+
+	tags["window"] = strconv.Itoa(int(window))
+	tags["network"] = store.blocks[end].network
+	setBlockKey(tags, fields, end, store.blocks[end].network)
+
+	pt, err := newPoint(
+		"block_metrics_rolling",
+		tags,
+		fields,
+		blockPointTime(store.blocks[end].time, end),
+	)
+	if err != nil {
+		Logger{}.Fatal("Error creating new point", "measurement", "block_metrics_rolling", "height", end, "err", err)
+	}
+
+	return pt
+}
+
+// missingNeighbors returns the heights that are needed to complete the pending windows
+// of stored blocks, but that haven't been analyzed by this process.
+func (store *rollingStore) missingNeighbors() []int64 {
+	store.Lock()
+	defer store.Unlock()
+
+	maxWindow := maxRollingWindow()
+	missing := make(map[int64]bool)
+	for height := range store.blocks {
+		for h := height - maxWindow + 1; h < height+maxWindow; h++ {
+			if h >= 0 && !store.has(h) {
+				missing[h] = true
+			}
+		}
+	}
+
+	heights := make([]int64, 0, len(missing))
+	for h := range missing {
+		heights = append(heights, h)
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+
+	return heights
+}
+
+// removeBlock drops a block that was reorganized away, so the block that replaces it is
+// added as a new block and the windows ending at its height are computed again. Those
+// windows also cover the blocks before it, so the ones that were already dropped are
+// no longer marked done, and are returned to be loaded again.
+func (store *rollingStore) removeBlock(height int64) []int64 {
+	store.Lock()
+	defer store.Unlock()
+
+	delete(store.blocks, height)
+	delete(store.done, height)
+
+	reload := make([]int64, 0)
+	for h := height - maxRollingWindow() + 1; h < height; h++ {
+		if store.done[h] {
+			delete(store.done, h)
+			reload = append(reload, h)
+		}
+	}
+	return reload
+}
+
+// analyzeRollingWindows adds a block to the rolling store and adds any completed
+// rolling windows to the Dashboard's batchpoints.
+func (dash *Dashboard) analyzeRollingWindows(blockHeight int64, blockTime time.Time, fields map[string]interface{}) {
+	for _, pt := range rolling.addBlock(blockHeight, blockTime, dash.network.Name, fields) {
+		dash.bp.AddPoint(pt)
+	}
+}
+
+// loadRollingBlocks reads the given heights from block_metrics in influxdb and adds
+// them to the rolling store, completing any windows that were waiting on them.
+// Heights that haven't been stored in influxdb yet are skipped.
+func (dash *Dashboard) loadRollingBlocks(heights []int64) {
+	for i := 0; i < len(heights); i += ROLLING_QUERY_BATCH {
+		end := i + ROLLING_QUERY_BATCH
+		if end > len(heights) {
+			end = len(heights)
+		}
+
+		conditions := make([]string, 0, end-i)
+		for _, h := range heights[i:end] {
+			conditions = append(conditions, heightCondition(h))
+		}
+
+		query := fmt.Sprintf("SELECT * FROM block_metrics WHERE %v AND (%v) GROUP BY *", dash.networkCondition(), strings.Join(conditions, " OR "))
+		points, err := dash.queryPoints(query)
+		if err != nil {
+			dash.logger.Fatal("Error loading blocks for rolling windows", "err", err)
+		}
+
+		for _, point := range points {
+			height, err := point.height()
+			if err != nil {
+				dash.logger.Fatal("Bad height in stored block", "err", err)
+			}
+
+			dash.analyzeRollingWindows(height, point.Time, point.Fields)
+		}
+	}
+}
+
+// completeRollingWindows fills in the rolling windows that are still waiting on blocks
+// which were analyzed by an earlier run, and writes the results to influxdb.
+func (dash *Dashboard) completeRollingWindows() {
+	missing := rolling.missingNeighbors()
+	if len(missing) == 0 {
+		return
+	}
+
+	dash.logger.Info("Loading blocks from influxdb to complete rolling windows", "blocks", len(missing))
+	dash.loadRollingBlocks(missing)
+	dash.writePoints()
+}
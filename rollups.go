@@ -0,0 +1,297 @@
+package dashboard
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+const DAY_FORMAT = "2006-01-02"
+
+// Number of blocks on top of a block before its median time past closes rollup periods.
+// No later block can have a timestamp before a block's median time past, so once it is
+// in a later day every block of the day has arrived, and the confirmations keep a reorg
+// from changing them afterwards.
+const ROLLUP_CONFIRMATIONS = BLOCK_NUM_DIFF
+
+// Percentiles computed over per-block values for fields that are already medians.
+var ROLLUP_PERCENTILE_RANKS = []float64{10, 50, 90}
+
+// Ways of combining a field across the blocks in a bucket.
+const (
+	ROLLUP_SUM = iota
+	ROLLUP_WEIGHTED_AVG
+	ROLLUP_MIN
+	ROLLUP_MAX
+	ROLLUP_PERCENTILES
+	ROLLUP_AVG
+)
+
+// A RollupRule says how the fields matching Prefix are aggregated. For
+// ROLLUP_WEIGHTED_AVG, each block's value is weighted by the field WeightField.
+type RollupRule struct {
+	Prefix      string
+	Kind        int
+	WeightField string
+}
+
+// ROLLUP_RULES are checked in order and the first matching prefix is used.
+// Fields that don't match any rule are averaged.
+var ROLLUP_RULES = []RollupRule{
+	{"percent_txs_native_segwit_over_total_sw_txs", ROLLUP_WEIGHTED_AVG, "num_segwit_txs"},
+	{"percent_P2TR_spends_", ROLLUP_WEIGHTED_AVG, "P2TR_outputs_spent"},
+	{"percent_witness_bytes_", ROLLUP_WEIGHTED_AVG, "total_witness_bytes"},
+	{"percent_weight_", ROLLUP_WEIGHTED_AVG, "total_weight"},
+	{"percent_spent_value_age_", ROLLUP_WEIGHTED_AVG, "spent_value"},
+	{"halving_epoch", ROLLUP_MAX, ""},
+	{"blocks_until_halving", ROLLUP_MIN, ""},
+	{"height", ROLLUP_MAX, ""},
+	{"avg_spent_output_age_days", ROLLUP_WEIGHTED_AVG, "spent_value"},
+	{"percent_txs_", ROLLUP_WEIGHTED_AVG, "num_txs"},
+	{"batch_range_", ROLLUP_WEIGHTED_AVG, "num_txs"},
+	{"percent_of_inputs_", ROLLUP_WEIGHTED_AVG, "num_inputs"},
+	{"percent_inputs_", ROLLUP_WEIGHTED_AVG, "num_inputs"},
+	{"percent_new_outs_", ROLLUP_WEIGHTED_AVG, "num_outputs"},
+	{"avg_", ROLLUP_WEIGHTED_AVG, "num_txs"},
+	{"min_", ROLLUP_MIN, ""},
+	{"max_", ROLLUP_MAX, ""},
+	{"median_", ROLLUP_PERCENTILES, ""},
+	{"num_", ROLLUP_SUM, ""},
+	{"new_", ROLLUP_SUM, ""},
+	{"txs_", ROLLUP_SUM, ""},
+	{"nested_", ROLLUP_SUM, ""},
+	{"native_", ROLLUP_SUM, ""},
+	{"total_", ROLLUP_SUM, ""},
+	{"segwit_total_", ROLLUP_SUM, ""},
+	{"utxo_", ROLLUP_SUM, ""},
+	{"dust_bin_", ROLLUP_SUM, ""},
+	{"output_count_bin_", ROLLUP_SUM, ""},
+	{"block_size", ROLLUP_SUM, ""},
+	{"block_weight", ROLLUP_SUM, ""},
+	{"volume_btc", ROLLUP_SUM, ""},
+	{"subsidy", ROLLUP_SUM, ""},
+	{"P2TR_", ROLLUP_SUM, ""},
+	{"inscription_", ROLLUP_SUM, ""},
+	{"spent_value", ROLLUP_SUM, ""},
+	{"coin_days_destroyed", ROLLUP_SUM, ""},
+}
+
+// rollupRule returns the rule used to aggregate the given field.
+func rollupRule(field string) RollupRule {
+	for _, rule := range ROLLUP_RULES {
+		if strings.HasPrefix(field, rule.Prefix) {
+			return rule
+		}
+	}
+	return RollupRule{field, ROLLUP_AVG, ""}
+}
+
+// startOfDay returns midnight UTC of the day containing t.
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.UTC().Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// startOfISOWeek returns midnight UTC of the Monday starting the ISO week containing t.
+func startOfISOWeek(t time.Time) time.Time {
+	day := startOfDay(t)
+	daysSinceMonday := (int(day.Weekday()) + 6) % 7
+	return day.AddDate(0, 0, -daysSinceMonday)
+}
+
+// percentile returns the p-th percentile of the sorted values using the nearest-rank method.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// aggregateBlocks combines the fields of every block in a bucket according to ROLLUP_RULES.
+func aggregateBlocks(blocks []StoredPoint) map[string]interface{} {
+	fields := make(map[string]interface{})
+
+	values := make(map[string][]float64)
+	for _, block := range blocks {
+		for name, value := range block.Fields {
+			// Old blocks can have fields that are no longer written.
+			if _, ok := lookupMetric("block_metrics", name); !ok {
+				continue
+			}
+			if f, ok := toFloat(value); ok {
+				values[name] = append(values[name], f)
+			}
+		}
+	}
+
+	for name, vals := range values {
+		rule := rollupRule(name)
+
+		switch rule.Kind {
+		case ROLLUP_SUM:
+			sum := 0.0
+			for _, v := range vals {
+				sum += v
+			}
+			fields[name] = sum
+
+		case ROLLUP_WEIGHTED_AVG:
+			weightedSum, totalWeight := 0.0, 0.0
+			for _, block := range blocks {
+				v, ok := toFloat(block.Fields[name])
+				w, wOk := toFloat(block.Fields[rule.WeightField])
+				if !ok || !wOk {
+					continue
+				}
+				weightedSum += v * w
+				totalWeight += w
+			}
+
+			// Avoid divide by 0 errors.
+			if totalWeight != 0 {
+				fields[name] = weightedSum / totalWeight
+			}
+
+		case ROLLUP_MIN:
+			sort.Float64s(vals)
+			fields[name] = vals[0]
+
+		case ROLLUP_MAX:
+			sort.Float64s(vals)
+			fields[name] = vals[len(vals)-1]
+
+		case ROLLUP_PERCENTILES:
+			sort.Float64s(vals)
+			for _, p := range ROLLUP_PERCENTILE_RANKS {
+				fields[fmt.Sprintf("%v_p%v", name, p)] = percentile(vals, p)
+			}
+
+		default:
+			sum := 0.0
+			for _, v := range vals {
+				sum += v
+			}
+			fields[name] = sum / float64(len(vals))
+		}
+	}
+
+	fields["num_blocks"] = int64(len(blocks))
+	return fields
+}
+
+// rollupBucket aggregates all blocks with timestamps in [start, end) into a single point
+// in the given measurement. Rerunning it for the same bucket overwrites the previous
+// result, since the point has the same tags and timestamp, or deletes it if the bucket
+// no longer has any blocks.
+func (dash *Dashboard) rollupBucket(measurement, bucket string, start, end time.Time) {
+	query := fmt.Sprintf("SELECT * FROM block_metrics WHERE %v AND time >= '%v' AND time < '%v' GROUP BY *",
+		dash.networkCondition(), start.Format(time.RFC3339), end.Format(time.RFC3339))
+	blocks, err := dash.queryPoints(query)
+	if err != nil {
+		dash.logger.Fatal("Error querying blocks for rollup", "measurement", measurement, "bucket", bucket, "err", err)
+	}
+
+	if len(blocks) == 0 {
+		dash.logger.Info("No blocks found for rollup", "measurement", measurement, "bucket", bucket)
+		_, err := dash.queryPoints(fmt.Sprintf("DELETE FROM %v WHERE network = '%v' AND bucket = '%v'", measurement, dash.network.Name, bucket))
+		if err != nil {
+			dash.logger.Fatal("Error deleting empty rollup", "measurement", measurement, "bucket", bucket, "err", err)
+		}
+		return
+	}
+
+	tags := map[string]string{"bucket": bucket, "network": dash.network.Name} // for influxdb
+	fields := aggregateBlocks(blocks)                                         // for influxdb
+
+	pt, err := newPoint(
+		measurement,
+		tags,
+		fields,
+		start,
+	)
+	if err != nil {
+		dash.logger.Fatal("Error creating new point", "measurement", measurement, "bucket", bucket, "err", err)
+	}
+
+	dash.bp.AddPoint(pt)
+	dash.logger.Info("Rolled up blocks", "measurement", measurement, "bucket", bucket, "blocks", len(blocks))
+}
+
+// rollupDay writes the block_metrics_daily point for the UTC day containing t.
+func (dash *Dashboard) rollupDay(t time.Time) {
+	start := startOfDay(t)
+	dash.rollupBucket("block_metrics_daily", start.Format(DAY_FORMAT), start, start.AddDate(0, 0, 1))
+}
+
+// rollupWeek writes the block_metrics_weekly point for the ISO week containing t.
+func (dash *Dashboard) rollupWeek(t time.Time) {
+	start := startOfISOWeek(t)
+	year, week := start.ISOWeek()
+	dash.rollupBucket("block_metrics_weekly", fmt.Sprintf("%v-W%02d", year, week), start, start.AddDate(0, 0, 7))
+}
+
+// rollupRange writes daily rollups for every day in [from, to], and weekly rollups
+// for every ISO week that overlaps it. Weeks are always aggregated in full.
+func (dash *Dashboard) rollupRange(from, to time.Time) {
+	for day := startOfDay(from); !day.After(to); day = day.AddDate(0, 0, 1) {
+		dash.rollupDay(day)
+	}
+
+	for week := startOfISOWeek(from); !week.After(to); week = week.AddDate(0, 0, 7) {
+		dash.rollupWeek(week)
+	}
+
+	dash.writePoints()
+}
+
+// rollupClosedPeriods writes the rollups for every day and ISO week that was closed by
+// the median time past of confirmed blocks moving from prevMedianTime to medianTime.
+func (dash *Dashboard) rollupClosedPeriods(prevMedianTime, medianTime time.Time) {
+	if !startOfDay(medianTime).After(startOfDay(prevMedianTime)) {
+		return
+	}
+
+	for day := startOfDay(prevMedianTime); day.Before(startOfDay(medianTime)); day = day.AddDate(0, 0, 1) {
+		dash.rollupDay(day)
+	}
+	for week := startOfISOWeek(prevMedianTime); week.Before(startOfISOWeek(medianTime)); week = week.AddDate(0, 0, 7) {
+		dash.rollupWeek(week)
+	}
+
+	dash.writePoints()
+}
+
+// rollupCommand implements the rollup subcommand, which (re)computes the daily and
+// weekly rollups for a range of UTC days.
+func rollupCommand(args []string) {
+	flags := flag.NewFlagSet("rollup", flag.ExitOnError)
+	fromPtr := flags.String("from", "", "First day to roll up (YYYY-MM-DD).")
+	toPtr := flags.String("to", "", "Last day to roll up (YYYY-MM-DD). Defaults to the first day.")
+	flags.Parse(args)
+
+	from, err := time.Parse(DAY_FORMAT, *fromPtr)
+	if err != nil {
+		Logger{}.Fatal("Bad -from day", "err", err)
+	}
+
+	to := from
+	if *toPtr != "" {
+		to, err = time.Parse(DAY_FORMAT, *toPtr)
+		if err != nil {
+			Logger{}.Fatal("Bad -to day", "err", err)
+		}
+	}
+
+	dash := setupDashboard()
+	defer dash.shutdown()
+
+	dash.rollupRange(from, to)
+}
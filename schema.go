@@ -0,0 +1,146 @@
+package dashboard
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Versions of the influxdb schema.
+const (
+	// Height is a tag, so every block gets its own series.
+	SCHEMA_V1 = 1
+	// Height is a field and block-level points are only tagged with low-cardinality
+	// tags: network, node, pool and epoch (the halving epoch).
+	SCHEMA_V2 = 2
+)
+
+// schemaVersion is the schema used for every point written by this process.
+var schemaVersion int
+var schemaOnce sync.Once
+
+// detectSchema sets the schema version from the SCHEMA_VERSION environment variable or,
+// if it isn't set, from the database: databases whose block_metrics have a height tag
+// keep using schema v1 until they are migrated, and everything else uses schema v2.
+func (dash *Dashboard) detectSchema() {
+	schemaOnce.Do(func() {
+		if version := os.Getenv("SCHEMA_VERSION"); version != "" {
+			v, err := strconv.Atoi(version)
+			if err != nil || (v != SCHEMA_V1 && v != SCHEMA_V2) {
+				dash.logger.Fatal("Bad SCHEMA_VERSION", "value", version)
+			}
+			schemaVersion = v
+			return
+		}
+
+		schemaVersion = SCHEMA_V2
+		if dash.hasHeightTag(dash.DB) {
+			schemaVersion = SCHEMA_V1
+			dash.logger.Warn("Database uses schema v1 (height tags). Run the migrate command to move it to schema v2.", "db", dash.DB)
+		}
+	})
+}
+
+// hasHeightTag returns true if block_metrics in the given database has a height tag.
+func (dash *Dashboard) hasHeightTag(database string) bool {
+	for _, key := range firstColumn(dash.query(database, "SHOW TAG KEYS FROM block_metrics")) {
+		if key == "height" {
+			return true
+		}
+	}
+	return false
+}
+
+// halvingEpoch returns the halving epoch of a height on the given network.
+// Points written before the network tag was added are all from mainnet.
+func halvingEpoch(height int64, network string) int64 {
+	params, ok := NETWORKS[network]
+	if !ok {
+		params = NETWORKS[MAINNET]
+	}
+	return height / params.HalvingInterval
+}
+
+// setBlockKey records which block a point belongs to, as a height tag in schema v1, or as
+// a height field along with an epoch tag in schema v2.
+func setBlockKey(tags map[string]string, fields map[string]interface{}, height int64, network string) {
+	if schemaVersion == SCHEMA_V1 {
+		tags["height"] = strconv.Itoa(int(height))
+		return
+	}
+
+	setBlockKeyV2(tags, fields, height, network)
+}
+
+func setBlockKeyV2(tags map[string]string, fields map[string]interface{}, height int64, network string) {
+	tags["epoch"] = strconv.Itoa(int(halvingEpoch(height, network)))
+	fields["height"] = height
+}
+
+// blockPointTime returns the timestamp used for a point belonging to the block at the given
+// height. Block timestamps aren't unique, so in schema v2, where blocks share series, the
+// height is added as nanoseconds to keep blocks with the same timestamp from overwriting
+// each other.
+func blockPointTime(blockTime time.Time, height int64) time.Time {
+	if schemaVersion == SCHEMA_V1 {
+		return blockTime
+	}
+	return blockPointTimeV2(blockTime, height)
+}
+
+func blockPointTimeV2(blockTime time.Time, height int64) time.Time {
+	return time.Unix(blockTime.Unix(), height)
+}
+
+// heightCondition returns an InfluxQL condition that selects the points of the block at the given height.
+func heightCondition(height int64) string {
+	if schemaVersion == SCHEMA_V1 {
+		return fmt.Sprintf("height = '%v'", height)
+	}
+	return fmt.Sprintf("height = %v", height)
+}
+
+// blockPointsCondition returns an InfluxQL condition that selects the points written for
+// the block at the given height with the given time. It only uses tags and time, so it can
+// be used to delete them: in schema v2 the point time alone identifies the block.
+func blockPointsCondition(height int64, blockTime time.Time) string {
+	pointTime := blockPointTime(blockTime, height).UTC().Format(time.RFC3339Nano)
+	condition := fmt.Sprintf("time >= '%v' AND time <= '%v'", pointTime, pointTime)
+	if schemaVersion == SCHEMA_V1 {
+		condition = heightCondition(height) + " AND " + condition
+	}
+	return condition
+}
+
+// heightRangeCondition returns an InfluxQL condition that selects the points of the blocks
+// with heights in [from, to]. Height tags are strings, so in schema v1 every height is listed.
+func heightRangeCondition(from, to int64) string {
+	if schemaVersion == SCHEMA_V1 {
+		conditions := make([]string, 0, to-from+1)
+		for h := from; h <= to; h++ {
+			conditions = append(conditions, heightCondition(h))
+		}
+		return "(" + strings.Join(conditions, " OR ") + ")"
+	}
+	return fmt.Sprintf("height >= %v AND height <= %v", from, to)
+}
+
+// height returns the height of the block a stored point belongs to, from either schema.
+func (point StoredPoint) height() (int64, error) {
+	if tag := point.Tags["height"]; tag != "" {
+		return strconv.ParseInt(tag, 10, 64)
+	}
+
+	value, ok := point.Fields["height"]
+	if !ok {
+		return 0, fmt.Errorf("point at %v has no height", point.Time)
+	}
+	height, ok := toFloat(value)
+	if !ok {
+		return 0, fmt.Errorf("point at %v has a non-numeric height %v", point.Time, value)
+	}
+	return int64(height), nil
+}
@@ -0,0 +1,197 @@
+package dashboard
+
+import (
+	"github.com/btcsuite/btcd/txscript"
+	"time"
+)
+
+// Script types used for the script_type tag.
+const (
+	SCRIPT_P2PK            = "P2PK"
+	SCRIPT_P2PKH           = "P2PKH"
+	SCRIPT_P2SH            = "P2SH"
+	SCRIPT_P2WPKH          = "P2WPKH"
+	SCRIPT_P2WSH           = "P2WSH"
+	SCRIPT_P2TR            = "P2TR"
+	SCRIPT_WITNESS_UNKNOWN = "witness_unknown"
+	SCRIPT_MULTISIG        = "multisig"
+	SCRIPT_OP_RETURN       = "op_return"
+	SCRIPT_NONSTANDARD     = "nonstandard"
+)
+
+// SCRIPT_TYPES lists every script type, so that each block has a point for all of them.
+var SCRIPT_TYPES = []string{
+	SCRIPT_P2PK,
+	SCRIPT_P2PKH,
+	SCRIPT_P2SH,
+	SCRIPT_P2WPKH,
+	SCRIPT_P2WSH,
+	SCRIPT_P2TR,
+	SCRIPT_WITNESS_UNKNOWN,
+	SCRIPT_MULTISIG,
+	SCRIPT_OP_RETURN,
+	SCRIPT_NONSTANDARD,
+}
+
+// isWitnessProgram returns true for scripts of the form <version> <2 to 40 byte program>.
+func isWitnessProgram(pkScript []byte) bool {
+	if len(pkScript) < 4 || len(pkScript) > 42 {
+		return false
+	}
+	version := pkScript[0]
+	if version != txscript.OP_0 && (version < txscript.OP_1 || version > txscript.OP_16) {
+		return false
+	}
+	return int(pkScript[1]) == len(pkScript)-2
+}
+
+// classifyScript returns the script type of an output script.
+func classifyScript(pkScript []byte) string {
+	switch {
+	case len(pkScript) == 25 && pkScript[0] == txscript.OP_DUP && pkScript[1] == txscript.OP_HASH160 &&
+		pkScript[2] == txscript.OP_DATA_20 && pkScript[23] == txscript.OP_EQUALVERIFY && pkScript[24] == txscript.OP_CHECKSIG:
+		return SCRIPT_P2PKH
+
+	case len(pkScript) == 23 && pkScript[0] == txscript.OP_HASH160 && pkScript[1] == txscript.OP_DATA_20 &&
+		pkScript[22] == txscript.OP_EQUAL:
+		return SCRIPT_P2SH
+
+	case len(pkScript) == 22 && pkScript[0] == txscript.OP_0 && pkScript[1] == txscript.OP_DATA_20:
+		return SCRIPT_P2WPKH
+
+	case len(pkScript) == 34 && pkScript[0] == txscript.OP_0 && pkScript[1] == txscript.OP_DATA_32:
+		return SCRIPT_P2WSH
+
+	case isP2TR(pkScript):
+		return SCRIPT_P2TR
+
+	case isWitnessProgram(pkScript):
+		return SCRIPT_WITNESS_UNKNOWN
+
+	case len(pkScript) > 0 && pkScript[0] == txscript.OP_RETURN:
+		return SCRIPT_OP_RETURN
+
+	case len(pkScript) == 35 && pkScript[0] == txscript.OP_DATA_33 && pkScript[34] == txscript.OP_CHECKSIG,
+		len(pkScript) == 67 && pkScript[0] == txscript.OP_DATA_65 && pkScript[66] == txscript.OP_CHECKSIG:
+		return SCRIPT_P2PK
+
+	case txscript.GetScriptClass(pkScript) == txscript.MultiSigTy:
+		return SCRIPT_MULTISIG
+	}
+
+	return SCRIPT_NONSTANDARD
+}
+
+// ScriptTypeCounts holds the number and value of outputs of a single script type
+// that were created and spent in a block.
+type ScriptTypeCounts struct {
+	NewOutputs     int64
+	NewOutputValue int64
+	TxsCreating    int64
+	OutputsSpent   int64
+	SpentValue     int64
+	TxsSpending    int64
+	WitnessBytes   int64 // witness data of the inputs spending outputs of this type
+}
+
+// ScriptTypeStats breaks down the outputs created and spent in a block by script type.
+type ScriptTypeStats struct {
+	Ins    int64
+	Outs   int64
+	Counts map[string]*ScriptTypeCounts
+}
+
+// computeScriptTypeStats counts the outputs created and spent in a block by script type.
+func computeScriptTypeStats(data *BlockData) ScriptTypeStats {
+	stats := ScriptTypeStats{Counts: make(map[string]*ScriptTypeCounts)}
+	for _, scriptType := range SCRIPT_TYPES {
+		stats.Counts[scriptType] = &ScriptTypeCounts{}
+	}
+
+	for i, tx := range data.Transactions {
+		stats.Outs += int64(len(tx.TxOut))
+
+		created := make(map[string]bool)
+		for _, out := range tx.TxOut {
+			scriptType := classifyScript(out.PkScript)
+			stats.Counts[scriptType].NewOutputs++
+			stats.Counts[scriptType].NewOutputValue += out.Value
+			created[scriptType] = true
+		}
+		for scriptType := range created {
+			stats.Counts[scriptType].TxsCreating++
+		}
+
+		// The coinbase input doesn't spend anything.
+		if i == 0 {
+			continue
+		}
+
+		stats.Ins += int64(len(tx.TxIn))
+
+		spent := make(map[string]bool)
+		for j, prevout := range data.Prevouts[i] {
+			scriptType := classifyScript(prevout.PkScript)
+			stats.Counts[scriptType].OutputsSpent++
+			stats.Counts[scriptType].SpentValue += prevout.Value
+			stats.Counts[scriptType].WitnessBytes += witnessSize(tx.TxIn[j].Witness)
+			spent[scriptType] = true
+		}
+		for scriptType := range spent {
+			stats.Counts[scriptType].TxsSpending++
+		}
+	}
+
+	return stats
+}
+
+func (counts ScriptTypeCounts) setInfluxFields(fields map[string]interface{}, ins, outs int64) {
+	fields["new_outputs"] = counts.NewOutputs
+	fields["new_output_value"] = counts.NewOutputValue
+	fields["num_txs_creating"] = counts.TxsCreating
+	fields["outputs_spent"] = counts.OutputsSpent
+	fields["spent_value"] = counts.SpentValue
+	fields["num_txs_spending"] = counts.TxsSpending
+	fields["witness_bytes"] = counts.WitnessBytes
+
+	// Avoid divide by 0 errors.
+	if outs != 0 {
+		fields["percent_new_outs"] = float64(counts.NewOutputs) / float64(outs)
+	}
+
+	// Avoid divide by 0 errors.
+	if ins != 0 {
+		fields["percent_of_inputs_spending"] = float64(counts.OutputsSpent) / float64(ins)
+	}
+}
+
+// analyzeScriptTypes adds a point to the script_types measurement for each script type,
+// tagged with script_type in addition to the block's tags.
+func (dash *Dashboard) analyzeScriptTypes(data *BlockData, blockTags map[string]string, blockTime time.Time) {
+	stats := computeScriptTypeStats(data)
+
+	for _, scriptType := range SCRIPT_TYPES {
+		tags := make(map[string]string)        // for influxdb
+		fields := make(map[string]interface{}) // for influxdb
+
+		for k, v := range blockTags {
+			tags[k] = v
+		}
+		tags["script_type"] = scriptType
+		setBlockKey(tags, fields, data.Height, tags["network"])
+
+		stats.Counts[scriptType].setInfluxFields(fields, stats.Ins, stats.Outs)
+
+		pt, err := newPoint(
+			"script_types",
+			tags,
+			fields,
+			blockTime,
+		)
+		if err != nil {
+			dash.logger.Fatal("Error creating new point", "measurement", "script_types", "height", data.Height, "err", err)
+		}
+
+		dash.bp.AddPoint(pt)
+	}
+}
@@ -0,0 +1,360 @@
+package dashboard
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Workers that haven't recorded progress for this long are reported as stalled. They may
+// be paused, stuck, or dead, so their heights aren't counted as failed.
+const STATUS_STALE_AFTER = 10 * DB_WAIT_TIME * time.Second
+
+// States of workers.
+const (
+	WORKER_RUNNING = "running"
+	WORKER_STALLED = "stalled"
+	WORKER_FAILED  = "failed"
+)
+
+// EXPECTED_BLOCK_SIZES approximates the average size of mainnet blocks (in kB) at heights
+// where the trend changed, for weighting the time left by the work left rather than the
+// number of blocks. Sizes in between are interpolated, and other networks are unweighted.
+var EXPECTED_BLOCK_SIZES = []struct {
+	Height int64
+	Size   float64
+}{
+	{0, 0.3},
+	{100000, 10},
+	{150000, 30},
+	{200000, 150},
+	{250000, 200},
+	{300000, 400},
+	{350000, 500},
+	{400000, 750},
+	{450000, 950},
+	{500000, 1000},
+	{550000, 900},
+	{600000, 1200},
+	{650000, 1300},
+	{750000, 1400},
+	{800000, 1600},
+	{850000, 1700},
+}
+
+// A HeightRange is the heights in [Start, End).
+type HeightRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// A WorkerStatus is the progress of a worker, read from its worker-progress file.
+type WorkerStatus struct {
+	File            string    `json:"file"`
+	State           string    `json:"state"`
+	Start           int64     `json:"start,omitempty"`
+	Last            int64     `json:"last,omitempty"`
+	End             int64     `json:"end,omitempty"`
+	Height          int64     `json:"height,omitempty"` // block being analyzed by live analysis
+	Done            int64     `json:"done"`
+	Total           int64     `json:"total"`
+	Percent         float64   `json:"percent"`
+	BlocksPerSecond float64   `json:"blocks_per_second"`
+	ETASeconds      float64   `json:"eta_seconds,omitempty"`
+	Checkpoint      time.Time `json:"checkpoint"`
+}
+
+// A LiveStatus is how far the blocks in influxdb are behind the primary node's tip.
+type LiveStatus struct {
+	Height   int64 `json:"height"`
+	Tip      int64 `json:"tip"`
+	Distance int64 `json:"distance"`
+}
+
+// A Status is the progress of every worker along with the overall progress.
+type Status struct {
+	Network         string         `json:"network"`
+	Workers         []WorkerStatus `json:"workers"`
+	Done            int64          `json:"done"`
+	Total           int64          `json:"total"`
+	Percent         float64        `json:"percent"`
+	BlocksPerSecond float64        `json:"blocks_per_second"`
+	ETASeconds      float64        `json:"eta_seconds,omitempty"`
+	FailedHeights   []HeightRange  `json:"failed_heights"`
+	Live            *LiveStatus    `json:"live,omitempty"`
+}
+
+// expectedBlockSize returns the expected size of a block at a height, in kB.
+func expectedBlockSize(network string, height int64) float64 {
+	if network != MAINNET {
+		return 1
+	}
+
+	for i := 1; i < len(EXPECTED_BLOCK_SIZES); i++ {
+		prev, next := EXPECTED_BLOCK_SIZES[i-1], EXPECTED_BLOCK_SIZES[i]
+		if height < next.Height {
+			fraction := float64(height-prev.Height) / float64(next.Height-prev.Height)
+			return prev.Size + fraction*(next.Size-prev.Size)
+		}
+	}
+	return EXPECTED_BLOCK_SIZES[len(EXPECTED_BLOCK_SIZES)-1].Size
+}
+
+// expectedWork returns the expected size of the blocks in [start, end), in kB.
+func expectedWork(network string, start, end int64) float64 {
+	work := 0.0
+	for height := start; height < end; height++ {
+		work += expectedBlockSize(network, height)
+	}
+	return work
+}
+
+// runningJobs returns the IDs of the jobs in a jobs directory that are running in a
+// process that's still alive.
+func runningJobs(dir string) (map[int]bool, error) {
+	running := make(map[int]bool)
+
+	records, err := readJobs(dir)
+	if os.IsNotExist(err) {
+		return running, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		if record.State == JOB_RUNNING && processAlive(record.Host, record.PID) {
+			running[record.ID] = true
+		}
+	}
+	return running, nil
+}
+
+// progressFileJob returns the ID of the job a progress file belongs to, if it belongs to one.
+func progressFileJob(name string) (int, bool) {
+	var id int
+	_, err := fmt.Sscanf(name, "job-%d.", &id)
+	return id, err == nil
+}
+
+// workerStatus reads the progress of a worker from its worker-progress file. A worker has
+// failed if it marked its progress as failed, or if it belongs to a job that isn't running.
+func workerStatus(network, dir string, file os.FileInfo, now time.Time, running map[int]bool) (WorkerStatus, error) {
+	contentsBytes, err := ioutil.ReadFile(dir + "/" + file.Name())
+	if err != nil {
+		return WorkerStatus{}, err
+	}
+	progress := parseProgress(string(contentsBytes))
+
+	status := WorkerStatus{File: file.Name(), State: WORKER_RUNNING, Checkpoint: file.ModTime()}
+	if now.Sub(file.ModTime()) > STATUS_STALE_AFTER {
+		status.State = WORKER_STALLED
+	}
+	if id, ok := progressFileJob(file.Name()); ok && !running[id] {
+		status.State = WORKER_FAILED
+	}
+	if _, ok := progress["Failed"]; ok {
+		status.State = WORKER_FAILED
+	}
+
+	// Live analysis only has a file while it's analyzing a block.
+	if height, ok := progress["Height"]; ok {
+		status.Height = int64(height)
+		return status, nil
+	}
+	if _, ok := progress["End"]; !ok {
+		return WorkerStatus{}, fmt.Errorf("bad progress in %v", file.Name())
+	}
+
+	status.Start, status.Last, status.End = int64(progress["Start"]), int64(progress["Last"]), int64(progress["End"])
+	status.Done = status.Last - status.Start
+	status.Total = status.End - status.Start
+	// Avoid divide by 0 errors.
+	if status.Total > 0 {
+		status.Percent = 100 * float64(status.Done) / float64(status.Total)
+	}
+
+	// Files written before the start time was recorded don't have a rate.
+	started, ok := progress["Started"]
+	elapsed := file.ModTime().Sub(time.Unix(int64(started), 0)).Seconds()
+	if !ok || elapsed <= 0 || status.Done == 0 {
+		return status, nil
+	}
+	status.BlocksPerSecond = float64(status.Done) / elapsed
+
+	// The time left is the work left at the rate work has been done so far.
+	if status.State == WORKER_RUNNING {
+		workRate := expectedWork(network, status.Start, status.Last) / elapsed
+		status.ETASeconds = expectedWork(network, status.Last, status.End) / workRate
+	}
+	return status, nil
+}
+
+// readStatus reads the progress of every worker in a worker-progress directory, given
+// the IDs of the jobs that are running.
+func readStatus(network, dir string, now time.Time, running map[int]bool) (Status, error) {
+	status := Status{Network: network, Workers: make([]WorkerStatus, 0), FailedHeights: make([]HeightRange, 0)}
+
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return status, nil
+	}
+	if err != nil {
+		return status, err
+	}
+
+	// The progress belongs to the network the directory is marked with.
+	contentsBytes, err := ioutil.ReadFile(dir + "/" + NETWORK_FILE)
+	if err == nil {
+		status.Network = strings.TrimSpace(string(contentsBytes))
+	}
+
+	for _, file := range files {
+		if file.Name() == NETWORK_FILE {
+			continue
+		}
+
+		worker, err := workerStatus(status.Network, dir, file, now, running)
+		if err != nil {
+			return status, err
+		}
+		status.Workers = append(status.Workers, worker)
+	}
+
+	for _, worker := range status.Workers {
+		status.Done += worker.Done
+		status.Total += worker.Total
+
+		if worker.State == WORKER_RUNNING {
+			status.BlocksPerSecond += worker.BlocksPerSecond
+			// Workers run in parallel, so everything is done when the slowest one is.
+			if worker.ETASeconds > status.ETASeconds {
+				status.ETASeconds = worker.ETASeconds
+			}
+			continue
+		}
+
+		if worker.State != WORKER_FAILED {
+			continue
+		}
+
+		// The blocks a failed worker didn't record are left for its job or the recovery process.
+		if worker.End > 0 {
+			status.FailedHeights = append(status.FailedHeights, HeightRange{worker.Last, worker.End})
+		} else {
+			status.FailedHeights = append(status.FailedHeights, HeightRange{worker.Height, worker.Height + 1})
+		}
+	}
+	// Avoid divide by 0 errors.
+	if status.Total > 0 {
+		status.Percent = 100 * float64(status.Done) / float64(status.Total)
+	}
+
+	sort.Slice(status.FailedHeights, func(i, j int) bool {
+		return status.FailedHeights[i].Start < status.FailedHeights[j].Start
+	})
+	return status, nil
+}
+
+// liveStatus compares the latest block in influxdb with the primary node's tip.
+func (dash *Dashboard) liveStatus() (*LiveStatus, error) {
+	tip, err := dash.blockCount()
+	if err != nil {
+		return nil, err
+	}
+
+	latest, found, err := dash.latestBlock()
+	if err != nil || !found {
+		return nil, err
+	}
+	return &LiveStatus{latest.Height, tip, tip - latest.Height}, nil
+}
+
+func formatETA(seconds float64) string {
+	if seconds == 0 {
+		return "-"
+	}
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+func printStatus(status Status) {
+	fmt.Printf("Network: %v\n\n", status.Network)
+
+	if len(status.Workers) == 0 {
+		fmt.Println("No workers have unfinished progress.")
+	} else {
+		fmt.Printf("%-32v %-8v %-24v %8v %10v %12v\n", "WORKER", "STATE", "RANGE", "DONE", "BLOCKS/S", "ETA")
+		for _, worker := range status.Workers {
+			if worker.End == 0 {
+				fmt.Printf("%-32v %-8v %-24v %8v %10v %12v\n", worker.File, worker.State, fmt.Sprintf("block %v", worker.Height), "-", "-", "-")
+				continue
+			}
+
+			heights := fmt.Sprintf("%v/[%v, %v)", worker.Last, worker.Start, worker.End)
+			fmt.Printf("%-32v %-8v %-24v %7.1f%% %10.2f %12v\n", worker.File, worker.State, heights, worker.Percent, worker.BlocksPerSecond, formatETA(worker.ETASeconds))
+		}
+		fmt.Printf("\nOverall: %v of %v blocks (%.1f%%), %.2f blocks/s, ETA %v\n", status.Done, status.Total, status.Percent, status.BlocksPerSecond, formatETA(status.ETASeconds))
+	}
+
+	if len(status.FailedHeights) > 0 {
+		ranges := make([]string, 0, len(status.FailedHeights))
+		for _, heights := range status.FailedHeights {
+			ranges = append(ranges, fmt.Sprintf("[%v, %v)", heights.Start, heights.End))
+		}
+		fmt.Printf("Failed heights: %v (retry their job, or run with -recovery for workers outside jobs, to finish them)\n", strings.Join(ranges, " "))
+	}
+
+	if status.Live != nil {
+		fmt.Printf("Live: latest block %v, tip %v, %v blocks behind\n", status.Live.Height, status.Live.Tip, status.Live.Distance)
+	}
+}
+
+// statusCommand implements the status subcommand, which prints the progress of the workers
+// in ./worker-progress and how far behind the tip the blocks in influxdb are.
+func statusCommand(args []string) {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	formatPtr := flags.String("format", "text", "Output format: text or json.")
+	offlinePtr := flags.Bool("offline", false, "Only read worker-progress, without connecting to bitcoind and influxdb.")
+	flags.Parse(args)
+
+	checkFormat(*formatPtr)
+
+	currentDir, err := os.Getwd()
+	if err != nil {
+		Logger{}.Fatal("Error getting working directory", "err", err)
+	}
+
+	network := ""
+	var live *LiveStatus
+	if !*offlinePtr {
+		dash := setupDashboard()
+		defer dash.shutdown()
+
+		network = dash.network.Name
+		live, err = dash.liveStatus()
+		if err != nil {
+			Logger{}.Fatal("Error getting the latest block", "err", err)
+		}
+	}
+
+	running, err := runningJobs(currentDir + "/jobs")
+	if err != nil {
+		Logger{}.Fatal("Error reading jobs", "err", err)
+	}
+
+	status, err := readStatus(network, currentDir+"/worker-progress", time.Now(), running)
+	if err != nil {
+		Logger{}.Fatal("Error reading worker progress", "err", err)
+	}
+	status.Live = live
+
+	if *formatPtr == "json" {
+		printJSON(status)
+		return
+	}
+	printStatus(status)
+}
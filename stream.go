@@ -0,0 +1,363 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const STREAM_BACKLOG = 1000
+const STREAM_SUBSCRIBER_BUFFER = 100
+const STREAM_KEEPALIVE = 15 * time.Second
+
+// Types of stream events.
+const (
+	EVENT_BLOCK   = "block"
+	EVENT_RETRACT = "retract"
+)
+
+// A StreamEvent is sent to stream subscribers when a block is written or retracted. Its ID is
+// the height of the last block the subscriber has after the event, so that a reconnecting
+// client can resume with the Last-Event-ID header.
+type StreamEvent struct {
+	ID     int64
+	Type   string
+	Height int64
+	Data   []byte
+}
+
+// A Retraction tells subscribers that a block they were sent is no longer in the best chain.
+type Retraction struct {
+	Height int64  `json:"height"`
+	Hash   string `json:"hash"`
+}
+
+// blockStream keeps the most recent events so that reconnecting clients can catch up,
+// and forwards new events to every subscriber.
+type blockStream struct {
+	sync.Mutex
+	backlog     []StreamEvent
+	hashes      map[int64]string // hashes of the published blocks that are still in the best chain
+	subscribers map[chan StreamEvent]bool
+}
+
+// Every block analyzed live by this process is published to a single stream.
+var stream = blockStream{
+	hashes:      make(map[int64]string),
+	subscribers: make(map[chan StreamEvent]bool),
+}
+
+// streamAddr returns the address to serve the stream on, which can be set with the
+// STREAM_ADDR environment variable. The stream isn't served if it's empty.
+func streamAddr() string {
+	return os.Getenv("STREAM_ADDR")
+}
+
+// publish adds an event to the backlog and sends it to every subscriber. Subscribers that
+// have fallen too far behind are disconnected, and can resume from where they were.
+// Must be called with the stream locked.
+func (s *blockStream) publish(event StreamEvent) {
+	s.backlog = append(s.backlog, event)
+	if len(s.backlog) > STREAM_BACKLOG {
+		s.backlog = s.backlog[len(s.backlog)-STREAM_BACKLOG:]
+	}
+
+	for subscriber := range s.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			delete(s.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// publishBlock sends a block to subscribers once it's been written to influxdb.
+func (s *blockStream) publishBlock(block BlockResponse) {
+	data, err := json.Marshal(block)
+	if err != nil {
+		Logger{}.Fatal("Error encoding block for the stream", "height", block.Height, "err", err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.hashes[block.Height] = fmt.Sprint(block.Fields["hash"])
+	delete(s.hashes, block.Height-STREAM_BACKLOG)
+
+	s.publish(StreamEvent{block.Height, EVENT_BLOCK, block.Height, data})
+}
+
+// retract tells subscribers that the block at a height was reorganized away.
+func (s *blockStream) retract(height int64, hash string) {
+	data, err := json.Marshal(Retraction{height, hash})
+	if err != nil {
+		Logger{}.Fatal("Error encoding retraction for the stream", "height", height, "err", err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.hashes, height)
+	s.publish(StreamEvent{height - 1, EVENT_RETRACT, height, data})
+}
+
+// publishedHash returns the hash of the block published at a height, if it's still in the best chain.
+func (s *blockStream) publishedHash(height int64) (string, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	hash, ok := s.hashes[height]
+	return hash, ok
+}
+
+// subscribe returns a channel of new events along with the events already in the backlog.
+func (s *blockStream) subscribe() (chan StreamEvent, []StreamEvent) {
+	s.Lock()
+	defer s.Unlock()
+
+	subscriber := make(chan StreamEvent, STREAM_SUBSCRIBER_BUFFER)
+	s.subscribers[subscriber] = true
+
+	backlog := make([]StreamEvent, len(s.backlog))
+	copy(backlog, s.backlog)
+	return subscriber, backlog
+}
+
+func (s *blockStream) unsubscribe(subscriber chan StreamEvent) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.subscribers[subscriber] {
+		delete(s.subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+// queueDepth returns the number of events waiting to be sent to the slowest subscriber.
+func (s *blockStream) queueDepth() int {
+	s.Lock()
+	defer s.Unlock()
+
+	depth := 0
+	for subscriber := range s.subscribers {
+		if len(subscriber) > depth {
+			depth = len(subscriber)
+		}
+	}
+	return depth
+}
+
+// retractReorganizedBlocks compares the chain leading to a header with the blocks already
+// published, and retracts every published block that is no longer in the best chain,
+// highest first. It returns the number of blocks retracted, which need to be analyzed again.
+func (dash *Dashboard) retractReorganizedBlocks(header *BlockHeader) int64 {
+	retracted := int64(0)
+	height, prevHash := header.Height-1, header.PreviousHash
+
+	for {
+		hash, ok := stream.publishedHash(height)
+		if !ok || hash == prevHash {
+			return retracted
+		}
+
+		dash.logger.Warn("Block was reorganized away", "height", height, "hash", hash)
+		dash.removeBlock(height, hash)
+		stream.retract(height, hash)
+		retracted++
+
+		prevHeader, err := dash.getBlockHeader(prevHash)
+		if err != nil {
+			dash.logger.Fatal("Error getting block header", "height", height-1, "hash", prevHash, "err", err)
+		}
+		height, prevHash = height-1, prevHeader.PreviousHash
+	}
+}
+
+// removeBlock undoes the analysis of a block that was reorganized away. Its points are
+// deleted from influxdb, since the block replacing it has a different time and wouldn't
+// overwrite them, and it's taken out of the rolling store and the script index.
+func (dash *Dashboard) removeBlock(height int64, hash string) {
+	blockHash, err := chainhash.NewHashFromStr(hash)
+	if err != nil {
+		dash.logger.Fatal("Bad block hash", "height", height, "hash", hash, "err", err)
+	}
+
+	start := throttleRPC()
+	block, err := dash.client.GetBlock(blockHash)
+	internal.observeRPC("getblock", start, err)
+	if err != nil {
+		dash.logger.Fatal("Error getting block", "height", height, "hash", hash, "err", err)
+	}
+
+	condition := blockPointsCondition(height, block.Header.Timestamp)
+	for _, measurement := range append([]string{"block_metrics_rolling"}, BLOCK_MEASUREMENTS...) {
+		_, err := dash.queryPoints(fmt.Sprintf("DELETE FROM %v WHERE %v AND %v", measurement, dash.networkCondition(), condition))
+		if err != nil {
+			dash.logger.Fatal("Error deleting reorganized block", "measurement", measurement, "height", height, "err", err)
+		}
+	}
+
+	// The summary of a retarget epoch is written with its last block.
+	if interval := dash.network.RetargetInterval; interval > 0 && (height+1)%interval == 0 {
+		_, err := dash.queryPoints(fmt.Sprintf("DELETE FROM difficulty_epochs WHERE %v AND epoch = '%v'", dash.networkCondition(), height/interval))
+		if err != nil {
+			dash.logger.Fatal("Error deleting reorganized block", "measurement", "difficulty_epochs", "height", height, "err", err)
+		}
+	}
+
+	// Windows recomputed while reloading are written before the next retracted block
+	// is removed, so any that end at it are deleted along with it.
+	if reload := rolling.removeBlock(height); len(reload) > 0 {
+		dash.loadRollingBlocks(reload)
+		dash.writePoints()
+	}
+	openScriptIndex(dash.network.Name).rewindBlock(height, block.Transactions)
+}
+
+func writeEvent(w io.Writer, event StreamEvent) error {
+	_, err := fmt.Fprintf(w, "id: %v\nevent: %v\ndata: %s\n\n", event.ID, event.Type, event.Data)
+	return err
+}
+
+// resumeEvents returns the events a client needs to catch up. A client resuming with
+// Last-Event-ID gets every event after the earliest backlog event with that ID, which
+// includes any retraction of blocks it already has. Otherwise, and if the ID is no longer
+// in the backlog, blocks after the given height are read from influxdb up to the start
+// of the backlog. Clients may get a block more than once, but don't miss any.
+func (dash *Dashboard) resumeEvents(r *http.Request, backlog []StreamEvent) ([]StreamEvent, error) {
+	var after int64
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		lastID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad Last-Event-ID %q", id)
+		}
+
+		for i, event := range backlog {
+			if event.ID == lastID {
+				return backlog[i+1:], nil
+			}
+		}
+		after = lastID
+	} else if from := r.URL.Query().Get("from"); from != "" {
+		height, err := parseHeight(from)
+		if err != nil {
+			return nil, fmt.Errorf("from: %v", err)
+		}
+		after = height - 1
+	} else {
+		return nil, nil
+	}
+
+	end := int64(-1)
+	if len(backlog) > 0 {
+		end = backlog[0].Height - 1
+	} else {
+		latest, found, err := dash.latestBlock()
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			end = latest.Height
+		}
+	}
+
+	events := make([]StreamEvent, 0)
+	for from := after + 1; from <= end; from += API_PAGE_SIZE_MAX {
+		to := from + API_PAGE_SIZE_MAX - 1
+		if to > end {
+			to = end
+		}
+
+		blocks, err := dash.blockRange(from, to)
+		if err != nil {
+			return nil, err
+		}
+		for _, block := range blocks {
+			data, err := json.Marshal(block)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, StreamEvent{block.Height, EVENT_BLOCK, block.Height, data})
+		}
+	}
+
+	for _, event := range backlog {
+		if event.Height > after {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// handleStream serves GET /v1/stream as server-sent events: a block event for each block
+// written and a retract event for each block reorganized away.
+func (dash *Dashboard) handleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, http.StatusInternalServerError, "streaming isn't supported")
+		return
+	}
+
+	// Subscribe before catching up, so that no events are missed in between.
+	events, backlog := stream.subscribe()
+	defer stream.unsubscribe(events)
+
+	replay, err := dash.resumeEvents(r, backlog)
+	if err != nil {
+		dash.logger.Error("Error resuming stream", "err", err)
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	for _, event := range replay {
+		if writeEvent(w, event) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(STREAM_KEEPALIVE)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			// The subscriber fell behind and was dropped. The client resumes on reconnect.
+			if !ok {
+				return
+			}
+			if writeEvent(w, event) != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// serveStream serves the stream of blocks analyzed live by this process.
+func serveStream(addr string) {
+	dash := setupDashboard()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/stream", onlyGET(dash.handleStream))
+
+	dash.logger.Info("Streaming blocks", "addr", addr)
+	dash.logger.Fatal("Error serving the block stream", "addr", addr, "err", http.ListenAndServe(addr, mux))
+}
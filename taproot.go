@@ -0,0 +1,94 @@
+package dashboard
+
+import (
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// First byte of a taproot annex, which is ignored when telling key-path and script-path spends apart.
+const TAPROOT_ANNEX_TAG = 0x50
+
+// TaprootStats counts taproot (P2TR) outputs created and spent in a block.
+// getblockstats doesn't know about taproot, so these are computed from the raw block.
+type TaprootStats struct {
+	NewP2TROutputs       int64
+	TxsCreatingP2TR      int64
+	P2TROutputsSpent     int64
+	P2TRKeyPathSpends    int64
+	P2TRScriptPathSpends int64
+	TxsSpendingP2TR      int64
+}
+
+// isP2TR returns true for scripts of the form OP_1 <32-byte witness program>.
+func isP2TR(pkScript []byte) bool {
+	return len(pkScript) == 34 && pkScript[0] == txscript.OP_1 && pkScript[1] == txscript.OP_DATA_32
+}
+
+// withoutAnnex returns the witness stack with the annex removed, if it has one.
+func withoutAnnex(witness wire.TxWitness) wire.TxWitness {
+	if len(witness) >= 2 {
+		last := witness[len(witness)-1]
+		if len(last) > 0 && last[0] == TAPROOT_ANNEX_TAG {
+			return witness[:len(witness)-1]
+		}
+	}
+	return witness
+}
+
+// isTaprootKeyPathSpend returns true if a P2TR input is spent with a single signature.
+// Script-path spends have at least a script and a control block on the witness stack.
+func isTaprootKeyPathSpend(witness wire.TxWitness) bool {
+	return len(withoutAnnex(witness)) == 1
+}
+
+// computeTaprootStats counts the taproot outputs created and spent in a block.
+func computeTaprootStats(data *BlockData) TaprootStats {
+	stats := TaprootStats{}
+
+	for i, tx := range data.Transactions {
+		creating := false
+		for _, out := range tx.TxOut {
+			if isP2TR(out.PkScript) {
+				stats.NewP2TROutputs++
+				creating = true
+			}
+		}
+		if creating {
+			stats.TxsCreatingP2TR++
+		}
+
+		// The coinbase input doesn't spend anything.
+		if i == 0 {
+			continue
+		}
+
+		spending := false
+		for j, in := range tx.TxIn {
+			if !isP2TR(data.Prevouts[i][j].PkScript) {
+				continue
+			}
+
+			stats.P2TROutputsSpent++
+			spending = true
+			if isTaprootKeyPathSpend(in.Witness) {
+				stats.P2TRKeyPathSpends++
+			} else {
+				stats.P2TRScriptPathSpends++
+			}
+		}
+		if spending {
+			stats.TxsSpendingP2TR++
+		}
+	}
+
+	return stats
+}
+
+func (metrics TaprootStats) setInfluxFields(fields map[string]interface{}) {
+	fields["new_P2TR_outputs"] = metrics.NewP2TROutputs
+	fields["num_txs_creating_P2TR"] = metrics.TxsCreatingP2TR
+	fields["P2TR_outputs_spent"] = metrics.P2TROutputsSpent
+	fields["P2TR_key_path_spends"] = metrics.P2TRKeyPathSpends
+	fields["P2TR_script_path_spends"] = metrics.P2TRScriptPathSpends
+	fields["txs_spending_p2tr_outputs"] = metrics.TxsSpendingP2TR
+}
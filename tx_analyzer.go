@@ -6,11 +6,9 @@ import (
 	"github.com/btcsuite/btcd/rpcclient"
 	influxClient "github.com/influxdata/influxdb/client/v2"
 	"io/ioutil"
-	"log"
 	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -19,6 +17,9 @@ var N_WORKERS int
 const N_WORKERS_DEFAULT = 2
 const DB_WAIT_TIME = 30
 
+// Name of the live analysis worker in internal metrics.
+const LIVE_WORKER = "live"
+
 // A Dashboard contains all the components necessary to make RPC calls to bitcoind, and
 // to place data into influxdb.
 type Dashboard struct {
@@ -26,9 +27,13 @@ type Dashboard struct {
 	iClient influxClient.Client
 	bp      influxClient.BatchPoints
 	DB      string
+	network NetworkParams
+	node    string
+	logger  Logger
 }
 
 // Assumes enviroment variables: DB, DB_USERNAME, DB_PASSWORD, BITCOIND_HOST, BITCOIND_USERNAME, BITCOIND_PASSWORD, are all set.
+// BITCOIND_NODE optionally names the node for the node tag.
 // influxd and bitcoind should already be started.
 func setupDashboard() Dashboard {
 	DB := os.Getenv("DB")
@@ -39,20 +44,8 @@ func setupDashboard() Dashboard {
 	BITCOIND_USERNAME := os.Getenv("BITCOIND_USERNAME")
 	BITCOIND_PASSWORD := os.Getenv("BITCOIND_PASSWORD")
 
-	// Connect to local bitcoin core RPC server using HTTP POST mode.
-	connCfg := &rpcclient.ConnConfig{
-		Host:         BITCOIND_HOST,
-		User:         BITCOIND_USERNAME,
-		Pass:         BITCOIND_PASSWORD,
-		HTTPPostMode: true, // Bitcoin core only supports HTTP POST mode
-		DisableTLS:   true, // Bitcoin core does not provide TLS by default
-	}
-	// Notice the notification parameter is nil since notifications are
-	// not supported in HTTP POST mode.
-	client, err := rpcclient.New(connCfg, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
+	// Connect to local bitcoin core RPC server.
+	client := newRPCClient(BITCOIND_HOST, BITCOIND_USERNAME, BITCOIND_PASSWORD)
 
 	// Setup influxdb client.
 	ic, err := influxClient.NewHTTPClient(influxClient.HTTPConfig{
@@ -61,7 +54,7 @@ func setupDashboard() Dashboard {
 		Password: DB_PASSWORD,
 	})
 	if err != nil {
-		log.Fatal(err)
+		Logger{}.Fatal("Error creating influxdb client", "err", err)
 	}
 
 	// Setup influx batchpoints.
@@ -69,7 +62,7 @@ func setupDashboard() Dashboard {
 		Database: DB,
 	})
 	if err != nil {
-		log.Fatal(err)
+		Logger{}.Fatal("Error creating new batchpoints", "err", err)
 	}
 
 	dash := Dashboard{
@@ -77,7 +70,12 @@ func setupDashboard() Dashboard {
 		ic,
 		bp,
 		DB,
+		NetworkParams{},
+		primaryNodeName(),
+		Logger{},
 	}
+	dash.network = dash.detectNetwork()
+	dash.detectSchema()
 
 	return dash
 }
@@ -87,14 +85,82 @@ func (dash *Dashboard) shutdown() {
 	dash.iClient.Close()
 }
 
+// writePoints writes the Dashboard's batchpoints to influxdb, retrying up to MAX_ATTEMPTS times.
+// On success the batchpoints are replaced with an empty batch. Returns false if the write failed.
+func (dash *Dashboard) writePoints() bool {
+	dash.addInternalPoints()
+
+	writeSuccessful := false
+	for attempts := 0; attempts <= MAX_ATTEMPTS; attempts++ {
+		start := time.Now()
+		err := dash.iClient.Write(dash.bp)
+		internal.observeWrite(start, err)
+		if err != nil {
+			dash.logger.Warn("Error writing to influxdb, trying again", "attempt", attempts+1, "err", err)
+			time.Sleep(1 * time.Second) // Sleep to give DB a break.
+			continue
+		}
+
+		writeSuccessful = true
+		break
+	}
+
+	points := len(dash.bp.Points())
+	internal.observeBatch(points, writeSuccessful)
+	if !writeSuccessful {
+		dash.logger.Error("Giving up on writing to influxdb", "attempt", MAX_ATTEMPTS+1, "points", points)
+		return false
+	}
+
+	dash.logger.Debug("Stored points in influxdb", "points", points)
+
+	// Setup influx batchpoints.
+	bp, err := influxClient.NewBatchPoints(influxClient.BatchPointsConfig{
+		Database: dash.DB,
+	})
+	if err != nil {
+		dash.logger.Fatal("Error creating new batchpoints", "err", err)
+	}
+
+	dash.bp = bp
+	return true
+}
+
+// COMMANDS maps subcommand names to the functions that run them with the remaining arguments.
+var COMMANDS = map[string]func(args []string){
+	"rollup":  rollupCommand,
+	"migrate": migrateCommand,
+	"schema":  schemaCommand,
+	"grafana": grafanaCommand,
+	"serve":   serveCommand,
+	"status":  statusCommand,
+	"jobs":    jobsCommand,
+}
+
 func main() {
 	recoveryFlagPtr := flag.Bool("recovery", false, "Set to true to start workers on files in ./worker-progress")
 	startPtr := flag.Int("start", 0, "Starting blockheight.")
 	endPtr := flag.Int("end", 0, "Last blockheight to analyze.")
 	nWorkersPtr := flag.Int("workers", N_WORKERS_DEFAULT, "Number of concurrent RPC workers.")
+	namePtr := flag.String("name", "", "Name of the job analyzing the range from start to end.")
 	flag.Parse()
 
 	N_WORKERS = *nWorkersPtr
+	defer closeScriptIndex()
+	setupLogging()
+
+	// Subcommands are given as the first argument after any flags.
+	if flag.NArg() > 0 {
+		command, ok := COMMANDS[flag.Arg(0)]
+		if !ok {
+			Logger{}.Fatal("Unknown command", "command", flag.Arg(0))
+		}
+
+		command(flag.Args()[1:])
+		return
+	}
+
+	startServers()
 
 	if *recoveryFlagPtr {
 		recoverFromFailure()
@@ -102,7 +168,7 @@ func main() {
 
 	// If both a start and end are given, analyze that range.
 	if (*startPtr > 0) && (*endPtr > 0) {
-		analyze(*startPtr, *endPtr)
+		analyze(*namePtr, *startPtr, *endPtr)
 		return
 	}
 
@@ -110,48 +176,51 @@ func main() {
 	doLiveAnalysis(*startPtr)
 }
 
-// Splits up work across N_WORKERS workers,each with their own RPC/db clients.
-func analyze(start, end int) {
-	var wg sync.WaitGroup
-	workSplit := (end - start) / N_WORKERS
-	log.Println("work split: ", workSplit, end-start, start, end)
-
-	currentDir, err := os.Getwd()
-	if err != nil {
-		log.Fatal(err)
+// startServers serves internal metrics and the admin API, if they're enabled.
+func startServers() {
+	if addr := metricsAddr(); addr != "" {
+		go serveMetrics(addr)
 	}
-
-	// Create the progress directory if it doesn't already exist.
-	workerProgressDir := currentDir + "/worker-progress"
-	if _, err := os.Stat(workerProgressDir); os.IsNotExist(err) {
-		log.Printf("Creating worker progress directory at: %v\n", workerProgressDir)
-		err := os.Mkdir(workerProgressDir, 0777)
-		if err != nil {
-			log.Fatal(err)
-		}
+	if addr := adminAddr(); addr != "" {
+		go serveAdmin(addr)
 	}
+}
 
-	formattedTime := time.Now().Format("01-02:15:04")
-
-	for i := 0; i < N_WORKERS; i++ {
-		wg.Add(1)
-		go func(i int) {
-			// Get name for this worker's progress file.
-			workFile := fmt.Sprintf("%v/worker-%v_%v", workerProgressDir, i, formattedTime)
+// analyze runs a named job in this process that splits up work across N_WORKERS workers,
+// each with their own RPC/db clients. There are never more workers than blocks.
+func analyze(name string, start, end int) {
+	if end <= start {
+		Logger{}.Fatal("The end must be after the start", "start", start, "end", end)
+	}
 
-			analyzeBlockRange(i, start+(workSplit*i), start+(workSplit*(i+1)), workFile)
-			wg.Done()
-		}(i)
+	nWorkers := N_WORKERS
+	if nWorkers > end-start {
+		nWorkers = end - start
 	}
-	wg.Wait()
+
+	jobsDir := setupJobsDir()
+	record := createJob(jobsDir, name, JobParams{start, end, nWorkers}, true)
+	runJob(jobsDir, record)
 }
 
-// Analyzes all blocks from in the interval [start, end)
-func analyzeBlockRange(workerID, start, end int, workFile string) {
+// Analyzes all blocks from in the interval [start, end) as one of a job's workers. The end
+// moves down if the job splits the range to give part of it to another worker. Between
+// blocks the worker waits while ingestion is paused, writes its points when asked to, and
+// stops if it's retired or the job is cancelled. Returns false if points couldn't be written,
+// leaving the rest of the range in its progress file.
+func analyzeBlockRange(job *rangeJob, workerID, start, end int, workFile string) bool {
 	dash := setupDashboard()
 	defer dash.shutdown()
 
-	log.Println(start, end)
+	worker := strconv.Itoa(workerID)
+	dash.logger = job.logger.With("worker", worker)
+	dash.logger.Info("Starting worker", "start", start, "end", end)
+
+	internal.startWorker(worker, int64(start), int64(end))
+	defer internal.finishWorker(worker)
+	if _, err := dash.blockCount(); err != nil {
+		dash.logger.Warn("Error getting block count", "err", err)
+	}
 
 	// Keep track of time since last write.
 	// If it was less than DB_WAIT_TIME seconds ago. don't write yet.
@@ -165,116 +234,195 @@ func analyzeBlockRange(workerID, start, end int, workFile string) {
 	file, err := os.Create(workFile)
 	defer file.Close()
 	if err != nil {
-		log.Fatal(err)
+		dash.logger.Fatal("Error creating progress file", "file", workFile, "err", err)
 	}
 
 	// Record progress in file.
-	progress := fmt.Sprintf("Start=%v\nLast=%v\nEnd=%v", start, start, end)
-	_, err = file.WriteAt([]byte(progress), 0)
+	progress := progressRecord(start, start, end, startTime)
+	err = writeProgress(file, progress)
 	if err != nil {
-		log.Fatal(err)
+		dash.logger.Fatal("Error writing progress", "file", workFile, "err", err)
 	}
 
-	for i := start; i < end; i++ {
-		startBlock := time.Now()
-		dash.analyzeBlock(int64(i))
-		log.Printf("Worker %v: Done with %v blocks total (height=%v) after %v (%v) \n", workerID, i-start+1, i, time.Since(startTime), time.Since(startBlock))
+	// recordProgress writes the points of every block up to last, and records it in the file.
+	// Returns false if the write failed.
+	recorded := start - 1
+	recordProgress := func(last int) bool {
+		if !dash.writePoints() {
+			// Mark the progress as failed, so it isn't mistaken for a worker that's still running.
+			err = writeProgress(file, fmt.Sprintf("%v\nFailed=%v", progress, time.Now().Unix()))
+			if err != nil {
+				dash.logger.Error("Error writing progress", "file", workFile, "err", err)
+			}
+			return false
+		}
 
-		// Only perform the write to influxDB if there hasn't been a write in the last 5 seconds.
-		// And make sure to do the write before finishing.
-		if !time.Now().After(lastWriteTime) && (i != end-1) {
-			continue
+		lastWriteTime = time.Now().Add(DB_WAIT_TIME * time.Second)
+
+		// Record progress in file, overwriting previous record.
+		progress = progressRecord(start, last, end, startTime)
+		err = writeProgress(file, progress)
+		if err != nil {
+			dash.logger.Fatal("Error writing progress", "file", workFile, "height", last, "err", err)
 		}
+		recorded = last
+		internal.checkpoint(worker, int64(last))
+		dash.logger.Info("Recorded progress", "height", last, "blocks", last-start+1, "elapsed", time.Since(startTime))
 
-		writeSuccessful := false
-		for attempts := 0; attempts <= MAX_ATTEMPTS; attempts++ {
-			err := dash.iClient.Write(dash.bp)
-			if err != nil {
-				log.Println("DB WRITE ERR: ", err)
-				log.Println("Trying DB write again...")
-				time.Sleep(1 * time.Second) // Sleep to give DB a break.
-				continue
+		// Keep the distance from the tip up to date, without stopping for RPC errors.
+		if _, err := dash.blockCount(); err != nil {
+			dash.logger.Warn("Error getting block count", "err", err)
+		}
+		return true
+	}
+
+	flushes := control.flushCount()
+	i := start
+	for ; ; i++ {
+		// Write everything analyzed so far before pausing, or when asked to.
+		count := control.flushCount()
+		flush := count != flushes
+		flushes = count
+		if (flush || control.isPaused()) && recorded < i-1 {
+			if !recordProgress(i - 1) {
+				return false
 			}
+		}
+		control.waitWhilePaused(job.isCancelled)
 
-			writeSuccessful = true
+		var stop bool
+		end, stop = job.poll(workerID, i)
+		if i >= end {
 			break
 		}
 
-		if !writeSuccessful {
-			log.Printf("DB write failed!")
-			return
-		}
+		if stop {
+			if recorded < i-1 && !recordProgress(i-1) {
+				return false
+			}
 
-		log.Printf("\n\n STORED INTO INFLUXDB \n\n")
+			// The rest of the range is left to another worker, which takes over the progress file.
+			if job.handOff(workRange{start: i, end: end, workFile: workFile}) {
+				dash.logger.Info("Worker retired", "height", i, "end", end)
+				return true
+			}
 
-		// Setup influx batchpoints.
-		bp, err := influxClient.NewBatchPoints(influxClient.BatchPointsConfig{
-			Database: dash.DB,
-		})
-		if err != nil {
-			log.Fatal("Error creating new batchpoints", err)
+			dash.logger.Info("Worker cancelled", "height", i, "end", end)
+			break
 		}
 
-		dash.bp = bp
-		lastWriteTime = time.Now().Add(DB_WAIT_TIME * time.Second)
+		startBlock := time.Now()
+		dash.analyzeBlock(int64(i))
+		internal.blockAnalyzed(worker, int64(i))
+		job.blockAnalyzed()
+		dash.logger.Sampled(int64(i-start), "Analyzed block", "height", i, "blocks", i-start+1, "elapsed", time.Since(startTime), "took", time.Since(startBlock))
 
-		// Record progress in file, overwriting previous record.
-		progress = fmt.Sprintf("Start=%v\nLast=%v\nEnd=%v", start, i, end)
-		_, err = file.WriteAt([]byte(progress), 0)
-		if err != nil {
-			log.Fatal("Error writing progress: ", err, progress)
+		// Only perform the write to influxDB if there hasn't been a write in the last 5 seconds.
+		// And make sure to do the write before finishing.
+		if !time.Now().After(lastWriteTime) && (i != end-1) {
+			continue
+		}
+
+		if !recordProgress(i) {
+			return false
 		}
 	}
 
+	// The range may have been split after its last block was analyzed.
+	if recorded < i-1 && !recordProgress(i-1) {
+		return false
+	}
+
 	// Worker finished successfully so its progress record is unneeded.
 	err = os.Remove(workFile)
 	if err != nil {
-		log.Printf("Error removing %v: %v\n", workFile, err)
+		dash.logger.Warn("Error removing progress file", "file", workFile, "err", err)
 	}
 
-	log.Printf("Worker %v done analyzing %v blocks (height=%v) after %v\n", workerID, end-start, end, time.Since(startTime))
+	dash.logger.Info("Worker done", "blocks", i-start, "height", i, "elapsed", time.Since(startTime))
+	return true
 }
 
 // analyzeBlock uses the getblockstats RPC to compute metrics of a single block.
-// It then stores the results in a batchpoint in the Dashboard's influx client.
-func (dash *Dashboard) analyzeBlock(blockHeight int64) {
+// It then stores the results in a batchpoint in the Dashboard's influx client, and returns
+// the block's block_metrics point.
+func (dash *Dashboard) analyzeBlock(blockHeight int64) StoredPoint {
 	tags := make(map[string]string)        // for influxdb
 	fields := make(map[string]interface{}) // for influxdb
 
 	// Use getblockstats RPC and merge results into the metrics struct.
+	start := throttleRPC()
 	blockStatsRes, err := dash.client.GetBlockStats(blockHeight, nil)
+	internal.observeRPC("getblockstats", start, err)
 	if err != nil {
-		log.Fatal(err)
+		dash.logger.Fatal("Error getting block stats", "height", blockHeight, "err", err)
 	}
 
 	blockStats := BlockStats{blockStatsRes}
 
+	// Fetch the full block to look at data getblockstats doesn't cover.
+	blockData, err := dash.getBlockData(blockStats.Hash)
+	if err != nil {
+		dash.logger.Fatal("Error getting block", "height", blockHeight, "err", err)
+	}
+
 	// Set influx tags and fields based off of the block stats computed.
-	blockStats.setInfluxTags(tags, blockHeight)
+	blockStats.setInfluxTags(tags, dash.network.Name, dash.node)
 	blockStats.setInfluxFields(fields)
+	setBlockKey(tags, fields, blockHeight, dash.network.Name)
+	tags["pool"] = identifyPool(blockData.Transactions[0], dash.network.ChainParams)
+
+	taprootStats := computeTaprootStats(blockData)
+	taprootStats.setInfluxFields(fields)
+
+	inscriptionStats := computeInscriptionStats(blockData)
+	inscriptionStats.setInfluxFields(fields)
+
+	// Reuse is left out while the script index is far behind the block.
+	if addressReuseStats, ok := dash.computeAddressReuseStats(blockData); ok {
+		addressReuseStats.setInfluxFields(fields)
+	}
+
+	coinAgeStats := dash.computeCoinAgeStats(blockData)
+	coinAgeStats.setInfluxFields(fields)
+
+	networkStats := dash.computeNetworkStats(blockData)
+	networkStats.setInfluxFields(fields)
+
+	setDerivedFields(fields)
 
 	// Create and add new influxdb point for this block.
 	blockTime := time.Unix(blockStats.Time, 0)
-	pt, err := influxClient.NewPoint(
+	pointTime := blockPointTime(blockTime, blockHeight)
+	pt, err := newPoint(
 		"block_metrics",
 		tags,
 		fields,
-		blockTime,
+		pointTime,
 	)
 	if err != nil {
-		log.Fatal("Error creating new point", err)
+		dash.logger.Fatal("Error creating new point", "height", blockHeight, "err", err)
 	}
 
 	dash.bp.AddPoint(pt)
+
+	dash.analyzeRollingWindows(blockHeight, blockTime, fields)
+	dash.analyzeScriptTypes(blockData, tags, pointTime)
+	dash.analyzeOpReturns(blockData, tags, pointTime)
+	dash.analyzeInscriptionContentTypes(blockHeight, inscriptionStats, tags, pointTime)
+	dash.analyzeDifficulty(blockHeight, blockStats.Hash)
+
+	return StoredPoint{pointTime, tags, fields}
 }
 
 // recoverFromFailure checks the worker-progress directory for any unfinished work from a previous job.
 // If there is any, it starts a new worker to continue the work for each previously failed worker.
 func recoverFromFailure() {
-	log.Println("Starting Recovery Process.")
+	logger := Logger{}.With("job", "recovery")
+	logger.Info("Starting recovery")
 	currentDir, err := os.Getwd()
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal("Error getting working directory", "err", err)
 	}
 
 	// If there is no worker-progress directory, then there aren't any failures :)
@@ -283,73 +431,89 @@ func recoverFromFailure() {
 		return
 	}
 
-	files, err := ioutil.ReadDir(workerProgressDir)
+	dash := setupDashboard()
+	defer dash.shutdown()
+	dash.logger = logger
+	checkProgressNetwork(workerProgressDir, dash.network.Name)
+
+	allFiles, err := ioutil.ReadDir(workerProgressDir)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal("Error reading progress directory", "dir", workerProgressDir, "err", err)
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(len(files))
-	nWorkersBusy := 0
-	doneCh := make(chan struct{}, N_WORKERS)
-
-	i := 0 // index into files, incremented at bottom of loop.
-	for i < len(files) {
-		// Check if any workers are free.
-		select {
-		case <-doneCh:
-			nWorkersBusy--
-		default:
-		}
-
-		// If all workers are busy, wait and continue.
-		if nWorkersBusy >= N_WORKERS {
-			time.Sleep(250 * time.Millisecond)
+	// Skip the file marking which network the progress belongs to, and the progress of
+	// named jobs, which is resumed by retrying them.
+	files := make([]os.FileInfo, 0, len(allFiles))
+	for _, file := range allFiles {
+		if strings.HasPrefix(file.Name(), "job-") {
+			logger.Info("Skipping progress of a named job, retry the job to resume it", "file", file.Name())
 			continue
 		}
+		if file.Name() != NETWORK_FILE {
+			files = append(files, file)
+		}
+	}
 
-		// Assign work to a free worker.
-		nWorkersBusy++
-
-		file := files[i]
-		contentsBytes, err := ioutil.ReadFile(workerProgressDir + "/" + file.Name())
+	// Unfinished ranges and blocks are queued on a job, which runs them on N_WORKERS workers.
+	job := newRangeJob("recovery", workerProgressDir, N_WORKERS)
+	for _, file := range files {
+		workFile := workerProgressDir + "/" + file.Name()
+		contentsBytes, err := ioutil.ReadFile(workFile)
 		if err != nil {
-			log.Fatal(err)
+			logger.Fatal("Error reading progress file", "file", file.Name(), "err", err)
 		}
 		contents := string(contentsBytes)
 
 		progress := parseProgress(contents)
-		if len(progress) == 3 {
-			log.Printf("Starting recovery worker %v on range [%v, %v) at height %v\n", i, progress[0], progress[2], progress[1])
-			go func(i int, file os.FileInfo) {
-				analyzeBlockRange(i, progress[1], progress[2], workerProgressDir+"/"+file.Name())
-				doneCh <- struct{}{}
-				wg.Done()
-			}(i, file)
-		} else if len(progress) == 1 {
+		_, isRange := progress["End"]
+		_, isLive := progress["Height"]
+		if isRange {
+			logger.Info("Resuming range", "file", file.Name(), "start", progress["Start"], "end", progress["End"], "height", progress["Last"])
+			job.pending = append(job.pending, workRange{start: progress["Last"], end: progress["End"], workFile: workFile})
+		} else if isLive {
 			// Finish work done during a live analysis.
-			log.Printf("Starting recovery worker %v on block %v\n", i, progress[0])
-			go func(i int, file os.FileInfo) {
-				analyzeBlockLive(int64(progress[0]), workerProgressDir+"/"+file.Name())
-				doneCh <- struct{}{}
-				wg.Done()
-			}(i, file)
+			logger.Info("Resuming live block", "file", file.Name(), "height", progress["Height"])
+			job.pending = append(job.pending, workRange{start: progress["Height"], end: progress["Height"] + 1, workFile: workFile, live: true})
 		} else {
-			log.Fatal("Bad progress given: ", progress)
+			logger.Fatal("Bad progress file", "file", file.Name(), "progress", fmt.Sprint(progress))
 		}
+	}
+	job.run()
 
-		i++
+	if job.isCancelled() {
+		logger.Info("Recovery cancelled")
+		return
 	}
-	wg.Wait()
 
-	log.Println("Finished with Recovery.")
+	dash.completeRollingWindows()
+
+	logger.Info("Finished recovery", "files", len(files))
 }
 
-// parseProgress takes in the contents of a worker-progress file
-// and returns the starting height, the last height completed, and the end height.
-func parseProgress(contents string) []int {
+// progressRecord formats the progress of a worker analyzing the range [start, end) that
+// started at the given time and has written every block up to last.
+func progressRecord(start, last, end int, started time.Time) string {
+	return fmt.Sprintf("Start=%v\nLast=%v\nEnd=%v\nStarted=%v", start, last, end, started.Unix())
+}
+
+// writeProgress replaces the contents of a progress file with a record. The file is
+// truncated first, since a record can be shorter than the one before it when a split
+// moves the end of a range down.
+func writeProgress(file *os.File, record string) error {
+	err := file.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.WriteAt([]byte(record), 0)
+	return err
+}
+
+// parseProgress takes in the contents of a worker-progress file and returns its values by name:
+// Start, Last, End, Started and Failed (a unix time) for ranges, or Height for live analysis.
+func parseProgress(contents string) map[string]int {
 	lines := strings.Split(contents, "\n")
-	result := make([]int, 0)
+	result := make(map[string]int)
 
 	for _, line := range lines {
 		split := strings.Split(line, "=")
@@ -357,12 +521,12 @@ func parseProgress(contents string) []int {
 		if len(split) < 2 {
 			continue
 		}
-		height, err := strconv.Atoi(split[1])
+		value, err := strconv.Atoi(split[1])
 		if err != nil {
-			log.Fatal(err)
+			Logger{}.Fatal("Bad progress record", "line", line, "err", err)
 		}
 
-		result = append(result, height)
+		result[split[0]] = value
 	}
 
 	return result
@@ -372,30 +536,28 @@ func parseProgress(contents string) []int {
 // In order to avoid dealing with re-org in this code-base, it should
 // stay at least 6 blocks behind.
 func doLiveAnalysis(height int) {
-	log.Println("Starting a live analysis of the blockchain.")
+	logger := Logger{}.With("job", "live", "worker", LIVE_WORKER)
+	logger.Info("Starting live analysis")
 	formattedTime := time.Now().Format("01-02:15:04")
 
 	dash := setupDashboard()
 	defer dash.shutdown()
+	dash.logger = logger
 
-	currentDir, err := os.Getwd()
-	if err != nil {
-		log.Fatal(err)
-	}
+	workerProgressDir := setupWorkerProgressDir(dash.network.Name)
 
-	// Create the progress directory if it doesn't already exist.
-	workerProgressDir := currentDir + "/worker-progress"
-	if _, err := os.Stat(workerProgressDir); os.IsNotExist(err) {
-		log.Printf("Creating worker progress directory at: %v\n", workerProgressDir)
-		err := os.Mkdir(workerProgressDir, 0777)
-		if err != nil {
-			log.Fatal(err)
-		}
+	// Other nodes are polled for every block to catch disagreements between bitcoind versions.
+	nodes := dash.connectNodes()
+	defer shutdownNodes(nodes)
+
+	if addr := streamAddr(); addr != "" {
+		go serveStream(addr)
 	}
+	setupAlerts(dash.network.Name)
 
-	blockCount, err := dash.client.GetBlockCount()
+	blockCount, err := dash.blockCount()
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal("Error getting block count", "err", err)
 	}
 
 	workFile := fmt.Sprintf("%v/live-worker_%v", workerProgressDir, formattedTime)
@@ -406,16 +568,65 @@ func doLiveAnalysis(height int) {
 	} else {
 		lastAnalysisStarted = int64(height)
 	}
+	internal.startWorker(LIVE_WORKER, lastAnalysisStarted, 0)
+	logger.Info("Following the tip", "height", lastAnalysisStarted, "tip", blockCount)
+
+	// Load the blocks before the starting height so rolling windows can be computed right away.
+	previousHeights := make([]int64, 0)
+	for h := lastAnalysisStarted - maxRollingWindow() + 1; h < lastAnalysisStarted; h++ {
+		if h >= 0 {
+			previousHeights = append(previousHeights, h)
+		}
+	}
+	dash.loadRollingBlocks(previousHeights)
+	dash.writePoints()
+
+	// Daily and weekly rollups are written once the median time past of the block
+	// ROLLUP_CONFIRMATIONS below the tip is in a later day.
+	var prevMedianTime time.Time
+
 	heightInRangeOfTip := (blockCount - lastAnalysisStarted) <= 6
 	for {
 		if heightInRangeOfTip {
 			time.Sleep(500 * time.Millisecond)
-			blockCount, err = dash.client.GetBlockCount()
+			blockCount, err = dash.blockCount()
 			if err != nil {
-				log.Fatal(err)
+				logger.Fatal("Error getting block count", "err", err)
 			}
+			alerting.checkStale(time.Now())
 		} else {
-			analyzeBlockLive(lastAnalysisStarted, workFile)
+			control.waitWhilePaused(func() bool { return false })
+
+			header, err := dash.getBlockHeaderAtHeight(lastAnalysisStarted)
+			if err != nil {
+				logger.Fatal("Error getting block header", "height", lastAnalysisStarted, "err", err)
+			}
+
+			// Blocks published before a reorg are retracted and the new blocks at
+			// their heights are analyzed in their place.
+			if retracted := dash.retractReorganizedBlocks(header); retracted > 0 {
+				lastAnalysisStarted -= retracted
+				continue
+			}
+
+			analyzeBlockLive(logger, lastAnalysisStarted, workFile)
+
+			if confirmed := lastAnalysisStarted - ROLLUP_CONFIRMATIONS; confirmed >= 0 {
+				confirmedHeader, err := dash.getBlockHeaderAtHeight(confirmed)
+				if err != nil {
+					logger.Fatal("Error getting block header", "height", confirmed, "err", err)
+				}
+
+				medianTime := time.Unix(confirmedHeader.MedianTime, 0)
+				if !prevMedianTime.IsZero() {
+					dash.rollupClosedPeriods(prevMedianTime, medianTime)
+				}
+				prevMedianTime = medianTime
+			}
+
+			dash.checkNodeDivergence(lastAnalysisStarted, nodes)
+			dash.writePoints()
+
 			lastAnalysisStarted += 1
 		}
 
@@ -425,12 +636,10 @@ func doLiveAnalysis(height int) {
 
 // analyzeBlock uses the getblockstats RPC to compute metrics of a single block.
 // It then stores the results in a batchpoint in the Dashboard's influx client.
-func analyzeBlockLive(blockHeight int64, workFile string) {
+func analyzeBlockLive(logger Logger, blockHeight int64, workFile string) {
 	dash := setupDashboard()
 	defer dash.shutdown()
-
-	tags := make(map[string]string)        // for influxdb
-	fields := make(map[string]interface{}) // for influxdb
+	dash.logger = logger.With("height", blockHeight)
 
 	start := time.Now()
 
@@ -438,69 +647,37 @@ func analyzeBlockLive(blockHeight int64, workFile string) {
 	file, err := os.Create(workFile)
 	defer file.Close()
 	if err != nil {
-		log.Fatal(err)
+		dash.logger.Fatal("Error creating progress file", "file", workFile, "err", err)
 	}
 
 	// Record progress in file.
 	progress := fmt.Sprintf("Height=%v", blockHeight)
 	_, err = file.WriteAt([]byte(progress), 0)
 	if err != nil {
-		log.Fatal(err)
+		dash.logger.Fatal("Error writing progress", "file", workFile, "err", err)
 	}
 
-	// Use getblockstats RPC and merge results into the metrics struct.
-	blockStatsRes, err := dash.client.GetBlockStats(blockHeight, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	blockStats := BlockStats{blockStatsRes}
-
-	// Set influx tags and fields based off of the block stats computed.
-	blockStats.setInfluxTags(tags, blockHeight)
-	blockStats.setInfluxFields(fields)
-
-	// Create and add new influxdb point for this block.
-	blockTime := time.Unix(blockStats.Time, 0)
-	pt, err := influxClient.NewPoint(
-		"block_metrics",
-		tags,
-		fields,
-		blockTime,
-	)
-	if err != nil {
-		log.Fatal("Error creating new point", err)
-	}
-
-	dash.bp.AddPoint(pt)
+	point := dash.analyzeBlock(blockHeight)
+	internal.blockAnalyzed(LIVE_WORKER, blockHeight)
 
 	// Try writing the point to influxdb.
-	writeSuccessful := false
-	for attempts := 0; attempts <= MAX_ATTEMPTS; attempts++ {
-		err := dash.iClient.Write(dash.bp)
-		if err != nil {
-			log.Println("DB WRITE ERR: ", err)
-			log.Println("Trying DB write again...")
-			time.Sleep(1 * time.Second) // Sleep to give DB a break.
-			continue
-		}
-
-		log.Printf("\n\n STORED INTO INFLUXDB \n\n")
-
-		writeSuccessful = true
-		break
+	if !dash.writePoints() {
+		return
 	}
+	internal.checkpoint(LIVE_WORKER, blockHeight)
 
-	if !writeSuccessful {
-		log.Printf("DB write failed!")
-		return
+	block, err := dash.blockResponse(point)
+	if err != nil {
+		dash.logger.Fatal("Error converting block for the stream", "err", err)
 	}
+	stream.publishBlock(block)
+	alerting.evaluateBlock(blockHeight, point.Fields)
 
 	// Worker finished successfully so its progress record is unneeded.
 	err = os.Remove(workFile)
 	if err != nil {
-		log.Printf("Error removing %v: %v\n", workFile, err)
+		dash.logger.Warn("Error removing progress file", "file", workFile, "err", err)
 	}
 
-	log.Printf("Done with block %v after %v\n", blockHeight, time.Since(start))
+	dash.logger.Info("Analyzed block", "took", time.Since(start))
 }
@@ -1,9 +1,11 @@
 package dashboard
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/btcsuite/btcd/btcjson"
-	"strconv"
+	influxClient "github.com/influxdata/influxdb/client/v2"
+	"time"
 )
 
 const PROFILE = false
@@ -18,8 +20,9 @@ type BlockStats struct {
 	*btcjson.GetBlockStatsResult
 }
 
-func (metrics BlockStats) setInfluxTags(tags map[string]string, height int64) {
-	tags["height"] = strconv.Itoa(int(height))
+func (metrics BlockStats) setInfluxTags(tags map[string]string, network, node string) {
+	tags["network"] = network
+	tags["node"] = node
 }
 
 func (metrics BlockStats) setInfluxFields(fields map[string]interface{}) {
@@ -91,59 +94,87 @@ func (metrics BlockStats) setInfluxFields(fields map[string]interface{}) {
 		fieldName := fmt.Sprintf("output_count_bin_%v", i)
 		fields[fieldName] = metrics.OutputCountBins[i]
 	}
+}
 
-	// Derived fields added below /////////////////////////////////////////////////////
-
-	fields["num_txs_creating_native_segwit_outputs"] = metrics.TxsCreatingP2WPKHOutputs + metrics.TxsCreatingP2WSHOutputs
-	// Avoid divide by 0 errors.
-	if metrics.Txs != 0 {
-		// Batch ranges =  [(1), (2), (3-4), (5-9), (10-49), (50-99), (100+)]
-		for i := 0; i < nOutputCountBins; i++ {
-			fieldName := fmt.Sprintf("batch_range_%v", i)
-			fields[fieldName] = float64(metrics.OutputCountBins[i]) / float64(metrics.Txs)
-		}
+// A StoredPoint is a point read back out of influxdb.
+type StoredPoint struct {
+	Time   time.Time
+	Tags   map[string]string
+	Fields map[string]interface{}
+}
 
-		fields["percent_txs_signalling_RBF"] = float64(metrics.TxsSignallingRBF) / float64(metrics.Txs)
-		fields["percent_txs_batching"] = float64(metrics.TxsBatching) / float64(metrics.Txs)
-		fields["percent_txs_consolidating"] = float64(metrics.TxsConsolidating) / float64(metrics.Txs)
-		fields["percent_txs_creating_native_segwit_outputs"] = float64(metrics.TxsCreatingP2WPKHOutputs+metrics.TxsCreatingP2WSHOutputs) / float64(metrics.Txs)
-		fields["percent_txs_creating_P2WSH_outputs"] = float64(metrics.TxsCreatingP2WSHOutputs) / float64(metrics.Txs)
-		fields["percent_txs_creating_P2WPKH_outputs"] = float64(metrics.TxsCreatingP2WPKHOutputs) / float64(metrics.Txs)
-		fields["percent_txs_spending_native_segwit_outputs"] = float64(metrics.TxsSpendingNativeP2WPKHOutputs+metrics.TxsSpendingNativeP2WSHOutputs) / float64(metrics.Txs)
-		fields["percent_txs_spending_native_P2WPKH_outputs"] = float64(metrics.TxsSpendingNativeP2WPKHOutputs) / float64(metrics.Txs)
-		fields["percent_txs_spending_native_P2WSH_outputs"] = float64(metrics.TxsSpendingNativeP2WSHOutputs) / float64(metrics.Txs)
-		fields["percent_txs_spending_nested_P2WPKH_outputs"] = float64(metrics.TxsSpendingNestedP2WPKHOutputs) / float64(metrics.Txs)
-		fields["percent_txs_spending_nested_P2WSH_outputs"] = float64(metrics.TxsSpendingNestedP2WSHOutputs) / float64(metrics.Txs)
-		fields["percent_txs_spending_P2WSH_outputs"] = float64(metrics.TxsSpendingNativeP2WSHOutputs+metrics.TxsSpendingNestedP2WSHOutputs) / float64(metrics.Txs)
-		fields["percent_txs_spending_P2WPKH_outputs"] = float64(metrics.TxsSpendingNativeP2WPKHOutputs+metrics.TxsSpendingNestedP2WPKHOutputs) / float64(metrics.Txs)
-		fields["percent_txs_that_are_segwit_txs"] = float64(metrics.SegWitTxs) / float64(metrics.Txs)
+// queryPoints runs the given InfluxQL query against the dashboard's database and returns
+// every point in the result. Queries should use GROUP BY * so that tags are
+// returned separately from fields.
+func (dash *Dashboard) queryPoints(command string) ([]StoredPoint, error) {
+	res, err := dash.iClient.Query(influxClient.NewQuery(command, dash.DB, "s"))
+	if err != nil {
+		return nil, err
+	}
+	if res.Error() != nil {
+		return nil, res.Error()
 	}
 
-	// Avoid divide by 0 errors.
-	if metrics.Ins != 0 {
-		fields["percent_of_inputs_spending_nested_P2WPKH_output"] = float64(metrics.NestedP2WPKHOutputsSpent) / float64(metrics.Ins)
-		fields["percent_of_inputs_spending_native_P2WPKH_outputs"] = float64(metrics.NativeP2WPKHOutputsSpent) / float64(metrics.Ins)
-		fields["percent_of_inputs_spending_P2WPKH_outputs"] = float64(metrics.NativeP2WPKHOutputsSpent+metrics.NestedP2WPKHOutputsSpent) / float64(metrics.Ins)
-		fields["percent_of_inputs_spending_nested_P2WSH_outputs"] = float64(metrics.NestedP2WSHOutputsSpent) / float64(metrics.Ins)
-		fields["percent_of_inputs_spending_native_P2WSH_outputs"] = float64(metrics.NativeP2WSHOutputsSpent) / float64(metrics.Ins)
-		fields["percent_of_inputs_spending_P2WSH_outputs"] = float64(metrics.NativeP2WSHOutputsSpent+metrics.NestedP2WSHOutputsSpent) / float64(metrics.Ins)
-		fields["percent_of_inputs_spending_native_sw_outputs"] = float64(metrics.NativeP2WSHOutputsSpent+metrics.NativeP2WSHOutputsSpent) / float64(metrics.Ins)
-		fields["percent_inputs_consolidated"] = float64(metrics.OutputsConsolidated) / float64(metrics.Ins)
+	points := make([]StoredPoint, 0)
+	for _, result := range res.Results {
+		for _, row := range result.Series {
+			for _, values := range row.Values {
+				point := StoredPoint{
+					Tags:   row.Tags,
+					Fields: make(map[string]interface{}),
+				}
+
+				for i, column := range row.Columns {
+					if values[i] == nil {
+						continue
+					}
+
+					if column == "time" {
+						seconds, err := values[i].(json.Number).Int64()
+						if err != nil {
+							return nil, err
+						}
+						point.Time = time.Unix(seconds, 0)
+						continue
+					}
+
+					point.Fields[column] = fromJSONValue(values[i])
+				}
+
+				points = append(points, point)
+			}
+		}
 	}
 
-	// Avoid divide by 0 errors.
-	if metrics.Outs != 0 {
-		fields["percent_new_outs_P2WPKH_outputs"] = float64(metrics.NewP2WPKHOutputs) / float64(metrics.Outs)
-		fields["percent_new_outs_P2WSH_outputs"] = float64(metrics.NewP2WSHOutputs) / float64(metrics.Outs)
+	return points, nil
+}
 
-		for i := 0; i < nDustBins; i++ {
-			fieldName := fmt.Sprintf("percent_new_outs_in_dust_bin_%v", i)
-			fields[fieldName] = float64(metrics.DustBins[i]) / float64(metrics.Outs)
-		}
+// fromJSONValue converts numbers in influxdb query results to int64 or float64.
+func fromJSONValue(value interface{}) interface{} {
+	number, ok := value.(json.Number)
+	if !ok {
+		return value
+	}
+
+	if i, err := number.Int64(); err == nil {
+		return i
+	}
+	if f, err := number.Float64(); err == nil {
+		return f
 	}
+	return value
+}
 
-	// Avoid divide by 0 errors.
-	if metrics.SegWitTxs != 0 {
-		fields["percent_txs_native_segwit_over_total_sw_txs"] = float64(metrics.TxsSpendingNativeP2WSHOutputs+metrics.TxsSpendingNativeP2WPKHOutputs) / float64(metrics.SegWitTxs)
+// toFloat converts a numeric field value to a float64. The second return value
+// is false for non-numeric values.
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
 	}
+	return 0, false
 }
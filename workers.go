@@ -0,0 +1,295 @@
+package dashboard
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Ranges with fewer blocks left than this aren't split to give new workers something to do.
+const MIN_SPLIT_BLOCKS = 20
+
+// A workRange is a range of blocks [start, end) waiting for a worker, or a single block left
+// over from live analysis. Ranges that were already started have a worker-progress file.
+type workRange struct {
+	start, end int
+	workFile   string
+	live       bool
+}
+
+// rangeWorker is the part of a worker's state that can be changed while it's running.
+type rangeWorker struct {
+	next    int // height the worker is about to analyze
+	end     int
+	retired bool
+}
+
+// A rangeJob runs a set of ranges on a pool of workers whose size can change while it runs.
+// Ranges are taken from a queue; when the pool grows the largest remaining range is split
+// in two, and when it shrinks workers hand what's left of their range back to the queue.
+type rangeJob struct {
+	sync.Mutex
+	kind          string // analyze or recovery
+	id            int    // ID of the named job being run, or 0
+	logger        Logger
+	dir           string // worker-progress directory
+	filePrefix    string // prefix of the names of progress files
+	formattedTime string
+	pending       []workRange
+	workers       map[int]*rangeWorker
+	nextID        int
+	target        int
+	cancelled     bool
+	blocks        int // blocks analyzed
+	failures      int // ranges left unfinished because their points couldn't be written
+	wg            sync.WaitGroup
+}
+
+func newRangeJob(kind, dir string, nWorkers int) *rangeJob {
+	return &rangeJob{
+		kind:          kind,
+		logger:        Logger{}.With("job", kind),
+		dir:           dir,
+		formattedTime: time.Now().Format("01-02:15:04"),
+		pending:       make([]workRange, 0),
+		workers:       make(map[int]*rangeWorker),
+		target:        nWorkers,
+	}
+}
+
+// run starts the workers on the queued ranges, and returns once every range is done or
+// the job is cancelled.
+func (job *rangeJob) run() {
+	control.setJob(job)
+	defer control.setJob(nil)
+
+	job.Lock()
+	job.fill()
+	job.Unlock()
+
+	job.wg.Wait()
+}
+
+// workFile returns the name of the progress file of a worker's range.
+func (job *rangeJob) workFile(id int) string {
+	return fmt.Sprintf("%v/%vworker-%v_%v", job.dir, job.filePrefix, id, job.formattedTime)
+}
+
+// active returns the number of workers that haven't been retired. Must be called with the job locked.
+func (job *rangeJob) active() int {
+	n := 0
+	for _, worker := range job.workers {
+		if !worker.retired {
+			n++
+		}
+	}
+	return n
+}
+
+// fill starts workers on queued ranges until there are target workers or no ranges left.
+// Must be called with the job locked.
+func (job *rangeJob) fill() {
+	for !job.cancelled && job.active() < job.target && len(job.pending) > 0 {
+		job.start(job.pending[0])
+		job.pending = job.pending[1:]
+	}
+}
+
+// start starts a worker on a range. Must be called with the job locked.
+func (job *rangeJob) start(r workRange) {
+	id := job.nextID
+	job.nextID++
+	job.workers[id] = &rangeWorker{next: r.start, end: r.end}
+
+	job.wg.Add(1)
+	go func() {
+		defer job.wg.Done()
+		job.runWorker(id, r)
+	}()
+}
+
+// runWorker analyzes ranges until the queue is empty, or the worker is retired.
+func (job *rangeJob) runWorker(id int, r workRange) {
+	for {
+		if r.live {
+			analyzeBlockLive(job.logger.With("worker", strconv.Itoa(id)), int64(r.start), r.workFile)
+		} else {
+			if !analyzeBlockRange(job, id, r.start, r.end, r.workFile) {
+				job.fail()
+			}
+		}
+
+		var ok bool
+		r, ok = job.take(id)
+		if !ok {
+			return
+		}
+	}
+}
+
+// take gives a worker that finished its range the next queued range, or removes the worker.
+func (job *rangeJob) take(id int) (workRange, bool) {
+	job.Lock()
+	defer job.Unlock()
+
+	worker := job.workers[id]
+	if worker.retired || job.cancelled || len(job.pending) == 0 {
+		delete(job.workers, id)
+		return workRange{}, false
+	}
+
+	r := job.pending[0]
+	job.pending = job.pending[1:]
+	worker.next, worker.end = r.start, r.end
+	return r, true
+}
+
+// poll is called by a worker before each block. It returns the end of the worker's range,
+// which moves down if the range was split, and whether the worker should stop.
+func (job *rangeJob) poll(id, height int) (int, bool) {
+	job.Lock()
+	defer job.Unlock()
+
+	worker := job.workers[id]
+	worker.next = height
+	return worker.end, worker.retired || job.cancelled
+}
+
+// handOff queues the rest of a stopped worker's range, unless the job was cancelled.
+// It returns false if the job was cancelled.
+func (job *rangeJob) handOff(r workRange) bool {
+	job.Lock()
+	defer job.Unlock()
+
+	if job.cancelled {
+		return false
+	}
+	job.pending = append(job.pending, r)
+	job.fill()
+	return true
+}
+
+// resize changes the number of workers. New workers take queued ranges first, then split
+// the largest remaining range. Extra workers stop before their next block.
+func (job *rangeJob) resize(n int) {
+	job.Lock()
+	defer job.Unlock()
+
+	job.target = n
+	job.fill()
+
+	for job.active() < job.target {
+		largest, remaining := -1, 0
+		for id, worker := range job.workers {
+			if !worker.retired && worker.end-worker.next > remaining {
+				largest, remaining = id, worker.end-worker.next
+			}
+		}
+		if remaining < 2*MIN_SPLIT_BLOCKS {
+			break
+		}
+
+		// The new worker records its own progress. Until the old worker records its new end,
+		// the overlap would be analyzed twice by the recovery process, which is harmless.
+		worker := job.workers[largest]
+		mid := worker.next + remaining/2
+		r := workRange{start: mid, end: worker.end, workFile: job.workFile(job.nextID)}
+		worker.end = mid
+		job.logger.Info("Splitting range", "worker", strconv.Itoa(largest), "start", r.start, "end", r.end)
+		job.start(r)
+	}
+
+	// Retire the newest workers first.
+	ids := make([]int, 0, len(job.workers))
+	for id, worker := range job.workers {
+		if !worker.retired {
+			ids = append(ids, id)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+	for i := 0; i < len(ids)-job.target; i++ {
+		job.workers[ids[i]].retired = true
+	}
+
+	job.logger.Info("Resized workers", "workers", job.target)
+}
+
+// cancel stops every worker before its next block and drops the queued ranges along with
+// their progress, so the recovery process doesn't resume them.
+func (job *rangeJob) cancel() {
+	job.Lock()
+	defer job.Unlock()
+
+	job.cancelled = true
+	for _, r := range job.pending {
+		if r.workFile != "" {
+			os.Remove(r.workFile)
+		}
+	}
+	job.pending = nil
+	job.logger.Info("Cancelled job")
+}
+
+func (job *rangeJob) isCancelled() bool {
+	job.Lock()
+	defer job.Unlock()
+
+	return job.cancelled
+}
+
+func (job *rangeJob) blockAnalyzed() {
+	job.Lock()
+	defer job.Unlock()
+
+	job.blocks++
+}
+
+func (job *rangeJob) fail() {
+	job.Lock()
+	defer job.Unlock()
+
+	job.failures++
+}
+
+// results returns the number of blocks analyzed and the number of ranges that failed.
+func (job *rangeJob) results() (int, int) {
+	job.Lock()
+	defer job.Unlock()
+
+	return job.blocks, job.failures
+}
+
+// JobWorkerState is the state of a worker as reported by the admin API.
+type JobWorkerState struct {
+	ID      int  `json:"id"`
+	Next    int  `json:"next"`
+	End     int  `json:"end"`
+	Retired bool `json:"retired"`
+}
+
+// JobState is the state of a job as reported by the admin API.
+type JobState struct {
+	ID        int              `json:"id,omitempty"` // ID of the named job, if it is one
+	Kind      string           `json:"kind"`
+	Target    int              `json:"target_workers"`
+	Workers   []JobWorkerState `json:"workers"`
+	Pending   int              `json:"pending_ranges"`
+	Cancelled bool             `json:"cancelled"`
+}
+
+func (job *rangeJob) state() JobState {
+	job.Lock()
+	defer job.Unlock()
+
+	state := JobState{job.id, job.kind, job.target, make([]JobWorkerState, 0), len(job.pending), job.cancelled}
+	for id, worker := range job.workers {
+		state.Workers = append(state.Workers, JobWorkerState{id, worker.next, worker.end, worker.retired})
+	}
+	sort.Slice(state.Workers, func(i, j int) bool {
+		return state.Workers[i].ID < state.Workers[j].ID
+	})
+	return state
+}